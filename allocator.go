@@ -1,6 +1,8 @@
 package goskip
 
 import (
+	"errors"
+	"runtime"
 	"sync/atomic"
 	"unsafe"
 )
@@ -39,86 +41,272 @@ import (
  boundary. Similar to Data Padding, you should set the
  alignment to the size of the cache line.
 */
-
 // Default size of the node type, in bytes.
 // This value will be used for allocating memory for node.
-const defaultNodeSize = uint32(unsafe.Sizeof(node{}))
+const defaultNodeSize = uint64(unsafe.Sizeof(node{}))
 
 // 0 means nil pointer for offsets of Allocator.
-const nilAllocatorOffset = uint32(0)
-const initialAllocatorOffset = uint32(1)
+const nilAllocatorOffset = uint64(0)
+const initialAllocatorOffset = uint64(1)
+
+// Max size of an allocator whose offsets fit in 32 bits.
+const maxCompactAllocatorSize = uint64(1 << 32)
+
+// Alignment of nodes in memory, in bytes.
+// Nodes are accessed with 64-bit atomic operations, which require 8 byte
+// alignment on 32-bit platforms and are much slower when misaligned on others.
+const nodeAlignment = uint64(8)
+
+// Cache line size of the most common CPUs, in bytes.
+const cacheLineSize = 64
+
+// Blocks larger than chunkSize/maxChunkedBlockRatio are never allocated
+// in chunks, so that at most that ratio of a chunk is abandoned at its tail.
+const maxChunkedBlockRatio = 8
+
+// ErrArenaFull is returned when there is not enough memory left in an arena.
+var ErrArenaFull = errors.New("goskip: arena is full")
+
+// Arena is the memory a skip list keeps its nodes, keys and values in.
+// Memory is addressed by offsets, offset 0 is never allocated since it is
+// used as nil. Allocator is the default implementation; others can be
+// passed to NewSkipList with WithArenas, e.g. to keep memory off-heap or to
+// inject faults in tests.
+//
+// Every allocated block must be contiguous, and must not move or be reused
+// while the arena is in use, since lists keep pointers into it.
+type Arena interface {
+	// Allocate reserves a block of given size whose address is a multiple
+	// of given alignment, a power of 2, and returns its offset.
+	// It is called concurrently by writers. If the block can not be
+	// allocated, an error such as ErrArenaFull is returned, which is
+	// returned by Set as well.
+	Allocate(size uint64, align uint64) (uint64, error)
 
-// const cacheLineSize = 64
-// const paddingLimit = 15
+	// BytesAt returns the bytes [offset, offset+size) of an allocated block.
+	BytesAt(offset uint64, size uint64) []byte
 
+	// NodeAt returns a pointer to the allocated block at given offset.
+	// Nodes are read and written through it, also with atomic operations.
+	// Nodes lower than max height are shorter than the node type, so the
+	// memory must extend past the last block by the size of a node.
+	NodeAt(offset uint64) unsafe.Pointer
+
+	// Used returns the number of bytes reserved so far. Every allocated
+	// block ends before Used.
+	Used() uint64
+
+	// Capacity returns the total number of bytes.
+	Capacity() uint64
+}
+
+// Allocator is a bump allocator on a byte slice, the default Arena.
 type Allocator struct {
+	// Pointer to the beginning of available memory.
+	// Kept as the first field so that it is 64-bit aligned for atomic access.
+	// Lists in compact mode only address the first 2^32 = 4GB.
+	offset uint64
+
+	// Number of bytes abandoned at the tails of chunks.
+	// Kept right after offset so that it is 64-bit aligned for atomic access.
+	tailWaste uint64
+
 	// Actual memory space where we keep the data.
 	mem []byte
 
-	// Pointer to the beginning of available memory.
-	// Max addressable memory 2^32 = 4GB.
-	offset uint32
+	// If chunkSize is not 0, small blocks are allocated in chunks of this
+	// size, each used by a single writer at a time. Writers then bump their
+	// own chunk offset and only touch offset once per chunk.
+	chunkSize uint64
+
+	// Chunks of writers, number of chunks is a power of 2.
+	chunks []allocChunk
+
+	// Whether mem is mapped by NewMmapAllocator and must be unmapped by Close.
+	mapped bool
+}
+
+// allocChunk is a part of allocator memory which is used by a single writer
+// at a time. Its fields are only accessed by the writer which set busy.
+type allocChunk struct {
+	// [offset, end) is the unused part of the chunk.
+	offset uint64
+	end    uint64
+
+	// 1 while the chunk is used by a writer.
+	busy uint32
+
+	// Pad the chunk to a cache line to prevent false sharing.
+	_ [cacheLineSize - 20]byte
+}
+
+// NewAllocator allocates a buffer with given size and returns a new allocator.
+func NewAllocator(size uint64) *Allocator {
+	return newAllocator(size)
 }
 
 // newAllocator allocates a buffer with given size and returns a new allocator.
-func newAllocator(size uint32) *Allocator {
+func newAllocator(size uint64) *Allocator {
 	// Set initial offset as 1 since 0 is used for nil pointers.
-	return &Allocator{make([]byte, size), initialAllocatorOffset}
-}
-
-// new reserves a block on memory and returns offset to it.
-func (allc *Allocator) new(size uint32) uint32 {
-	// Multiple goroutines might modify offset value.
-	// We need to calculate new offset atomically.
-	// TODO overflow
-	newOffset := atomic.AddUint32(&allc.offset, size)
-	return newOffset - size
-}
-
-// putBytes will copy given value into mem and return offset.
-func (allc *Allocator) putBytes(val []byte) uint32 {
-	valSize := uint32(len(val))
-	// Add padding for increasing cache performance.
-	/*padding := valSize % cacheLineSize
-	if padding < paddingLimit {
-		valSize += padding
-	}*/
-	offset := allc.new(valSize)
-	copy(allc.mem[offset:], val)
-	return offset
-}
-
-// putBytesTo will copy given value into given memory offset.
-func (allc *Allocator) putBytesTo(offset uint32, val []byte) {
-	copy(allc.mem[offset:], val)
-}
-
-// makeNode will allocate required space for node type.
-// The offset of the node in the mem is returned.
-func (allc *Allocator) makeNode(truncatedSize uint32) uint32 {
-	// Calculate the amount of actual memory required for this node.
-	// Depending on the height of the node, size might be truncated.
-	size := defaultNodeSize - truncatedSize
-	/*padding := size % cacheLineSize
-	if padding < paddingLimit {
-		size += padding
-	}*/
-	return allc.new(size)
-}
-
-// getBytes returns the byte slice in mem[offset:offset+size]
-func (allc *Allocator) getBytes(offset uint32, size uint32) []byte {
-	return allc.mem[offset : offset+size]
+	// Nodes lower than max height are shorter than the node type, keep room
+	// after the end so that a node at the end does not point past the buffer.
+	return &Allocator{offset: initialAllocatorOffset, mem: make([]byte, size, size+defaultNodeSize)}
+}
+
+// newChunkedAllocator returns a new allocator which allocates small blocks in
+// chunks of given size. If chunkSize is 0, it is the same as newAllocator.
+func newChunkedAllocator(size uint64, chunkSize uint64) *Allocator {
+	allc := newAllocator(size)
+	allc.enableChunks(chunkSize)
+	return allc
+}
+
+// enableChunks makes allocator allocate small blocks in chunks of given size.
+// It must be called before the allocator is used by multiple goroutines.
+func (allc *Allocator) enableChunks(chunkSize uint64) {
+	if chunkSize == 0 {
+		return
+	}
+	// A few more chunks than processors, so that writers rarely wait
+	// for a chunk even if they are not evenly spread among chunks.
+	count := 1
+	for count < 2*runtime.GOMAXPROCS(0) {
+		count <<= 1
+	}
+	allc.chunkSize = chunkSize
+	allc.chunks = make([]allocChunk, count)
+}
+
+// Allocate reserves a block on memory whose address is a multiple of
+// given alignment and returns offset to it. align must be a power of 2.
+// Aligning nodes to cacheLineSize implements both data alignment and padding
+// described above: a node starts on a cache line boundary, and nothing else
+// is placed in its last cache line, unless the next allocation is not aligned.
+func (allc *Allocator) Allocate(size uint64, align uint64) (uint64, error) {
+	if allc.isChunked(size) {
+		return allc.newInChunk(size, align)
+	}
+	return allc.reserveAligned(size, align)
+}
+
+// reserveAligned reserves a block from the shared offset whose address is
+// a multiple of given alignment and returns offset to it.
+func (allc *Allocator) reserveAligned(size uint64, align uint64) (uint64, error) {
+	// Align the actual address, mem itself might not be aligned.
+	base := uint64(uintptr(unsafe.Pointer(&allc.mem[0])))
+	for {
+		offset := allc.Used()
+		alignedOffset := (base+offset+align-1)&^(align-1) - base
+		if alignedOffset+size > uint64(len(allc.mem)) {
+			return 0, ErrArenaFull
+		}
+		// Multiple goroutines might modify offset value, it might be
+		// changed in the meantime. Alignment needs to be calculated
+		// again in that case.
+		if atomic.CompareAndSwapUint64(&allc.offset, offset, alignedOffset+size) {
+			return alignedOffset, nil
+		}
+	}
+}
+
+// isChunked returns whether a block with given size is allocated in a chunk.
+func (allc *Allocator) isChunked(size uint64) bool {
+	return allc.chunkSize != 0 && size <= allc.chunkSize/maxChunkedBlockRatio
+}
+
+// newInChunk reserves an aligned block in a chunk of the calling writer.
+// If the chunk is exhausted, its tail is abandoned and a new chunk is reserved.
+func (allc *Allocator) newInChunk(size uint64, align uint64) (uint64, error) {
+	chunk := allc.acquireChunk()
+	defer allc.releaseChunk(chunk)
+	base := uint64(uintptr(unsafe.Pointer(&allc.mem[0])))
+	offset := (base+chunk.offset+align-1)&^(align-1) - base
+	if offset+size > chunk.end {
+		// Near the end of memory there is no room for a whole chunk.
+		if allc.Used()+allc.chunkSize > uint64(len(allc.mem)) {
+			return allc.reserveAligned(size, align)
+		}
+		newOffset, err := allc.reserveAligned(allc.chunkSize, align)
+		if err != nil {
+			return allc.reserveAligned(size, align)
+		}
+		atomic.AddUint64(&allc.tailWaste, chunk.end-chunk.offset)
+		offset = newOffset
+		chunk.end = offset + allc.chunkSize
+	}
+	chunk.offset = offset + size
+	return offset, nil
+}
+
+// acquireChunk returns a chunk for the calling writer, which must be
+// released with releaseChunk.
+func (allc *Allocator) acquireChunk() *allocChunk {
+	// Go has no goroutine local storage. Stacks of goroutines are disjoint,
+	// so the stack address of the writer picks a chunk that is rarely
+	// wanted by others at the same time.
+	var stackMarker byte
+	hint := uint32(uintptr(unsafe.Pointer(&stackMarker)) >> 11)
+	mask := uint32(len(allc.chunks) - 1)
+	for i := hint * 2654435769 >> 16; ; i++ {
+		chunk := &allc.chunks[i&mask]
+		if atomic.CompareAndSwapUint32(&chunk.busy, 0, 1) {
+			return chunk
+		}
+		// Every chunk is in use, let the writers using them proceed.
+		if i&mask == mask {
+			runtime.Gosched()
+		}
+	}
+}
+
+// releaseChunk makes the chunk available to other writers.
+func (allc *Allocator) releaseChunk(chunk *allocChunk) {
+	atomic.StoreUint32(&chunk.busy, 0)
 }
 
-// getNode returns a pointer to the node at given offset.
-func (allc *Allocator) getNode(offset uint32) *node {
-	if offset == nilAllocatorOffset {
-		return nil
+// releaseChunks drops the unused parts of every chunk. Each part is given back
+// to allocator if nothing is reserved after it, it is abandoned otherwise.
+// Writers can allocate in the meantime, they will reserve new chunks.
+func (allc *Allocator) releaseChunks() {
+	for i := range allc.chunks {
+		chunk := &allc.chunks[i]
+		for !atomic.CompareAndSwapUint32(&chunk.busy, 0, 1) {
+			runtime.Gosched()
+		}
+		if chunk.end > chunk.offset &&
+			!atomic.CompareAndSwapUint64(&allc.offset, chunk.end, chunk.offset) {
+			atomic.AddUint64(&allc.tailWaste, chunk.end-chunk.offset)
+		}
+		chunk.offset, chunk.end = 0, 0
+		allc.releaseChunk(chunk)
 	}
-	return (*node)(unsafe.Pointer(&allc.mem[offset]))
 }
 
-func (allc *Allocator) getOffset() uint32 {
-	return atomic.LoadUint32(&allc.offset)
+// BytesAt returns the byte slice in mem[offset:offset+size]
+func (allc *Allocator) BytesAt(offset uint64, size uint64) []byte {
+	return allc.mem[offset : offset+size]
+}
+
+// NodeAt returns a pointer to the memory at given offset.
+func (allc *Allocator) NodeAt(offset uint64) unsafe.Pointer {
+	return unsafe.Pointer(&allc.mem[offset])
+}
+
+// Used returns the number of bytes reserved so far.
+func (allc *Allocator) Used() uint64 {
+	return atomic.LoadUint64(&allc.offset)
+}
+
+// Capacity returns the size of the allocator.
+func (allc *Allocator) Capacity() uint64 {
+	return uint64(len(allc.mem))
+}
+
+// arenaStats returns memory usage of given arena.
+func arenaStats(arena Arena) AllocatorStats {
+	stats := AllocatorStats{Used: arena.Used(), Capacity: arena.Capacity()}
+	if allc, ok := arena.(*Allocator); ok {
+		stats.TailWaste = atomic.LoadUint64(&allc.tailWaste)
+	}
+	return stats
 }
@@ -1,6 +1,7 @@
 package goskip
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 	"unsafe"
@@ -9,20 +10,20 @@ import (
 )
 
 // Default allocator size to be used in tests. 64 KB
-const allocatorSize = uint32(2 << 16)
+const allocatorSize = uint64(2 << 16)
 
 func TestNewAllocator(t *testing.T) {
 	a := newAllocator(allocatorSize)
-	assert.Equal(t, allocatorSize, uint32(len(a.mem)), "Allocator memory size must be equal to given size")
+	assert.Equal(t, allocatorSize, uint64(len(a.mem)), "Allocator memory size must be equal to given size")
 	assert.Equal(t, initialAllocatorOffset, a.offset, "Allocator offset must be 1 offset after init")
 }
 
 func TestAllocator_New(t *testing.T) {
 	a := newAllocator(allocatorSize)
-	valSize := uint32(304)
+	valSize := uint64(304)
 	lastOffset := initialAllocatorOffset
 	for i := 0; i < 10; i++ {
-		offset := a.new(valSize)
+		offset := allocate(t, a, valSize, 1)
 		assert.Equal(t, lastOffset, offset, "Offset must be set correctly after calling New")
 		lastOffset = offset + valSize
 	}
@@ -30,12 +31,12 @@ func TestAllocator_New(t *testing.T) {
 
 func TestAllocator_New_Parallel(t *testing.T) {
 	a := newAllocator(allocatorSize)
-	valSize := uint32(11)
+	valSize := uint64(11)
 	for i := 0; i < 400; i++ {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			offsetBefore := a.getOffset()
-			offset := a.new(valSize)
+			offsetBefore := a.Used()
+			offset := allocate(t, a, valSize, 1)
 			assert.GreaterOrEqual(t, offset, offsetBefore, "Offset must be greater or equal - parallel")
 		})
 	}
@@ -44,10 +45,10 @@ func TestAllocator_New_Parallel(t *testing.T) {
 func TestAllocator_PutBytes(t *testing.T) {
 	a := newAllocator(allocatorSize)
 	val := []byte("such_a_small_value")
-	valSize := uint32(len(val))
+	valSize := uint64(len(val))
 	lastOffset := initialAllocatorOffset
 	for i := 0; i < 20; i++ {
-		offset := a.putBytes(val)
+		offset := putBytes(t, a, val)
 		assert.Equal(t, lastOffset, offset, "Offset must be set correctly after calling putBytes")
 		lastOffset = offset + valSize
 	}
@@ -59,8 +60,8 @@ func TestAllocator_PutBytes_Parallel(t *testing.T) {
 	for i := 0; i < 400; i++ {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			offsetBefore := a.getOffset()
-			offset := a.putBytes(val)
+			offsetBefore := a.Used()
+			offset := putBytes(t, a, val)
 			assert.GreaterOrEqual(t, offset, offsetBefore, "Offset must be greater or equal - parallel")
 		})
 	}
@@ -69,14 +70,14 @@ func TestAllocator_PutBytes_Parallel(t *testing.T) {
 func TestAllocator_PutBytesTo(t *testing.T) {
 	a := newAllocator(allocatorSize)
 	val := []byte("such_a_small_value_3")
-	valSize := uint32(len(val))
-	offset := uint32(2 << 2)
+	valSize := uint64(len(val))
+	offset := uint64(2 << 2)
 	for i := 0; i < 20; i++ {
-		a.putBytesTo(offset, val)
+		copy(a.BytesAt(offset, uint64(len(val))), val)
 		offset += valSize
 	}
 
-	offset = uint32(2 << 2)
+	offset = uint64(2 << 2)
 	for i := 0; i < 20; i++ {
 		assert.Equal(t, val, a.mem[offset:offset+valSize])
 		offset += valSize
@@ -86,12 +87,13 @@ func TestAllocator_PutBytesTo(t *testing.T) {
 func TestAllocator_PutBytesTo_Parallel(t *testing.T) {
 	a := newAllocator(allocatorSize)
 	val := []byte("such_a_small_value_3")
-	valSize := uint32(len(val))
+	valSize := uint64(len(val))
 	for i := 0; i < 400; i++ {
+		i := i
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			offset := valSize * uint32(i)
-			a.putBytesTo(offset, val)
+			offset := valSize * uint64(i)
+			copy(a.BytesAt(offset, uint64(len(val))), val)
 			assert.Equal(t, val, a.mem[offset:offset+valSize])
 		})
 	}
@@ -100,16 +102,16 @@ func TestAllocator_PutBytesTo_Parallel(t *testing.T) {
 func TestAllocator_MakeNode(t *testing.T) {
 	a := newAllocator(allocatorSize)
 	t.Run("FullNodeSize", func(t *testing.T) {
-		offset := a.makeNode(0)
-		assert.Equal(t, a.getOffset(), offset+defaultNodeSize, "New offset must be old + node size")
+		offset := allocate(t, a, defaultNodeSize, nodeAlignment)
+		assert.Equal(t, a.Used(), offset+defaultNodeSize, "New offset must be old + node size")
 	})
 	t.Run("TruncatedNodeSize", func(t *testing.T) {
-		truncatedSize := uint32(96)
-		offset := a.makeNode(truncatedSize)
-		assert.Equal(t, a.getOffset(), offset+defaultNodeSize-truncatedSize, "New offset must be old + node size(truncated)")
+		truncatedSize := uint64(96)
+		offset := allocate(t, a, defaultNodeSize-truncatedSize, nodeAlignment)
+		assert.Equal(t, a.Used(), offset+defaultNodeSize-truncatedSize, "New offset must be old + node size(truncated)")
 	})
 	t.Run("ValidNode", func(t *testing.T) {
-		offset := a.makeNode(0)
+		offset := allocate(t, a, defaultNodeSize, nodeAlignment)
 		node := (*node)(unsafe.Pointer(&a.mem[offset]))
 		assert.Equal(t, uint8(0), node.height, "Smoke test for allocated node")
 	})
@@ -120,7 +122,7 @@ func TestAllocator_MakeNode_Parallel(t *testing.T) {
 	for i := 0; i < 400; i++ {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			offset := a.makeNode(0)
+			offset := allocate(t, a, defaultNodeSize, nodeAlignment)
 			node := (*node)(unsafe.Pointer(&a.mem[offset]))
 			assert.Equal(t, uint8(0), node.height, "Smoke test for node - parallel")
 		})
@@ -132,9 +134,9 @@ func TestAllocator_GetBytes(t *testing.T) {
 	valString := "sample key %d"
 	for i := 0; i < 400; i++ {
 		val := []byte(fmt.Sprintf(valString, i))
-		valSize := uint32(len(val))
-		offset := a.putBytes(val)
-		assert.Equal(t, val, a.getBytes(offset, valSize), "GetBytes must return correct value")
+		valSize := uint64(len(val))
+		offset := putBytes(t, a, val)
+		assert.Equal(t, val, a.BytesAt(offset, valSize), "GetBytes must return correct value")
 	}
 }
 
@@ -142,12 +144,13 @@ func TestAllocator_GetBytes_Parallel(t *testing.T) {
 	a := newAllocator(allocatorSize)
 	valString := "sample key %d"
 	for i := 0; i < 400; i++ {
+		i := i
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
 			val := []byte(fmt.Sprintf(valString, i))
-			valSize := uint32(len(val))
-			offset := a.putBytes(val)
-			assert.Equal(t, val, a.getBytes(offset, valSize), "GetBytes must return correct value - parallel")
+			valSize := uint64(len(val))
+			offset := putBytes(t, a, val)
+			assert.Equal(t, val, a.BytesAt(offset, valSize), "GetBytes must return correct value - parallel")
 		})
 	}
 }
@@ -155,8 +158,8 @@ func TestAllocator_GetBytes_Parallel(t *testing.T) {
 func TestAllocator_GetNode(t *testing.T) {
 	a := newAllocator(allocatorSize)
 	for i := 0; i < 400; i++ {
-		offset := a.makeNode(0)
-		node := a.getNode(offset)
+		offset := allocate(t, a, defaultNodeSize, nodeAlignment)
+		node := (*node)(a.NodeAt(offset))
 		assert.Equal(t, uint8(0), node.height, "Smoke test for GetNode")
 	}
 }
@@ -166,9 +169,153 @@ func TestAllocator_GetNode_Parallel(t *testing.T) {
 	for i := 0; i < 400; i++ {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			offset := a.makeNode(0)
-			node := a.getNode(offset)
+			offset := allocate(t, a, defaultNodeSize, nodeAlignment)
+			node := (*node)(a.NodeAt(offset))
 			assert.Equal(t, uint8(0), node.height, "Smoke test for GetNode - parallel")
 		})
 	}
 }
+
+func TestAllocator_NewAligned(t *testing.T) {
+	a := newAllocator(allocatorSize)
+	for i := uint64(1); i < 100; i++ {
+		// Leave the offset misaligned before each aligned allocation.
+		allocate(t, a, i, 1)
+		offset := allocate(t, a, i, nodeAlignment)
+		assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&a.mem[offset]))%uintptr(nodeAlignment),
+			"Block must be aligned")
+		assert.Equal(t, offset+i, a.Used(), "Offset must be set correctly after calling newAligned")
+	}
+}
+
+func TestAllocator_NewAligned_Parallel(t *testing.T) {
+	a := newAllocator(allocatorSize)
+	for i := 0; i < 400; i++ {
+		i := i
+		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
+			t.Parallel()
+			allocate(t, a, uint64(i%7), 1)
+			offset := allocate(t, a, uint64(i%13+1), nodeAlignment)
+			assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&a.mem[offset]))%uintptr(nodeAlignment),
+				"Block must be aligned - parallel")
+		})
+	}
+}
+
+// Chunk size to be used in tests.
+const testChunkSize = uint64(256)
+
+func TestNewChunkedAllocator(t *testing.T) {
+	a := newChunkedAllocator(allocatorSize, 0)
+	assert.Nil(t, a.chunks, "Allocator must not have chunks if chunk size is 0")
+	a = newChunkedAllocator(allocatorSize, testChunkSize)
+	assert.Equal(t, testChunkSize, a.chunkSize)
+	assert.Equal(t, 0, len(a.chunks)&(len(a.chunks)-1), "Number of chunks must be a power of 2")
+}
+
+// newSingleChunkAllocator returns an allocator with a single chunk, so that
+// every block is placed in the same chunk regardless of the calling goroutine.
+func newSingleChunkAllocator(size uint64) *Allocator {
+	a := newChunkedAllocator(size, testChunkSize)
+	a.chunks = a.chunks[:1]
+	return a
+}
+
+func TestAllocator_NewInChunk(t *testing.T) {
+	a := newSingleChunkAllocator(allocatorSize)
+	first := allocate(t, a, 10, 1)
+	assert.Equal(t, initialAllocatorOffset, first)
+	assert.Equal(t, initialAllocatorOffset+testChunkSize, a.Used(), "A whole chunk must be reserved")
+	// Following blocks are placed in the same chunk.
+	second := allocate(t, a, 10, nodeAlignment)
+	assert.True(t, second > first && second+10 <= first+testChunkSize, "Block must be in the chunk")
+	assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&a.mem[second]))%uintptr(nodeAlignment),
+		"Block must be aligned")
+	assert.Equal(t, initialAllocatorOffset+testChunkSize, a.Used())
+
+	// Large blocks are not allocated in chunks.
+	large := allocate(t, a, testChunkSize, 1)
+	assert.Equal(t, initialAllocatorOffset+testChunkSize, large)
+	assert.Equal(t, uint64(0), arenaStats(a).TailWaste)
+}
+
+func TestAllocator_NewInChunk_TailWaste(t *testing.T) {
+	a := newSingleChunkAllocator(allocatorSize)
+	blockSize := testChunkSize / maxChunkedBlockRatio
+	for i := uint64(0); i < 7; i++ {
+		allocate(t, a, blockSize, 1)
+	}
+	// Last part of the chunk is a byte short of a block.
+	allocate(t, a, blockSize-1, 1)
+	allocate(t, a, blockSize, 1)
+	assert.Equal(t, uint64(1), arenaStats(a).TailWaste, "Tail of the chunk must be abandoned")
+	assert.Equal(t, initialAllocatorOffset+2*testChunkSize, a.Used())
+}
+
+func TestAllocator_NewInChunk_EndOfMemory(t *testing.T) {
+	a := newChunkedAllocator(testChunkSize+testChunkSize/2, testChunkSize)
+	var err error
+	for err == nil {
+		_, err = a.Allocate(testChunkSize/maxChunkedBlockRatio, 1)
+	}
+	assert.Equal(t, ErrArenaFull, err)
+	assert.True(t, a.Used() <= a.Capacity(), "Chunks must not be reserved beyond memory")
+	assert.True(t, a.Capacity()-a.Used() < testChunkSize/maxChunkedBlockRatio, "Memory must be used up to the end")
+}
+
+func TestAllocator_ReleaseChunks(t *testing.T) {
+	a := newSingleChunkAllocator(allocatorSize)
+	offset := allocate(t, a, 10, 1)
+	a.releaseChunks()
+	assert.Equal(t, offset+10, a.Used(), "Unused part of the last chunk must be given back")
+	assert.Equal(t, uint64(0), arenaStats(a).TailWaste)
+
+	allocate(t, a, 10, 1)
+	large := allocate(t, a, testChunkSize, 1)
+	a.releaseChunks()
+	assert.Equal(t, large+testChunkSize, a.Used())
+	assert.Equal(t, testChunkSize-10, arenaStats(a).TailWaste, "Chunk followed by other blocks must be abandoned")
+}
+
+func TestAllocator_NewInChunk_Parallel(t *testing.T) {
+	a := newChunkedAllocator(allocatorSize, testChunkSize)
+	blocks := make([]uint64, 400)
+	t.Run("Group", func(t *testing.T) {
+		for i := range blocks {
+			i := i
+			t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
+				t.Parallel()
+				blocks[i] = allocate(t, a, uint64(i%13+1), nodeAlignment)
+				copy(a.BytesAt(blocks[i], uint64(len(bytes.Repeat([]byte{byte(i)}, i%13+1)))), bytes.Repeat([]byte{byte(i)}, i%13+1))
+			})
+		}
+	})
+	// Blocks must not overlap, so every block keeps its own bytes.
+	for i, offset := range blocks {
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, i%13+1), a.BytesAt(offset, uint64(i%13+1)))
+	}
+}
+
+// allocate reserves a block in given allocator, failing the test on errors.
+func allocate(t testing.TB, a *Allocator, size uint64, align uint64) uint64 {
+	offset, err := a.Allocate(size, align)
+	assert.NoError(t, err)
+	return offset
+}
+
+// putBytes copies given value into a new block and returns its offset.
+func putBytes(t testing.TB, a *Allocator, val []byte) uint64 {
+	offset := allocate(t, a, uint64(len(val)), 1)
+	copy(a.BytesAt(offset, uint64(len(val))), val)
+	return offset
+}
+
+func TestAllocator_Allocate_Full(t *testing.T) {
+	a := newAllocator(64)
+	_, err := a.Allocate(65, 1)
+	assert.Equal(t, ErrArenaFull, err)
+	assert.Equal(t, initialAllocatorOffset, a.Used(), "Failed allocation must not reserve memory")
+	allocate(t, a, 63, 1)
+	_, err = a.Allocate(1, 1)
+	assert.Equal(t, ErrArenaFull, err)
+}
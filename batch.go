@@ -0,0 +1,128 @@
+package goskip
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Batch is a group of pairs which are set together by Apply. The zero Batch
+// is empty and ready to use.
+type Batch struct {
+	// Payload of the batch record of the pairs, see the log record layout.
+	payload []byte
+
+	// Number of pairs.
+	count int
+}
+
+// Set adds given key-value pair to the batch. Key and value are copied, so
+// they can be reused once Set returns.
+func (b *Batch) Set(key []byte, val []byte) {
+	if len(b.payload) == 0 {
+		b.payload = append(b.payload, recordBatch)
+	}
+	b.payload = appendSizedBytes(b.payload, key)
+	b.payload = appendSizedBytes(b.payload, val)
+	b.count++
+}
+
+// Len returns the number of pairs in the batch.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Reset removes every pair from the batch, keeping its memory for reuse.
+func (b *Batch) Reset() {
+	b.payload = b.payload[:0]
+	b.count = 0
+}
+
+// Apply sets the pairs of given batch in the order they are added.
+// If the list has a write-ahead log, the batch is appended to it as a single
+// record before any pair becomes visible, so Recover replays either every
+// pair of the batch or none of them.
+// Pairs become visible one by one, readers might see some of them before the
+// others. ErrKeyTooLarge is returned before any pair is set if a key can not
+// fit into the list, and ErrWALRecordTooLarge if the batch can not fit into
+// a log record. If a pair can not be allocated, the error of the arena,
+// such as ErrArenaFull, is returned: the pairs before it stay set and the
+// others are not set, and Recover replays the same pairs.
+func (s *SkipList) Apply(b *Batch) error {
+	if b.count == 0 {
+		return nil
+	}
+	keys, vals, err := decodeBatchRecord(b.payload)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := checkKeySize(s.mainAllocator, uint64(len(key))); err != nil {
+			return err
+		}
+	}
+	if s.wal == nil {
+		for i, key := range keys {
+			if err := s.set(key, vals[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	locks := s.wal.lockKeys(keys)
+	defer func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}()
+	offset, err := s.wal.appendRecord(b.payload)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := s.set(key, vals[i]); err != nil {
+			// The error of the log, if any, is returned by the following updates.
+			s.wal.appendCancel(offset, i)
+			return err
+		}
+	}
+	return nil
+}
+
+// appendSizedBytes appends the size of given data as uvarint and the data
+// to buf.
+func appendSizedBytes(buf []byte, data []byte) []byte {
+	var size [binary.MaxVarintLen64]byte
+	buf = append(buf, size[:binary.PutUvarint(size[:], uint64(len(data)))]...)
+	return append(buf, data...)
+}
+
+// decodeBatchRecord returns the keys and values of a batch record payload.
+// They refer to the payload.
+func decodeBatchRecord(payload []byte) ([][]byte, [][]byte, error) {
+	var keys, vals [][]byte
+	for data := payload[1:]; len(data) > 0; {
+		key, rest, err := decodeSizedBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		val, rest, err := decodeSizedBytes(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys, vals = append(keys, key), append(vals, val)
+		data = rest
+	}
+	return keys, vals, nil
+}
+
+// decodeSizedBytes returns the data appended by appendSizedBytes at the start
+// of buf, and the rest of buf.
+func decodeSizedBytes(buf []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || size > uint64(len(buf)-n) {
+		return nil, nil, errors.New("invalid batch pair size")
+	}
+	end := n + int(size)
+	return buf[n:end], buf[end:], nil
+}
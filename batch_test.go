@@ -0,0 +1,171 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBatch returns a batch of uniqueNodesData.
+func newTestBatch() *Batch {
+	b := &Batch{}
+	for _, data := range uniqueNodesData {
+		b.Set(data.key, data.val)
+	}
+	return b
+}
+
+func TestBatch(t *testing.T) {
+	b := &Batch{}
+	key, val := []byte("key"), []byte("value")
+	b.Set(key, val)
+	key[0], val[0] = 'x', 'x'
+	b.Set([]byte("empty"), nil)
+	assert.Equal(t, 2, b.Len())
+
+	keys, vals, err := decodeBatchRecord(b.payload)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("key"), []byte("empty")}, keys, "Keys must be copied")
+	assert.Equal(t, [][]byte{[]byte("value"), {}}, vals, "Values must be copied")
+
+	b.Reset()
+	assert.Equal(t, 0, b.Len())
+	b.Set([]byte("other"), []byte("other value"))
+	keys, vals, err = decodeBatchRecord(b.payload)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("other")}, keys)
+	assert.Equal(t, [][]byte{[]byte("other value")}, vals)
+
+	_, _, err = decodeBatchRecord(b.payload[:len(b.payload)-1])
+	assert.EqualError(t, err, "invalid batch pair size")
+}
+
+func TestSkipList_Apply(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	assert.NoError(t, s.Apply(&Batch{}))
+	b := newTestBatch()
+	// Pairs are set in order, so the last one of a key wins.
+	b.Set(uniqueNodesData[0].key, []byte("new"))
+	assert.NoError(t, s.Apply(b))
+	assert.Equal(t, []byte("new"), s.Get(uniqueNodesData[0].key))
+	for _, data := range uniqueNodesData[1:] {
+		assert.Equal(t, data.val, s.Get(data.key))
+	}
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_Apply_KeyTooLarge(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	b := &Batch{}
+	b.Set([]byte("key"), []byte("value"))
+	b.Set(make([]byte, defaultAllocatorSize), []byte("value"))
+	assert.Equal(t, ErrKeyTooLarge, s.Apply(b))
+	assert.Nil(t, s.Get([]byte("key")), "No pair must be set")
+	assert.NoError(t, wal.Close())
+
+	log, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, log, "Batch must not be logged")
+}
+
+func TestRecover_Batch(t *testing.T) {
+	keyring := newTestKeyring(t, 1)
+	logs := map[string]struct {
+		walOpts  []WALOption
+		listOpts []Option
+	}{
+		"Plain":     {nil, nil},
+		"Encrypted": {[]WALOption{WithWALEncryption(keyring)}, []Option{WithRecoveryKeyring(keyring)}},
+	}
+	for name, log := range logs {
+		log := log
+		t.Run(name, func(t *testing.T) {
+			path, remove := tempWALPath(t)
+			defer remove()
+			s, wal := newLoggedList(t, path, log.walOpts...)
+			assert.NoError(t, s.Set([]byte("key"), []byte("value")))
+			assert.NoError(t, s.Apply(newTestBatch()))
+			assert.NoError(t, wal.Close())
+
+			recovered, report, err := Recover(path, defaultAllocatorSize, log.listOpts...)
+			assert.NoError(t, err)
+			assert.Equal(t, &RecoveryReport{Applied: len(uniqueNodesData) + 1}, report)
+			assert.Equal(t, listPairs(s), listPairs(recovered))
+			assert.NoError(t, recovered.Validate())
+		})
+	}
+}
+
+func TestRecover_Batch_Torn(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	assert.NoError(t, s.Set([]byte("key"), []byte("value")))
+	assert.NoError(t, s.Apply(newTestBatch()))
+	assert.NoError(t, wal.Close())
+
+	log, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, log[:len(log)-1], 0644))
+
+	recovered, report, err := Recover(path, defaultAllocatorSize)
+	assert.NoError(t, err)
+	assert.Equal(t, &RecoveryReport{Applied: 1}, report)
+	assert.Equal(t, map[string]string{"key": "value"}, listPairs(recovered), "Torn batches must not be replayed")
+}
+
+func TestRecover_Batch_Failed(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	wal, err := OpenWAL(path)
+	assert.NoError(t, err)
+	s := NewSkipList(4096, WithWAL(wal))
+	b := &Batch{}
+	b.Set([]byte("a"), []byte("value-a"))
+	b.Set([]byte("b"), bytes.Repeat([]byte("b"), 5000))
+	b.Set([]byte("c"), []byte("value-c"))
+	assert.Equal(t, ErrArenaFull, s.Apply(b))
+	assert.Equal(t, map[string]string{"a": "value-a"}, listPairs(s), "Pairs before the failed one must stay set")
+	assert.NoError(t, wal.Close())
+
+	recovered, report, err := Recover(path, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, &RecoveryReport{Applied: 1, Cancelled: 2}, report)
+	assert.Equal(t, listPairs(s), listPairs(recovered), "Pairs which were set must be replayed")
+}
+
+func TestSkipList_Apply_Parallel(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// Batches of writers share keys in different orders.
+				b := &Batch{}
+				for k := 0; k < 10; k++ {
+					key := (i*7 + k*13 + j) % 50
+					b.Set([]byte(fmt.Sprintf("key-%d", key)), []byte(fmt.Sprintf("value-%d-%d", i, j)))
+				}
+				assert.NoError(t, s.Apply(b))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, wal.Close())
+	assert.NoError(t, s.Validate())
+
+	recovered, report, err := Recover(path, defaultAllocatorSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 8*100*10, report.Applied)
+	assert.Equal(t, listPairs(s), listPairs(recovered), "Last visible values must be recovered")
+}
@@ -0,0 +1,121 @@
+package goskip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+// Bloom filters have at most this many hash functions.
+const maxBloomFilterHashes = 30
+
+// Bloom filters have at most this many bits.
+const maxBloomFilterBits = 1 << 36
+
+// Size of the header of serialized Bloom filters: the number of hash
+// functions as a little-endian uint32. Words follow it as little-endian
+// uint64 values.
+const bloomFilterHeaderSize = 4
+
+// bloomFilter is a Bloom filter of the keys of a list, see WithBloomFilter.
+// Bits are set atomically, so keys are added and checked concurrently.
+type bloomFilter struct {
+	words  []uint64
+	hashes uint32
+}
+
+// newBloomFilter returns a filter of given number of keys, with given number
+// of bits per key. The number of hash functions minimizes false positives.
+func newBloomFilter(keyCount int, bitsPerKey int) *bloomFilter {
+	if keyCount < 1 {
+		keyCount = 1
+	}
+	if bitsPerKey < 1 {
+		bitsPerKey = 1
+	}
+	bits := uint64(keyCount) * uint64(bitsPerKey)
+	if bits > maxBloomFilterBits {
+		bits = maxBloomFilterBits
+	}
+	hashes := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	if hashes > maxBloomFilterHashes {
+		hashes = maxBloomFilterHashes
+	}
+	return &bloomFilter{words: make([]uint64, (bits+63)/64), hashes: hashes}
+}
+
+// position returns the position of the bit of given hash function for a key
+// with given hash. Positions are derived from the two halves of the hash, see
+// "Less Hashing, Same Performance: Building a Better Bloom Filter".
+func (f *bloomFilter) position(h uint64, i uint32) uint64 {
+	return (h&math.MaxUint32 + uint64(i)*(h>>32)) % (uint64(len(f.words)) * 64)
+}
+
+// add adds given key to the filter.
+func (f *bloomFilter) add(key []byte) {
+	h := keyHash(key)
+	for i := uint32(0); i < f.hashes; i++ {
+		position := f.position(h, i)
+		word, bit := &f.words[position/64], uint64(1)<<(position%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&bit != 0 || atomic.CompareAndSwapUint64(word, old, old|bit) {
+				break
+			}
+		}
+	}
+}
+
+// mayContain returns false if given key is not added to the filter.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	h := keyHash(key)
+	for i := uint32(0); i < f.hashes; i++ {
+		position := f.position(h, i)
+		if atomic.LoadUint64(&f.words[position/64])&(uint64(1)<<(position%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// marshal returns the serialized filter.
+func (f *bloomFilter) marshal() []byte {
+	data := make([]byte, bloomFilterHeaderSize+8*len(f.words))
+	binary.LittleEndian.PutUint32(data, f.hashes)
+	for i := range f.words {
+		binary.LittleEndian.PutUint64(data[bloomFilterHeaderSize+8*i:], atomic.LoadUint64(&f.words[i]))
+	}
+	return data
+}
+
+// unmarshalBloomFilter returns the filter serialized by marshal.
+func unmarshalBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < bloomFilterHeaderSize+8 || (len(data)-bloomFilterHeaderSize)%8 != 0 ||
+		uint64(len(data)-bloomFilterHeaderSize)*8 > maxBloomFilterBits {
+		return nil, errors.New("invalid Bloom filter size")
+	}
+	f := &bloomFilter{
+		words:  make([]uint64, (len(data)-bloomFilterHeaderSize)/8),
+		hashes: binary.LittleEndian.Uint32(data),
+	}
+	if f.hashes < 1 || f.hashes > maxBloomFilterHashes {
+		return nil, errors.New("invalid number of Bloom filter hashes")
+	}
+	for i := range f.words {
+		f.words[i] = binary.LittleEndian.Uint64(data[bloomFilterHeaderSize+8*i:])
+	}
+	return f, nil
+}
+
+// fillBloomFilter adds the keys of every node to the Bloom filter.
+func (s *SkipList) fillBloomFilter() {
+	for offset := s.head.getNextNodeOffset(0); offset != nilAllocatorOffset; {
+		node := s.getNode(offset)
+		s.bloom.add(s.getNodeKey(node))
+		offset = node.getNextNodeOffset(0)
+	}
+}
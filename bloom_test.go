@@ -0,0 +1,213 @@
+package goskip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Bloom filter parameters of tests.
+const (
+	testBloomKeyCount   = 1000
+	testBloomBitsPerKey = 10
+)
+
+func TestNewBloomFilter(t *testing.T) {
+	tests := []struct {
+		keyCount   int
+		bitsPerKey int
+		words      int
+		hashes     uint32
+	}{
+		{1000, 10, 157, 7},
+		{64, 1, 1, 1},
+		{0, 0, 1, 1},
+		{10, 100, 16, maxBloomFilterHashes},
+	}
+	for _, test := range tests {
+		f := newBloomFilter(test.keyCount, test.bitsPerKey)
+		assert.Equal(t, test.words, len(f.words), "%d keys, %d bits per key", test.keyCount, test.bitsPerKey)
+		assert.Equal(t, test.hashes, f.hashes, "%d keys, %d bits per key", test.keyCount, test.bitsPerKey)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(testBloomKeyCount, testBloomBitsPerKey)
+	for i := 0; i < testBloomKeyCount; i++ {
+		f.add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < testBloomKeyCount; i++ {
+		assert.True(t, f.mayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 300, "%d false positives", falsePositives)
+}
+
+func TestBloomFilter_Parallel(t *testing.T) {
+	f := newBloomFilter(testBloomKeyCount, testBloomBitsPerKey)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < testBloomKeyCount; j += 4 {
+				f.add([]byte(fmt.Sprintf("key-%d", j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < testBloomKeyCount; i++ {
+		assert.True(t, f.mayContain([]byte(fmt.Sprintf("key-%d", i))), "Bits set concurrently must not be lost")
+	}
+}
+
+func TestBloomFilter_Marshal(t *testing.T) {
+	f := newBloomFilter(testBloomKeyCount, testBloomBitsPerKey)
+	f.add([]byte("key"))
+	unmarshaled, err := unmarshalBloomFilter(f.marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, f, unmarshaled)
+
+	invalid := map[string][]byte{
+		"Empty":    nil,
+		"NoWords":  make([]byte, bloomFilterHeaderSize),
+		"PartWord": make([]byte, bloomFilterHeaderSize+12),
+		"NoHashes": make([]byte, bloomFilterHeaderSize+8),
+		"Hashes": func() []byte {
+			data := make([]byte, bloomFilterHeaderSize+8)
+			binary.LittleEndian.PutUint32(data, maxBloomFilterHashes+1)
+			return data
+		}(),
+	}
+	for name, data := range invalid {
+		_, err := unmarshalBloomFilter(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSkipList_BloomFilter(t *testing.T) {
+	lists := map[string]func() *SkipList{
+		"Compact": func() *SkipList {
+			return NewSkipList(defaultAllocatorSize, WithBloomFilter(testBloomKeyCount, testBloomBitsPerKey))
+		},
+		"Wide": func() *SkipList {
+			return NewWideSkipList(uint64(defaultAllocatorSize), WithBloomFilter(testBloomKeyCount, testBloomBitsPerKey))
+		},
+	}
+	for name, newList := range lists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			s := newList()
+			for _, data := range uniqueNodesData {
+				assert.Nil(t, s.Get(data.key))
+				assert.NoError(t, s.Set(data.key, data.val))
+			}
+			for _, data := range uniqueNodesData {
+				assert.True(t, s.bloom.mayContain(data.key))
+				assert.Equal(t, data.val, s.Get(data.key))
+			}
+			assert.Nil(t, s.Get([]byte("missing")))
+			assert.NoError(t, s.Compact())
+			assert.Equal(t, uniqueNodesData[0].val, s.Get(uniqueNodesData[0].key))
+		})
+	}
+}
+
+func TestSkipList_BloomFilter_Parallel(t *testing.T) {
+	s := NewSkipList(1<<24, WithBloomFilter(testBloomKeyCount, testBloomBitsPerKey))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < testBloomKeyCount; j += 4 {
+				key := []byte(fmt.Sprintf("key-%d", j))
+				assert.NoError(t, s.Set(key, key))
+				assert.Equal(t, key, s.Get(key), "Keys must be found once they are set")
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, s.Validate())
+}
+
+func TestReadSnapshot_BloomFilter(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithBloomFilter(testBloomKeyCount, testBloomBitsPerKey))
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+	snapshot := buf.Bytes()
+
+	// Filter of the snapshot is used, whatever the options are.
+	loaded, err := ReadSnapshot(bytes.NewReader(snapshot), 1<<20, WithBloomFilter(10, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, s.bloom, loaded.bloom)
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, data.val, loaded.Get(data.key))
+	}
+	assert.NoError(t, loaded.Set([]byte("new-key"), []byte("new-value")))
+	assert.Equal(t, []byte("new-value"), loaded.Get([]byte("new-key")))
+
+	// Filter is corrupted while its checksum is valid.
+	bloomSize := len(s.bloom.marshal())
+	bloomOffset := len(snapshot) - 2*(snapshotSectionHeaderSize+4) - bloomSize
+	corrupted := append([]byte{}, snapshot...)
+	corrupted[bloomOffset+snapshotSectionHeaderSize] = 0
+	binary.LittleEndian.PutUint32(corrupted[bloomOffset+snapshotSectionHeaderSize+bloomSize:],
+		crc32.Checksum(corrupted[bloomOffset:bloomOffset+snapshotSectionHeaderSize+bloomSize], castagnoliTable))
+	assertSnapshotError(t, corrupted, ErrSnapshotInvalid, "Bloom filter")
+
+	// Filter is built for snapshots without one.
+	loaded, err = ReadSnapshot(bytes.NewReader(newSnapshot(t)), 1<<20, WithBloomFilter(testBloomKeyCount, testBloomBitsPerKey))
+	assert.NoError(t, err)
+	assert.Equal(t, s.bloom, loaded.bloom)
+	loaded, err = ReadSnapshot(bytes.NewReader(newSnapshot(t)), 1<<20)
+	assert.NoError(t, err)
+	assert.Nil(t, loaded.bloom)
+}
+
+func TestReadSnapshot_BloomFilter_Export(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.ExportSnapshot(&buf))
+	loaded, err := ReadSnapshot(&buf, 1<<20, WithBloomFilter(testBloomKeyCount, testBloomBitsPerKey))
+	assert.NoError(t, err)
+	for _, data := range uniqueNodesData {
+		assert.True(t, loaded.bloom.mayContain(data.key))
+		assert.Equal(t, data.val, loaded.Get(data.key))
+	}
+}
+
+func BenchmarkSkipList_Get_BloomFilter(b *testing.B) {
+	lists := map[string][]Option{
+		"Off": nil,
+		"On":  {WithBloomFilter(1<<16, testBloomBitsPerKey)},
+	}
+	for name, opts := range lists {
+		s := NewSkipList(1<<26, opts...)
+		for i := 0; i < 1<<16; i++ {
+			key := fmt.Sprintf("key-%09d", i)
+			s.Set([]byte(key), []byte(key))
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Get([]byte(fmt.Sprintf("missing-%09d", i%(1<<16))))
+			}
+		})
+	}
+}
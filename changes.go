@@ -0,0 +1,163 @@
+package goskip
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrChangesNotTracked is returned by ChangesSince for lists created without
+// WithChangeTracking.
+var ErrChangesNotTracked = errors.New("goskip: changes are not tracked, see WithChangeTracking")
+
+// ErrWatermarkExpired is returned by ChangesSince for watermarks taken before
+// Compact, which moves every value. A full copy, such as ExportSnapshot,
+// is needed to catch up then.
+var ErrWatermarkExpired = errors.New("goskip: watermark is taken before the last compaction")
+
+// Watermark is a point in the history of list updates, see ChangesSince.
+// The zero Watermark is the creation of the list.
+type Watermark struct {
+	// Compaction sequence of the list when the watermark was taken.
+	Epoch uint32
+
+	// Value arena offset, values below it were written before the watermark.
+	Offset uint64
+}
+
+// ChangeIterator iterates over the pairs returned by ChangesSince.
+//
+//	for it.Next() {
+//		apply(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		// Values are missing, the watermark must not be kept.
+//	}
+type ChangeIterator struct {
+	s *SkipList
+
+	// Changed nodes in the order of their values in value arena.
+	nodes []*node
+
+	// Index of the current node plus one, 0 before Next is called.
+	index int
+
+	// First error of reading a value.
+	err error
+}
+
+// Next moves to the next pair, it returns false once there are no more pairs.
+func (it *ChangeIterator) Next() bool {
+	if it.index >= len(it.nodes) {
+		return false
+	}
+	it.index++
+	return true
+}
+
+// Key returns the key of the current pair.
+func (it *ChangeIterator) Key() []byte {
+	return it.s.getNodeKey(it.nodes[it.index-1])
+}
+
+// Value returns the current value of the current pair. It is the value
+// written after the watermark, or a newer one which is returned again by
+// the next ChangesSince. If the value can not be read from value log or
+// decoded, nil is returned and the error is kept for Err.
+func (it *ChangeIterator) Value() []byte {
+	val, err := it.s.readNodeValue(it.nodes[it.index-1])
+	if err != nil && it.err == nil {
+		it.err = err
+	}
+	return val
+}
+
+// Err returns the first error of reading a value, for which Value returned nil.
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Len returns the number of pairs.
+func (it *ChangeIterator) Len() int {
+	return len(it.nodes)
+}
+
+// ChangesSince returns the pairs set after given watermark, in the order they
+// were last set, and a new watermark for the next call. Followers replicate
+// the list by applying the pairs and keeping the new watermark. A pair set
+// multiple times is returned once, with its current value.
+//
+// Changes are found by checking every node, but only changed pairs are copied.
+// Writers are blocked while the new watermark is taken, until the ones in
+// progress finish. The list must be created with WithChangeTracking, and
+// custom arenas must allocate at increasing offsets.
+func (s *SkipList) ChangesSince(watermark Watermark) (*ChangeIterator, Watermark, error) {
+	if !s.trackChanges {
+		return nil, watermark, ErrChangesNotTracked
+	}
+	var next Watermark
+	for {
+		next = s.takeWatermark()
+		// Compact must not move values while nodes are checked.
+		s.compactMu.RLock()
+		if atomic.LoadUint32(&s.compactSeq) == next.Epoch {
+			break
+		}
+		s.compactMu.RUnlock()
+	}
+	defer s.compactMu.RUnlock()
+	if watermark.Epoch != next.Epoch || watermark.Offset > next.Offset {
+		return nil, next, ErrWatermarkExpired
+	}
+
+	var offsets []uint64
+	it := &ChangeIterator{s: s}
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		offset := s.valueBlockOffset(n.loadValue())
+		if offset >= watermark.Offset && offset < next.Offset {
+			it.nodes = append(it.nodes, n)
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Sort(changesByOffset{it.nodes, offsets})
+	return it, next, nil
+}
+
+// takeWatermark returns a watermark such that every value below it is stored
+// in its node, and every value written later is above it.
+func (s *SkipList) takeWatermark() Watermark {
+	// Writers hold the read lock while they allocate and store values.
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	allc := s.getValueAllocator()
+	return Watermark{Epoch: atomic.LoadUint32(&s.compactSeq), Offset: allc.Used()}
+}
+
+// valueBlockOffset returns the offset of the block in value allocator
+// which is allocated for given encoded value.
+func (s *SkipList) valueBlockOffset(encodedValue uint64) uint64 {
+	if s.wide {
+		return encodedValue
+	}
+	offset, _ := decodeValue(encodedValue)
+	return uint64(offset)
+}
+
+// changesByOffset sorts changed nodes by the offsets of their values.
+type changesByOffset struct {
+	nodes   []*node
+	offsets []uint64
+}
+
+func (c changesByOffset) Len() int {
+	return len(c.nodes)
+}
+
+func (c changesByOffset) Less(i, j int) bool {
+	return c.offsets[i] < c.offsets[j]
+}
+
+func (c changesByOffset) Swap(i, j int) {
+	c.nodes[i], c.nodes[j] = c.nodes[j], c.nodes[i]
+	c.offsets[i], c.offsets[j] = c.offsets[j], c.offsets[i]
+}
@@ -0,0 +1,145 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collectChanges returns the changes since given watermark as key=value
+// strings, and the new watermark.
+func collectChanges(t *testing.T, s *SkipList, watermark Watermark) ([]string, Watermark) {
+	it, next, err := s.ChangesSince(watermark)
+	assert.NoError(t, err)
+	var changes []string
+	for it.Next() {
+		changes = append(changes, string(it.Key())+"="+string(it.Value()))
+	}
+	assert.Equal(t, len(changes), it.Len())
+	return changes, next
+}
+
+func TestSkipList_ChangesSince(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Compact": NewSkipList(defaultAllocatorSize, WithChangeTracking()),
+		"Wide":    NewWideSkipList(uint64(defaultAllocatorSize), WithChangeTracking()),
+		"Chunks":  NewSkipList(defaultAllocatorSize, WithChangeTracking(), WithAllocationChunks(1024)),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, s.Set([]byte("b"), []byte("value-b")))
+			assert.NoError(t, s.Set([]byte("a"), []byte("value-a")))
+			changes, watermark := collectChanges(t, s, Watermark{})
+			assert.Equal(t, []string{"b=value-b", "a=value-a"}, changes)
+
+			changes, watermark = collectChanges(t, s, watermark)
+			assert.Empty(t, changes)
+
+			// Smaller and empty values are changes too.
+			assert.NoError(t, s.Set([]byte("c"), []byte("value-c")))
+			assert.NoError(t, s.Set([]byte("b"), []byte("b")))
+			assert.NoError(t, s.Set([]byte("a"), nil))
+			changes, watermark = collectChanges(t, s, watermark)
+			assert.Equal(t, []string{"c=value-c", "b=b", "a="}, changes)
+
+			changes, _ = collectChanges(t, s, Watermark{})
+			assert.Equal(t, []string{"c=value-c", "b=b", "a="}, changes, "Pairs must be returned once in the order they were last set")
+
+			assert.NoError(t, s.Compact())
+			_, next, err := s.ChangesSince(watermark)
+			assert.Equal(t, ErrWatermarkExpired, err)
+			changes, _ = collectChanges(t, s, next)
+			assert.Empty(t, changes)
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+func TestSkipList_ChangesSince_Chunks(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithChangeTracking(), WithAllocationChunks(1024))
+	// Writers may use different chunks, so values must not be allocated
+	// in chunks to keep the order they are set.
+	assert.Equal(t, uint64(1024), s.mainAllocator.(*Allocator).chunkSize)
+	assert.Equal(t, uint64(0), s.getValueAllocator().(*Allocator).chunkSize)
+	assert.NoError(t, s.Compact())
+	assert.Equal(t, uint64(0), s.getValueAllocator().(*Allocator).chunkSize)
+}
+
+func TestSkipList_ChangesSince_NotTracked(t *testing.T) {
+	_, _, err := NewSkipList(defaultAllocatorSize).ChangesSince(Watermark{})
+	assert.Equal(t, ErrChangesNotTracked, err)
+}
+
+func TestSkipList_ChangesSince_ValueErr(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithChangeTracking(),
+		WithValueCodec(failingCodec{newTestCodec(t)}, testCodecThreshold))
+	assert.NoError(t, s.Set([]byte("json"), jsonValue("json", 0)))
+	assert.NoError(t, s.Set([]byte("small"), []byte("value")))
+	it, _, err := s.ChangesSince(Watermark{})
+	assert.NoError(t, err)
+	assert.NoError(t, it.Err())
+	for it.Next() {
+		if string(it.Key()) == "json" {
+			assert.Nil(t, it.Value())
+		} else {
+			assert.Equal(t, []byte("value"), it.Value())
+		}
+	}
+	assert.EqualError(t, it.Err(), "decode failed")
+}
+
+func TestSkipList_ChangesSince_Parallel(t *testing.T) {
+	s := NewSkipList(1<<24, WithChangeTracking(), WithAllocationChunks(1024))
+	follower := NewSkipList(1 << 24)
+	var stop uint32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; atomic.LoadUint32(&stop) == 0 || j < 1000; j++ {
+				key := []byte(fmt.Sprintf("key-%d", j%100))
+				assert.NoError(t, s.Set(key, bytes.Repeat([]byte("v"), (i+j)%40)))
+			}
+		}(i)
+	}
+	// Follower applies changes until writers stop, then catches up.
+	var watermark Watermark
+	apply := func() {
+		it, next, err := s.ChangesSince(watermark)
+		assert.NoError(t, err)
+		for it.Next() {
+			assert.NoError(t, follower.Set(it.Key(), it.Value()))
+		}
+		watermark = next
+	}
+	for k := 0; k < 20; k++ {
+		apply()
+	}
+	atomic.StoreUint32(&stop, 1)
+	wg.Wait()
+	apply()
+
+	for j := 0; j < 100; j++ {
+		key := []byte(fmt.Sprintf("key-%d", j))
+		assert.Equal(t, s.Get(key), follower.Get(key), "Follower must catch up")
+	}
+}
+
+func BenchmarkSkipList_ChangesSince(b *testing.B) {
+	s := NewSkipList(1<<26, WithChangeTracking())
+	for i := 0; i < 1<<16; i++ {
+		s.Set([]byte(fmt.Sprintf("key-%09d", i)), []byte("value"))
+	}
+	_, watermark, _ := s.ChangesSince(Watermark{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Set([]byte(fmt.Sprintf("key-%09d", i%(1<<16))), []byte("new-value"))
+		_, watermark, _ = s.ChangesSince(watermark)
+	}
+}
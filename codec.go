@@ -0,0 +1,144 @@
+package goskip
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compressed values are flagged by the second top bit of their size in value
+// arena, see valuePointerFlag. Values of at least this size can not be stored
+// in value arena of lists with flagged values, they are always stored in value
+// log if there is one.
+const valueCompressedFlag = uint32(1) << 30
+
+// Flags of values in value arena.
+const valueFlagMask = valuePointerFlag | valueCompressedFlag
+
+// ErrValueTooLarge is returned by Set for values of 4GB or more, or of 1GB or
+// more in lists with a value codec and no value log.
+var ErrValueTooLarge = errors.New("goskip: value is too large")
+
+// Codec compresses the values of a list, see WithValueCodec.
+// Its methods are called concurrently.
+type Codec interface {
+	// Encode returns the compressed form of given value.
+	Encode(val []byte) ([]byte, error)
+
+	// Decode returns the value with given compressed form.
+	Decode(data []byte) ([]byte, error)
+}
+
+// flateCodec compresses values with DEFLATE. Writers and readers are reused,
+// since they are expensive to create.
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewFlateCodec returns a codec compressing values with DEFLATE at given
+// level, see compress/flate.
+func NewFlateCodec(level int) (Codec, error) {
+	// Fail early for invalid levels.
+	if _, err := flate.NewWriter(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	return &flateCodec{level: level}, nil
+}
+
+func (c *flateCodec) Encode(val []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w, _ = flate.NewWriter(&buf, c.level)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(val); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decode(data []byte) ([]byte, error) {
+	r, ok := c.readers.Get().(io.ReadCloser)
+	if ok {
+		r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer c.readers.Put(r)
+	return ioutil.ReadAll(r)
+}
+
+// encodeNodeValue returns the bytes stored in value arena for given value of
+// a node, and their flags. Values larger than codec threshold are compressed,
+// unless they do not shrink. Values which are still larger than value log
+// threshold are appended to value log, and their pointer is stored.
+func (s *SkipList) encodeNodeValue(val []byte) ([]byte, uint32, error) {
+	var flags uint32
+	if s.codec != nil && len(val) > s.codecThreshold {
+		data, err := s.codec.Encode(val)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(data) < len(val) {
+			val, flags = data, valueCompressedFlag
+		}
+	}
+	if !s.isValueLogged(val) {
+		return val, flags, nil
+	}
+	p, err := s.vlog.append(val)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, valuePointerSize)
+	p.encode(buf)
+	return buf, flags | valuePointerFlag, nil
+}
+
+// decodeNodeValue returns the value of a node whose bytes in value arena are
+// given, with given flags.
+func (s *SkipList) decodeNodeValue(data []byte, flags uint32) ([]byte, error) {
+	if flags&valuePointerFlag != 0 {
+		var err error
+		if data, err = s.vlog.read(decodeValuePointer(data)); err != nil {
+			return nil, err
+		}
+	}
+	if flags&valueCompressedFlag != 0 {
+		return s.codec.Decode(data)
+	}
+	return data, nil
+}
+
+// hasValueFlags returns whether values in value arena might be flagged.
+func (s *SkipList) hasValueFlags() bool {
+	return s.vlog != nil || s.codec != nil
+}
+
+// ValueErr returns the first error of reading a value from value log or
+// decoding it, for which Get returned nil.
+func (s *SkipList) ValueErr() error {
+	s.valueErrMu.Lock()
+	defer s.valueErrMu.Unlock()
+	return s.valueErr
+}
+
+// setValueErr keeps given error unless there is already one.
+func (s *SkipList) setValueErr(err error) {
+	s.valueErrMu.Lock()
+	if s.valueErr == nil {
+		s.valueErr = err
+	}
+	s.valueErrMu.Unlock()
+}
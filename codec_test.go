@@ -0,0 +1,165 @@
+package goskip
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Values larger than this are compressed in codec tests.
+const testCodecThreshold = 32
+
+// failingCodec fails to decode every value.
+type failingCodec struct {
+	Codec
+}
+
+func (c failingCodec) Decode(data []byte) ([]byte, error) {
+	return nil, errors.New("decode failed")
+}
+
+// newTestCodec returns a flate codec for tests.
+func newTestCodec(t *testing.T) Codec {
+	codec, err := NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err)
+	return codec
+}
+
+// jsonValue returns a compressible value.
+func jsonValue(key string, version int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&buf, `{"key":%q,"version":%d,"index":%d},`, key, version, i)
+	}
+	return buf.Bytes()
+}
+
+func TestFlateCodec(t *testing.T) {
+	codec := newTestCodec(t)
+	for _, val := range [][]byte{nil, []byte("value"), jsonValue("key", 0)} {
+		data, err := codec.Encode(val)
+		assert.NoError(t, err)
+		decoded, err := codec.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, string(val), string(decoded))
+	}
+	_, err := codec.Decode([]byte("invalid"))
+	assert.Error(t, err)
+
+	_, err = NewFlateCodec(flate.BestCompression + 1)
+	assert.Error(t, err)
+}
+
+func TestSkipList_ValueCodec(t *testing.T) {
+	lists := map[string]func(codec Codec) *SkipList{
+		"Compact": func(codec Codec) *SkipList {
+			return NewSkipList(defaultAllocatorSize, WithValueCodec(codec, testCodecThreshold))
+		},
+		"Wide": func(codec Codec) *SkipList {
+			return NewWideSkipList(uint64(defaultAllocatorSize), WithValueCodec(codec, testCodecThreshold))
+		},
+		"Tracked": func(codec Codec) *SkipList {
+			return NewSkipList(defaultAllocatorSize, WithValueCodec(codec, testCodecThreshold), WithChangeTracking())
+		},
+	}
+	for name, newList := range lists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			s := newList(newTestCodec(t))
+			random := make([]byte, 100)
+			rand.Read(random)
+			assert.NoError(t, s.Set([]byte("json"), jsonValue("json", 0)))
+			assert.NoError(t, s.Set([]byte("random"), random))
+			assert.NoError(t, s.Set([]byte("small"), bytes.Repeat([]byte("s"), testCodecThreshold)))
+			assert.True(t, s.getValueAllocator().Used() < uint64(len(jsonValue("json", 0))+len(random)),
+				"Compressible values must be compressed")
+			assert.Equal(t, jsonValue("json", 0), s.Get([]byte("json")))
+			assert.Equal(t, random, s.Get([]byte("random")))
+			assert.Equal(t, bytes.Repeat([]byte("s"), testCodecThreshold), s.Get([]byte("small")))
+
+			// Values are compressed or stored as they are on updates too.
+			assert.NoError(t, s.Set([]byte("json"), []byte("not compressed")))
+			assert.NoError(t, s.Set([]byte("random"), jsonValue("random", 1)))
+			assert.NoError(t, s.Set([]byte("small"), random))
+			assert.Equal(t, []byte("not compressed"), s.Get([]byte("json")))
+			assert.Equal(t, jsonValue("random", 1), s.Get([]byte("random")))
+			assert.Equal(t, random, s.Get([]byte("small")))
+			assert.NoError(t, s.Validate())
+
+			assert.NoError(t, s.Compact())
+			assert.Equal(t, jsonValue("random", 1), s.Get([]byte("random")))
+			assert.NoError(t, s.Validate())
+			assert.NoError(t, s.ValueErr())
+		})
+	}
+}
+
+func TestSkipList_ValueCodec_ValueLog(t *testing.T) {
+	vlog, _, remove := tempValueLog(t, WithValueLogFileSize(1024))
+	defer remove()
+	// Values which are still large once compressed are logged.
+	s := NewSkipList(defaultAllocatorSize, WithValueCodec(newTestCodec(t), testCodecThreshold), WithValueLog(vlog, 64))
+	random := make([]byte, 100)
+	rand.Read(random)
+	for version := 0; version < 10; version++ {
+		assert.NoError(t, s.Set([]byte("json"), jsonValue("json", version)))
+		assert.NoError(t, s.Set([]byte("random"), random))
+	}
+	_, err := s.CollectValueLog(0.5)
+	assert.NoError(t, err)
+	assert.Equal(t, jsonValue("json", 9), s.Get([]byte("json")))
+	assert.Equal(t, random, s.Get([]byte("random")))
+	assert.NoError(t, s.Validate())
+	assert.NoError(t, s.ValueErr())
+}
+
+func TestSkipList_ValueCodec_DecodeError(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithValueCodec(failingCodec{newTestCodec(t)}, testCodecThreshold))
+	assert.NoError(t, s.Set([]byte("json"), jsonValue("json", 0)))
+	assert.Nil(t, s.Get([]byte("json")))
+	assert.EqualError(t, s.ValueErr(), "decode failed")
+}
+
+func TestReadSnapshot_ValueCodec(t *testing.T) {
+	codec := newTestCodec(t)
+	s := NewSkipList(defaultAllocatorSize, WithValueCodec(codec, testCodecThreshold))
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.NoError(t, s.Set([]byte(key), jsonValue(key, i)))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+
+	_, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<20)
+	assert.IsType(t, &SnapshotError{}, err, "Snapshot must not be loaded without its codec")
+
+	loaded, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<20, WithValueCodec(codec, testCodecThreshold))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.Equal(t, jsonValue(key, i), loaded.Get([]byte(key)))
+	}
+
+	// Exports contain values as they are.
+	buf.Reset()
+	assert.NoError(t, s.ExportSnapshot(&buf))
+	assert.Equal(t, string(jsonValue("key-1", 1)), readExportedList(t, buf.Bytes())["key-1"])
+}
+
+func BenchmarkSkipList_Get_ValueCodec(b *testing.B) {
+	codec, _ := NewFlateCodec(flate.BestSpeed)
+	s := NewSkipList(1<<26, WithValueCodec(codec, testCodecThreshold))
+	for i := 0; i < 1<<12; i++ {
+		key := fmt.Sprintf("key-%09d", i)
+		s.Set([]byte(key), jsonValue(key, 0))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Get([]byte(fmt.Sprintf("key-%09d", i%(1<<12))))
+	}
+}
@@ -0,0 +1,154 @@
+package goskip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpedNode is a node visited while dumping a level.
+type dumpedNode struct {
+	offset uint64
+	node   *node
+}
+
+// dumpLevel returns the nodes on given level in order.
+// Walk stops at the first offset outside allocated memory or at the first
+// node visited twice, reported by the returned message. Dumps are meant for
+// debugging broken lists, so they must not crash or loop on them.
+func (s *SkipList) dumpLevel(level uint8) ([]dumpedNode, string) {
+	var nodes []dumpedNode
+	visited := make(map[uint64]bool)
+	used := s.mainAllocator.Used()
+	for offset := s.head.getNextNodeOffset(level); offset != nilAllocatorOffset; {
+		if offset+s.nodeSize(1) > used {
+			return nodes, fmt.Sprintf("bad offset %d", offset)
+		}
+		if visited[offset] {
+			return nodes, fmt.Sprintf("cycle at offset %d", offset)
+		}
+		visited[offset] = true
+		node := s.getNode(offset)
+		nodes = append(nodes, dumpedNode{offset, node})
+		if node.height <= level || node.height > DefaultMaxHeight {
+			return nodes, fmt.Sprintf("bad height %d at offset %d", node.height, offset)
+		}
+		offset = node.getNextNodeOffset(level)
+	}
+	return nodes, ""
+}
+
+// dumpLabel returns a short description of the node: key, height and offset.
+func (s *SkipList) dumpLabel(n dumpedNode) string {
+	return fmt.Sprintf("%s[h%d@%d]", s.dumpKey(n), n.node.height, n.offset)
+}
+
+// dumpKey returns the printable key of the node, or a marker if
+// the key lies outside allocated memory.
+func (s *SkipList) dumpKey(n dumpedNode) string {
+	if s.validateNodeKey(n.offset, n.node) != nil {
+		return "<bad key>"
+	}
+	return formatKey(s.getNodeKey(n.node))
+}
+
+// DumpASCII writes the list to w, one line per level starting from the top.
+// Nodes are placed in columns by their position on the base level, so
+// towers line up vertically:
+//
+//	L1 head ------------------- -> "b"[h2@149] -> nil
+//	L0 head -> "a"[h1@129] -> "b"[h2@149] -> nil
+//
+// Each node is printed as key[h<height>@<offset>].
+func (s *SkipList) DumpASCII(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	baseNodes, _ := s.dumpLevel(0)
+	labels := make([]string, len(baseNodes))
+	columns := make(map[uint64]int, len(baseNodes))
+	for i, n := range baseNodes {
+		labels[i] = " -> " + s.dumpLabel(n)
+		columns[n.offset] = i
+	}
+
+	for level := int(s.getHeight()) - 1; level >= 0; level-- {
+		nodes, problem := s.dumpLevel(uint8(level))
+		present := make(map[int]bool, len(nodes))
+		// Nodes which are not on base level can not be placed in a column.
+		var misplaced []string
+		for _, n := range nodes {
+			if column, ok := columns[n.offset]; ok {
+				present[column] = true
+			} else {
+				misplaced = append(misplaced, s.dumpLabel(n))
+			}
+		}
+
+		fmt.Fprintf(bw, "L%-2d head", level)
+		for column, label := range labels {
+			if present[column] {
+				bw.WriteString(label)
+			} else {
+				bw.WriteString(" " + strings.Repeat("-", len(label)-1))
+			}
+		}
+		if problem != "" {
+			fmt.Fprintf(bw, " -> !%s", problem)
+		} else {
+			bw.WriteString(" -> nil")
+		}
+		if len(misplaced) > 0 {
+			fmt.Fprintf(bw, " !not on base level: %s", strings.Join(misplaced, ", "))
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// dotEscaper escapes characters with special meaning in record labels.
+var dotEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, `{`, `\{`, `}`, `\}`, `|`, `\|`, `<`, `\<`, `>`, `\>`,
+)
+
+// DumpDOT writes the list to w in Graphviz DOT format.
+// Every node is drawn as a record with its key, height, offset and one
+// field per level; edges follow the actual links on each level.
+func (s *SkipList) DumpDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	height := uint8(s.getHeight())
+	bw.WriteString("digraph skiplist {\n")
+	bw.WriteString("\trankdir=LR;\n")
+	bw.WriteString("\tnode [shape=record, fontname=monospace];\n")
+
+	// Head has a field for every level of the list.
+	bw.WriteString("\thead [label=\"head")
+	for level := int(height) - 1; level >= 0; level-- {
+		fmt.Fprintf(bw, "|<l%d> L%d", level, level)
+	}
+	bw.WriteString("\"];\n")
+
+	baseNodes, _ := s.dumpLevel(0)
+	for _, n := range baseNodes {
+		fmt.Fprintf(bw, "\tn%d [label=\"%s|h%d@%d", n.offset, dotEscaper.Replace(s.dumpKey(n)),
+			n.node.height, n.offset)
+		for level := int(n.node.height) - 1; level >= 0; level-- {
+			fmt.Fprintf(bw, "|<l%d> ", level)
+		}
+		bw.WriteString("\"];\n")
+	}
+
+	for level := uint8(0); level < height; level++ {
+		prev := "head"
+		nodes, problem := s.dumpLevel(level)
+		for _, n := range nodes {
+			fmt.Fprintf(bw, "\t%s:l%d -> n%d:l%d;\n", prev, level, n.offset, level)
+			prev = fmt.Sprintf("n%d", n.offset)
+		}
+		if problem != "" {
+			fmt.Fprintf(bw, "\tproblem%d [shape=plaintext, label=\"%s\"];\n", level, dotEscaper.Replace(problem))
+			fmt.Fprintf(bw, "\t%s:l%d -> problem%d [color=red];\n", prev, level, level)
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
@@ -0,0 +1,73 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipList_DumpASCII(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.DumpASCII(&buf))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, int(s.getHeight()), "There must be a line for each level")
+	for i, line := range lines {
+		assert.True(t, strings.HasPrefix(line, fmt.Sprintf("L%-2d head", len(lines)-1-i)))
+		assert.True(t, strings.HasSuffix(line, " -> nil"))
+		assert.Equal(t, len(lines[0]), len(line), "Levels must be aligned")
+	}
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		label := fmt.Sprintf("%s[h%d@", formatKey(s.getNodeKey(n)), n.height)
+		assert.Equal(t, int(n.height), strings.Count(buf.String(), label), "Node must be printed on each level")
+	}
+}
+
+func TestSkipList_DumpASCII_Cycle(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+	}
+	// Make the first node on base level point to itself.
+	first := s.head.getNextNodeOffset(0)
+	s.getNode(first).setNextNodeOffset(0, first)
+	var buf bytes.Buffer
+	assert.NoError(t, s.DumpASCII(&buf))
+	assert.Contains(t, buf.String(), fmt.Sprintf("!cycle at offset %d", first))
+}
+
+func TestSkipList_DumpDOT(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	s.Set([]byte(`odd "key" {|}`), []byte("value"))
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.DumpDOT(&buf))
+	dot := buf.String()
+
+	assert.True(t, strings.HasPrefix(dot, "digraph skiplist {\n"))
+	assert.True(t, strings.HasSuffix(dot, "}\n"))
+	assert.Contains(t, dot, `\"odd \\\"key\\\" \{\|\}\"`, "Keys must be escaped")
+	edges := 0
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		edges += int(n.height)
+	}
+	assert.Equal(t, edges, strings.Count(dot, " -> "), "There must be an edge for each link")
+}
+
+func TestSkipList_DumpDOT_BadOffset(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	s.Set([]byte("key"), []byte("value"))
+	s.getNode(s.head.getNextNodeOffset(0)).setNextNodeOffset(0, uint64(defaultAllocatorSize-1))
+	var buf bytes.Buffer
+	assert.NoError(t, s.DumpDOT(&buf))
+	assert.Contains(t, buf.String(), fmt.Sprintf("bad offset %d", defaultAllocatorSize-1))
+}
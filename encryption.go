@@ -0,0 +1,286 @@
+package goskip
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+ Encrypted data is sealed with AES-GCM under the current key of a keyring,
+ integers are little-endian:
+
+	[uint32 key ID][12 bytes random nonce][ciphertext][16 bytes tag]
+
+ Key ID selects the key to open it with, so keys can be rotated while data
+ sealed with older keys is still readable. Encrypted streams, such as
+ snapshots, are split into sealed chunks following a magic:
+
+	["GOSKIPEN"][uint32 chunk size][sealed chunk]...
+
+ Top bit of the size of the last chunk is set. Additional data of a chunk is
+ its index and whether it is the last one, so chunks can not be reordered,
+ and a stream cut at a chunk boundary is detected.
+*/
+
+// Size of the key ID and nonce preceding ciphertext.
+const sealHeaderSize = 4 + 12
+
+// Chunks of encrypted streams are sealed once they reach this size.
+const encryptedChunkSize = 64 << 10
+
+// Magic of encrypted streams.
+const encryptedMagic = "GOSKIPEN"
+
+// The last chunk of an encrypted stream is flagged by the top bit of its size.
+const encryptedLastChunkFlag = uint32(1) << 31
+
+// ErrUnknownKey is returned when data is encrypted with a key which is not
+// in the keyring, or there is no keyring.
+var ErrUnknownKey = errors.New("goskip: data is encrypted with an unknown key")
+
+// ErrDecryption is returned when encrypted data is corrupted, or the key
+// with its ID is not the one it is encrypted with.
+var ErrDecryption = errors.New("goskip: data can not be decrypted")
+
+// ErrNotEncrypted is returned by readers of NewDecryptingReader when the
+// stream is not encrypted.
+var ErrNotEncrypted = errors.New("goskip: stream is not encrypted")
+
+// Keyring keeps AES keys by ID. Data is encrypted with the current key and
+// decrypted with the key whose ID is stored with it.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// NewKeyring returns a keyring with given keys by ID, encrypting with the key
+// with given current ID. Keys are 16, 24 or 32 bytes long, selecting AES-128,
+// AES-192 or AES-256. To rotate keys, keep the old keys, which are needed to
+// read data encrypted before, and make the new key current.
+func NewKeyring(currentID uint32, keys map[uint32][]byte) (*Keyring, error) {
+	k := &Keyring{current: currentID, aeads: make(map[uint32]cipher.AEAD)}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	if _, ok := k.aeads[currentID]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return k, nil
+}
+
+// seal appends given plaintext, encrypted and authenticated with given
+// additional data, to dst.
+func (k *Keyring) seal(dst []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead := k.aeads[k.current]
+	var header [sealHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], k.current)
+	if _, err := io.ReadFull(rand.Reader, header[4:]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, header[:]...)
+	return aead.Seal(dst, header[4:], plaintext, additionalData), nil
+}
+
+// open returns the plaintext of given sealed data. A nil keyring knows no keys.
+func (k *Keyring) open(sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < sealHeaderSize {
+		return nil, ErrDecryption
+	}
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.aeads[binary.LittleEndian.Uint32(sealed)]
+	}
+	if aead == nil {
+		return nil, ErrUnknownKey
+	}
+	plaintext, err := aead.Open(nil, sealed[4:sealHeaderSize], sealed[sealHeaderSize:], additionalData)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
+
+// sealOverhead returns the number of bytes sealing adds to plaintext.
+func (k *Keyring) sealOverhead() int {
+	return sealHeaderSize + k.aeads[k.current].Overhead()
+}
+
+// chunkAdditionalData returns the additional data of the chunk with given
+// index of an encrypted stream.
+func chunkAdditionalData(index uint64, last bool) []byte {
+	var data [9]byte
+	binary.LittleEndian.PutUint64(data[:], index)
+	if last {
+		data[8] = 1
+	}
+	return data[:]
+}
+
+// encryptingWriter encrypts a stream in chunks, see NewEncryptingWriter.
+type encryptingWriter struct {
+	w       io.Writer
+	keyring *Keyring
+	buf     []byte
+	index   uint64
+	started bool
+	closed  bool
+	err     error
+}
+
+// NewEncryptingWriter returns a writer which encrypts the data written to it
+// with the current key of given keyring, and writes it to w. Close must be
+// called to write the last chunk, it does not close w. Use it to encrypt
+// snapshots, and NewDecryptingReader to read them:
+//
+//	w := NewEncryptingWriter(file, keyring)
+//	if err := s.WriteSnapshot(w); err != nil {
+//		...
+//	}
+//	err := w.Close()
+func NewEncryptingWriter(w io.Writer, keyring *Keyring) io.WriteCloser {
+	return &encryptingWriter{w: w, keyring: keyring}
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if ew.err != nil {
+			return written, ew.err
+		}
+		n := encryptedChunkSize - len(ew.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		ew.buf = append(ew.buf, p[:n]...)
+		p, written = p[n:], written+n
+		// The last chunk is written by Close, so a full chunk is written
+		// once more data follows it.
+		if len(ew.buf) == encryptedChunkSize && len(p) > 0 {
+			ew.err = ew.writeChunk(false)
+		}
+	}
+	return written, ew.err
+}
+
+// Close writes the buffered data as the last chunk.
+func (ew *encryptingWriter) Close() error {
+	if ew.closed || ew.err != nil {
+		return ew.err
+	}
+	ew.closed = true
+	ew.err = ew.writeChunk(true)
+	return ew.err
+}
+
+// writeChunk seals and writes the buffered data.
+func (ew *encryptingWriter) writeChunk(last bool) error {
+	var out []byte
+	if !ew.started {
+		out = append(out, encryptedMagic...)
+		ew.started = true
+	}
+	var size [4]byte
+	out = append(out, size[:]...)
+	sizeOffset := len(out) - len(size)
+	out, err := ew.keyring.seal(out, ew.buf, chunkAdditionalData(ew.index, last))
+	if err != nil {
+		return err
+	}
+	chunkSize := uint32(len(out) - sizeOffset - len(size))
+	if last {
+		chunkSize |= encryptedLastChunkFlag
+	}
+	binary.LittleEndian.PutUint32(out[sizeOffset:], chunkSize)
+	ew.buf = ew.buf[:0]
+	ew.index++
+	_, err = ew.w.Write(out)
+	return err
+}
+
+// decryptingReader decrypts a stream of NewEncryptingWriter.
+type decryptingReader struct {
+	r       io.Reader
+	keyring *Keyring
+	buf     []byte
+	index   uint64
+	started bool
+	last    bool
+	err     error
+}
+
+// NewDecryptingReader returns a reader which decrypts the stream written by
+// NewEncryptingWriter to r, with the keys of given keyring. Reads return
+// ErrNotEncrypted if the stream is not encrypted, ErrUnknownKey if a chunk is
+// encrypted with a key which is not in the keyring, ErrDecryption if a chunk
+// is corrupted, and io.ErrUnexpectedEOF if the stream ends before the last
+// chunk.
+func NewDecryptingReader(r io.Reader, keyring *Keyring) io.Reader {
+	return &decryptingReader{r: r, keyring: keyring}
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 && dr.err == nil {
+		dr.err = dr.readChunk()
+	}
+	if len(dr.buf) == 0 {
+		return 0, dr.err
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// readChunk reads and opens the next chunk.
+func (dr *decryptingReader) readChunk() error {
+	if dr.last {
+		return io.EOF
+	}
+	if !dr.started {
+		magic := make([]byte, len(encryptedMagic))
+		if _, err := io.ReadFull(dr.r, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrNotEncrypted
+		} else if err != nil {
+			return err
+		}
+		if !bytes.Equal(magic, []byte(encryptedMagic)) {
+			return ErrNotEncrypted
+		}
+		dr.started = true
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(dr.r, size[:]); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	chunkSize := binary.LittleEndian.Uint32(size[:])
+	last := chunkSize&encryptedLastChunkFlag != 0
+	// Size is not authenticated before the chunk is read, so the buffer
+	// only grows as data is read.
+	var sealed bytes.Buffer
+	if _, err := io.CopyN(&sealed, dr.r, int64(chunkSize&^encryptedLastChunkFlag)); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	plaintext, err := dr.keyring.open(sealed.Bytes(), chunkAdditionalData(dr.index, last))
+	if err != nil {
+		return err
+	}
+	dr.buf, dr.last = plaintext, last
+	dr.index++
+	return nil
+}
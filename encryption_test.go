@@ -0,0 +1,170 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKeyring returns a keyring encrypting with the key with given ID, and
+// knowing keys with given IDs.
+func newTestKeyring(t *testing.T, currentID uint32, ids ...uint32) *Keyring {
+	keys := map[uint32][]byte{currentID: testKey(currentID)}
+	for _, id := range ids {
+		keys[id] = testKey(id)
+	}
+	keyring, err := NewKeyring(currentID, keys)
+	assert.NoError(t, err)
+	return keyring
+}
+
+// testKey returns an AES-256 key for given ID.
+func testKey(id uint32) []byte {
+	return bytes.Repeat([]byte{byte(id)}, 32)
+}
+
+// encrypt returns given data encrypted with NewEncryptingWriter.
+func encrypt(t *testing.T, keyring *Keyring, data []byte) []byte {
+	var buf bytes.Buffer
+	w := NewEncryptingWriter(&buf, keyring)
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestNewKeyring(t *testing.T) {
+	_, err := NewKeyring(1, map[uint32][]byte{1: []byte("short")})
+	assert.Error(t, err)
+	_, err = NewKeyring(2, map[uint32][]byte{1: testKey(1)})
+	assert.Equal(t, ErrUnknownKey, err)
+	for _, size := range []int{16, 24, 32} {
+		_, err = NewKeyring(1, map[uint32][]byte{1: make([]byte, size)})
+		assert.NoError(t, err)
+	}
+}
+
+func TestKeyring_Seal(t *testing.T) {
+	keyring := newTestKeyring(t, 1)
+	sealed, err := keyring.seal(nil, []byte("value"), []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, len("value")+keyring.sealOverhead(), len(sealed))
+	assert.False(t, bytes.Contains(sealed, []byte("value")))
+
+	opened, err := keyring.open(sealed, []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), opened)
+	_, err = keyring.open(sealed, []byte("other"))
+	assert.Equal(t, ErrDecryption, err)
+	_, err = keyring.open(sealed[:sealHeaderSize-1], []byte("data"))
+	assert.Equal(t, ErrDecryption, err)
+	_, err = (*Keyring)(nil).open(sealed, []byte("data"))
+	assert.Equal(t, ErrUnknownKey, err)
+
+	// Data sealed with old keys is opened after rotation.
+	rotated := newTestKeyring(t, 2, 1)
+	opened, err = rotated.open(sealed, []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), opened)
+	_, err = newTestKeyring(t, 2).open(sealed, []byte("data"))
+	assert.Equal(t, ErrUnknownKey, err)
+
+	// A different key with the same ID fails.
+	wrong, err := NewKeyring(1, map[uint32][]byte{1: testKey(2)})
+	assert.NoError(t, err)
+	_, err = wrong.open(sealed, []byte("data"))
+	assert.Equal(t, ErrDecryption, err)
+}
+
+func TestEncryptingWriter(t *testing.T) {
+	keyring := newTestKeyring(t, 1)
+	sizes := []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 7}
+	for _, size := range sizes {
+		size := size
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			var buf bytes.Buffer
+			w := NewEncryptingWriter(&buf, keyring)
+			// Data is written in pieces not aligned to chunks.
+			for rest := data; len(rest) > 0; {
+				n := 1000
+				if n > len(rest) {
+					n = len(rest)
+				}
+				written, err := w.Write(rest[:n])
+				assert.NoError(t, err)
+				assert.Equal(t, n, written)
+				rest = rest[n:]
+			}
+			assert.NoError(t, w.Close())
+			assert.NoError(t, w.Close(), "Closing twice must do nothing")
+
+			decrypted, err := ioutil.ReadAll(NewDecryptingReader(bytes.NewReader(buf.Bytes()), keyring))
+			assert.NoError(t, err)
+			assert.Equal(t, data, decrypted)
+		})
+	}
+}
+
+func TestDecryptingReader_Errors(t *testing.T) {
+	keyring := newTestKeyring(t, 1)
+	data := bytes.Repeat([]byte("data"), encryptedChunkSize)
+	encrypted := encrypt(t, keyring, data)
+	firstChunkEnd := len(encryptedMagic) + 4 + encryptedChunkSize + keyring.sealOverhead()
+
+	flipped := append([]byte{}, encrypted...)
+	flipped[len(flipped)/2] ^= 0x10
+	lastFlag := append([]byte{}, encrypted...)
+	lastFlag[len(encryptedMagic)+3] |= 0x80
+
+	tests := map[string]struct {
+		data    []byte
+		keyring *Keyring
+		err     error
+	}{
+		"NotEncrypted":      {data: data, keyring: keyring, err: ErrNotEncrypted},
+		"Empty":             {data: nil, keyring: keyring, err: ErrNotEncrypted},
+		"UnknownKey":        {data: encrypted, keyring: newTestKeyring(t, 2), err: ErrUnknownKey},
+		"NoKeyring":         {data: encrypted, keyring: nil, err: ErrUnknownKey},
+		"Corrupted":         {data: flipped, keyring: keyring, err: ErrDecryption},
+		"FlaggedLast":       {data: lastFlag, keyring: keyring, err: ErrDecryption},
+		"TruncatedChunk":    {data: encrypted[:len(encrypted)-1], keyring: keyring, err: io.ErrUnexpectedEOF},
+		"TruncatedBoundary": {data: encrypted[:firstChunkEnd], keyring: keyring, err: io.ErrUnexpectedEOF},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := ioutil.ReadAll(NewDecryptingReader(bytes.NewReader(test.data), test.keyring))
+			assert.Equal(t, test.err, err)
+		})
+	}
+}
+
+func TestReadSnapshot_Encrypted(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	var buf bytes.Buffer
+	w := NewEncryptingWriter(&buf, newTestKeyring(t, 1))
+	assert.NoError(t, s.WriteSnapshot(w))
+	assert.NoError(t, w.Close())
+
+	// Snapshots are read after rotation.
+	loaded, err := ReadSnapshot(NewDecryptingReader(bytes.NewReader(buf.Bytes()), newTestKeyring(t, 2, 1)), 1<<20)
+	assert.NoError(t, err)
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, data.val, loaded.Get(data.key))
+	}
+	assert.NoError(t, loaded.Validate())
+
+	_, err = ReadSnapshot(NewDecryptingReader(bytes.NewReader(buf.Bytes()), newTestKeyring(t, 2)), 1<<20)
+	assert.Equal(t, ErrUnknownKey, err)
+}
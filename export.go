@@ -0,0 +1,233 @@
+package goskip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Records sections of ExportSnapshot are written once they exceed this size.
+const exportSectionSize = 64 << 10
+
+// snapshotExport keeps the state of the list at the time of an export for
+// the nodes which are changed after it. Writers save the value of a node
+// before they change it, and the nodes they create, unless the export has
+// already written the key. The export writes saved values instead of current
+// ones and skips created nodes, so only the list at the time of the export
+// is written.
+type snapshotExport struct {
+	mu sync.Mutex
+
+	// Key of the last node written, and whether any node is written.
+	// Nodes are written in key order, so every key up to it is written.
+	lastKey []byte
+	started bool
+
+	// Values of nodes at the time of the export, by node offset.
+	values map[uint64][]byte
+
+	// Offsets of nodes created after the export started.
+	created map[uint64]struct{}
+
+	// First error of reading a saved value, returned by the export.
+	err error
+}
+
+// isWritten returns whether given key is already written by the export.
+// It is called holding mu.
+func (e *snapshotExport) isWritten(key []byte) bool {
+	return e.started && compareKeys(key, e.lastKey) <= 0
+}
+
+// saveValue saves the current value of given node, which is about to change,
+// unless it is already written or saved. If the value can not be read, the
+// export fails.
+func (e *snapshotExport) saveValue(s *SkipList, node *node) {
+	key := s.getNodeKey(node)
+	offset := s.nodeOffset(node)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.isWritten(key) {
+		return
+	}
+	if _, ok := e.created[offset]; ok {
+		return
+	}
+	if _, ok := e.values[offset]; !ok {
+		val, err := s.readNodeValue(node)
+		if err != nil && e.err == nil {
+			e.err = err
+		}
+		e.values[offset] = append([]byte{}, val...)
+	}
+}
+
+// addNode records a node created after the export started, before it is
+// linked to the list.
+func (e *snapshotExport) addNode(offset uint64, key []byte) {
+	e.mu.Lock()
+	if !e.isWritten(key) {
+		e.created[offset] = struct{}{}
+	}
+	e.mu.Unlock()
+}
+
+// nodeValue returns the value of given node at the time of the export, and
+// false if the node is created after it. The node is marked as written.
+// An error is returned if the value, or a value saved by writers, can not be
+// read.
+func (e *snapshotExport) nodeValue(s *SkipList, offset uint64, node *node) ([]byte, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return nil, false, e.err
+	}
+	e.lastKey, e.started = s.getNodeKey(node), true
+	if _, ok := e.created[offset]; ok {
+		delete(e.created, offset)
+		return nil, false, nil
+	}
+	if val, ok := e.values[offset]; ok {
+		delete(e.values, offset)
+		return val, true, nil
+	}
+	val, err := s.readNodeValue(node)
+	if err != nil {
+		return nil, false, err
+	}
+	return append([]byte{}, val...), true, nil
+}
+
+// getExport returns the export in progress, or nil.
+func (s *SkipList) getExport() *snapshotExport {
+	return (*snapshotExport)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&s.export))))
+}
+
+// setExport replaces the export in progress.
+func (s *SkipList) setExport(e *snapshotExport) {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&s.export)), unsafe.Pointer(e))
+}
+
+// ExportSnapshot writes every key-value pair of the list at the time of the
+// call to w, in the snapshot format read by ReadSnapshot. Unlike WriteSnapshot
+// writers keep running: they are only blocked until the ones in progress
+// finish, and then save the values they change until the export writes them.
+// Only pairs are written, so wasted value space is left out, and the list can
+// be loaded into a list of any mode. Exports of a list are serialized.
+// If a value can not be read from value log or decoded, the error is
+// returned and the export is incomplete.
+func (s *SkipList) ExportSnapshot(w io.Writer) error {
+	s.exportMu.Lock()
+	defer s.exportMu.Unlock()
+
+	// Writers hold the read lock, so every writer either finishes before
+	// the export starts or sees it.
+	export := &snapshotExport{values: make(map[uint64][]byte), created: make(map[uint64]struct{})}
+	s.compactMu.Lock()
+	s.setExport(export)
+	s.compactMu.Unlock()
+	defer s.setExport(nil)
+
+	sw := &snapshotWriter{w: w}
+	if err := sw.writeHeader(); err != nil {
+		return err
+	}
+	var records []byte
+	for offset := s.head.getNextNodeOffset(0); offset != nilAllocatorOffset; {
+		node := s.getNode(offset)
+		val, ok, err := export.nodeValue(s, offset, node)
+		if err != nil {
+			return err
+		}
+		if ok {
+			records = appendExportRecord(records, s.getNodeKey(node), val)
+		}
+		if len(records) >= exportSectionSize {
+			if err := sw.writeSection(snapshotSectionRecords, records); err != nil {
+				return err
+			}
+			records = records[:0]
+		}
+		offset = node.getNextNodeOffset(0)
+	}
+	if len(records) > 0 {
+		if err := sw.writeSection(snapshotSectionRecords, records); err != nil {
+			return err
+		}
+	}
+	return sw.writeSection(snapshotSectionEnd, nil)
+}
+
+// appendExportRecord appends a key-value pair to records section data.
+func appendExportRecord(buf []byte, key []byte, val []byte) []byte {
+	var size [binary.MaxVarintLen64]byte
+	buf = append(buf, size[:binary.PutUvarint(size[:], uint64(len(key)))]...)
+	buf = append(buf, key...)
+	buf = append(buf, size[:binary.PutUvarint(size[:], uint64(len(val)))]...)
+	return append(buf, val...)
+}
+
+// decodeExportRecord returns the first key-value pair in records section
+// data and the rest of the data.
+func decodeExportRecord(data []byte) ([]byte, []byte, []byte, error) {
+	var fields [2][]byte
+	for i := range fields {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, nil, nil, errors.New("invalid record size")
+		}
+		fields[i], data = data[n:n+int(size)], data[n+int(size):]
+	}
+	return fields[0], fields[1], data, nil
+}
+
+// readExport loads a snapshot of ExportSnapshot whose first section header,
+// with given type, size and checksum, is already read. Errors of Set, such as
+// ErrArenaFull, are returned as they are.
+func readExport(sr *snapshotReader, sectionType uint32, size uint64, crc uint32, allocatorSize uint64, opts []Option) (*SkipList, error) {
+	var s *SkipList
+	if allocatorSize > maxCompactAllocatorSize {
+		s = NewWideSkipList(allocatorSize, opts...)
+	} else {
+		s = NewSkipList(uint32(allocatorSize), opts...)
+	}
+	var buf bytes.Buffer
+	for sectionType == snapshotSectionRecords {
+		// Size is not verified before the data is read, so the buffer
+		// only grows as data is read.
+		buf.Reset()
+		n, err := io.CopyN(&buf, sr.r, int64(size))
+		sr.offset += n
+		if err == io.EOF {
+			return nil, sr.fail(ErrSnapshotTruncated, "")
+		} else if err != nil {
+			return nil, err
+		}
+		if err := sr.readSectionData(crc32.Update(crc, castagnoliTable, buf.Bytes()), nil); err != nil {
+			return nil, err
+		}
+		for data := buf.Bytes(); len(data) > 0; {
+			key, val, rest, err := decodeExportRecord(data)
+			if err != nil {
+				return nil, sr.fail(ErrSnapshotInvalid, fmt.Sprintf("%v at byte %d", err, buf.Len()-len(data)))
+			}
+			if err := s.set(key, val); err != nil {
+				return nil, err
+			}
+			data = rest
+		}
+		if sectionType, size, crc, err = sr.readSectionHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if err := sr.readExpectedSection(snapshotSectionEnd, sectionType, size, crc, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
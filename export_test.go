@@ -0,0 +1,179 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hookWriter calls hook before the write with given index.
+type hookWriter struct {
+	bytes.Buffer
+	writes int
+	at     int
+	hook   func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	if w.writes == w.at {
+		w.hook()
+	}
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// readExportedList loads a snapshot and returns its pairs.
+func readExportedList(t *testing.T, snapshot []byte) map[string]string {
+	s, err := ReadSnapshot(bytes.NewReader(snapshot), 1<<24)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Validate())
+	pairs := make(map[string]string)
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		pairs[string(s.getNodeKey(n))] = string(s.getNodeValue(n))
+	}
+	return pairs
+}
+
+func TestSkipList_ExportSnapshot(t *testing.T) {
+	for name, newList := range snapshotLists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			s := newList()
+			expected := make(map[string]string)
+			for _, data := range uniqueNodesData {
+				assert.NoError(t, s.Set(data.key, []byte("old")))
+				assert.NoError(t, s.Set(data.key, data.val))
+				expected[string(data.key)] = string(data.val)
+			}
+			var buf bytes.Buffer
+			assert.NoError(t, s.ExportSnapshot(&buf))
+			assert.Equal(t, expected, readExportedList(t, buf.Bytes()))
+			assert.Nil(t, s.getExport(), "Export must be finished")
+		})
+	}
+}
+
+func TestSkipList_ExportSnapshot_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, NewSkipList(defaultAllocatorSize).ExportSnapshot(&buf))
+	assert.Equal(t, map[string]string{}, readExportedList(t, buf.Bytes()))
+}
+
+func TestSkipList_ExportSnapshot_ValueErr(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithValueCodec(failingCodec{newTestCodec(t)}, testCodecThreshold))
+	assert.NoError(t, s.Set([]byte("json"), jsonValue("json", 0)))
+	assert.NoError(t, s.Set([]byte("small"), []byte("value")))
+	assert.EqualError(t, s.ExportSnapshot(&bytes.Buffer{}), "decode failed", "Values must not be written empty")
+	assert.Nil(t, s.getExport(), "Export must be finished")
+}
+
+func TestSkipList_ExportSnapshot_Writers(t *testing.T) {
+	// Enough pairs for multiple records sections, updates happen while
+	// the first section is written.
+	const keyCount = 4096
+	values := []string{"", "inline", string(bytes.Repeat([]byte("large"), 10))}
+	s := NewSkipList(1 << 24)
+	expected := make(map[string]string)
+	for i := 0; i < keyCount; i++ {
+		key := fmt.Sprintf("key-%06d", i)
+		expected[key] = values[i%len(values)]
+		assert.NoError(t, s.Set([]byte(key), []byte(expected[key])))
+	}
+	w := &hookWriter{at: 1, hook: func() {
+		for i := 0; i < keyCount; i++ {
+			key := fmt.Sprintf("key-%06d", i)
+			assert.NoError(t, s.Set([]byte(key), []byte(values[(i+1)%len(values)])))
+			assert.NoError(t, s.Set([]byte(key+"-new"), []byte("new")))
+		}
+	}}
+	assert.NoError(t, s.ExportSnapshot(w))
+	assert.True(t, w.writes > 3, "Multiple sections must be written")
+	assert.Equal(t, expected, readExportedList(t, w.Bytes()), "Changes after export must not be written")
+	assert.Equal(t, []byte(values[1]), s.Get([]byte("key-000000")))
+}
+
+func TestSkipList_ExportSnapshot_Parallel(t *testing.T) {
+	const writerCount = 4
+	s := NewSkipList(1 << 24)
+	var stop uint32
+	var wg sync.WaitGroup
+	for i := 0; i < writerCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; atomic.LoadUint32(&stop) == 0; j++ {
+				// Keys of a writer are added in reverse key order, and the
+				// counter sorted before them is updated after every key.
+				assert.NoError(t, s.Set([]byte(fmt.Sprintf("w-%d-%09d", i, 1<<20-j)), []byte("value")))
+				assert.NoError(t, s.Set([]byte(fmt.Sprintf("c-%d", i)), []byte(strconv.Itoa(j))))
+			}
+		}(i)
+	}
+	var snapshots [][]byte
+	for k := 0; k < 5; k++ {
+		var buf bytes.Buffer
+		assert.NoError(t, s.ExportSnapshot(&buf))
+		snapshots = append(snapshots, buf.Bytes())
+	}
+	atomic.StoreUint32(&stop, 1)
+	wg.Wait()
+
+	for _, snapshot := range snapshots {
+		pairs := readExportedList(t, snapshot)
+		for i := 0; i < writerCount; i++ {
+			keyCount := 0
+			for ; ; keyCount++ {
+				if _, ok := pairs[fmt.Sprintf("w-%d-%09d", i, 1<<20-keyCount)]; !ok {
+					break
+				}
+			}
+			counter, ok := pairs[fmt.Sprintf("c-%d", i)]
+			if keyCount == 0 {
+				assert.False(t, ok)
+				continue
+			}
+			// The writer might have added a key but not updated the counter yet.
+			count, _ := strconv.Atoi(counter)
+			if assert.True(t, ok) {
+				assert.True(t, count+1 == keyCount || count+2 == keyCount,
+					"Writer %d has %d keys and counter %s in snapshot", i, keyCount, counter)
+			}
+		}
+	}
+}
+
+func TestReadSnapshot_ExportErrors(t *testing.T) {
+	s := newValidList(t)
+	var buf bytes.Buffer
+	assert.NoError(t, s.ExportSnapshot(&buf))
+	snapshot := buf.Bytes()
+	for size := 0; size < len(snapshot); size++ {
+		_, err := ReadSnapshot(bytes.NewReader(snapshot[:size]), 1<<20)
+		if assert.IsType(t, &SnapshotError{}, err, "Size %d", size) {
+			assert.Equal(t, ErrSnapshotTruncated, err.(*SnapshotError).Err, "Size %d", size)
+		}
+	}
+	for offset := 0; offset < len(snapshot); offset++ {
+		corrupted := append([]byte{}, snapshot...)
+		corrupted[offset] ^= 0x10
+		_, err := ReadSnapshot(bytes.NewReader(corrupted), 1<<20)
+		assert.IsType(t, &SnapshotError{}, err, "Offset %d", offset)
+	}
+}
+
+func BenchmarkSkipList_ExportSnapshot(b *testing.B) {
+	s := NewSkipList(1 << 26)
+	for i := 0; i < 1<<16; i++ {
+		s.Set([]byte(fmt.Sprintf("key-%09d", i)), []byte("value"))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		s.ExportSnapshot(&buf)
+	}
+}
@@ -0,0 +1,87 @@
+package goskip
+
+import "sync/atomic"
+
+// Searches of hash indexes give up after probing this many slots, and the
+// key is searched in the list instead.
+const maxHashIndexProbes = 32
+
+// hashIndex maps the hashes of keys to the offsets of their nodes, see
+// WithHashIndex. It is an open addressing table with linear probing.
+// Nodes are never moved or removed, so slots are filled once and never
+// changed afterwards.
+type hashIndex struct {
+	// Pairs of key hash and node offset. A slot is claimed by setting its
+	// hash with CAS, and its offset is stored afterwards, so readers might
+	// see a hash with offset 0 for a while. Hash 0 marks empty slots.
+	slots []uint64
+
+	// Number of slots minus one, which is a power of 2.
+	mask uint64
+}
+
+// newHashIndex returns an index of given number of keys. The index has at
+// least twice as many slots, so that probes end soon.
+func newHashIndex(keyCount int) *hashIndex {
+	size := uint64(2)
+	for size < 2*uint64(keyCount) {
+		size <<= 1
+	}
+	return &hashIndex{slots: make([]uint64, 2*size), mask: size - 1}
+}
+
+// indexHash returns the hash of given key in hash indexes, which is never 0.
+func indexHash(key []byte) uint64 {
+	if h := keyHash(key); h != 0 {
+		return h
+	}
+	return 1
+}
+
+// add adds the node with given offset, whose key has given hash. The node is
+// left out if the probed slots are full.
+func (ix *hashIndex) add(h uint64, offset uint64) {
+	slot := h & ix.mask
+	for i := 0; i < maxHashIndexProbes; i++ {
+		if atomic.CompareAndSwapUint64(&ix.slots[2*slot], 0, h) {
+			atomic.StoreUint64(&ix.slots[2*slot+1], offset)
+			return
+		}
+		slot = (slot + 1) & ix.mask
+	}
+}
+
+// getIndexedNode returns the node with given key if it is in hash index,
+// nil otherwise.
+func (s *SkipList) getIndexedNode(key []byte) *node {
+	ix := s.index
+	h, prefix := indexHash(key), keyPrefix(key)
+	slot := h & ix.mask
+	for i := 0; i < maxHashIndexProbes; i++ {
+		slotHash := atomic.LoadUint64(&ix.slots[2*slot])
+		if slotHash == 0 {
+			return nil
+		}
+		if slotHash == h {
+			node := s.getNode(atomic.LoadUint64(&ix.slots[2*slot+1]))
+			// Offset is not stored yet, the key is found by searching.
+			if node == nil {
+				return nil
+			}
+			if s.compareNodeKey(node, key, prefix) == 0 {
+				return node
+			}
+		}
+		slot = (slot + 1) & ix.mask
+	}
+	return nil
+}
+
+// fillHashIndex adds every node to hash index.
+func (s *SkipList) fillHashIndex() {
+	for offset := s.head.getNextNodeOffset(0); offset != nilAllocatorOffset; {
+		node := s.getNode(offset)
+		s.index.add(indexHash(s.getNodeKey(node)), offset)
+		offset = node.getNextNodeOffset(0)
+	}
+}
@@ -0,0 +1,158 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// indexedNodeCount returns the number of nodes in hash index of given list.
+func indexedNodeCount(s *SkipList) int {
+	count := 0
+	for slot := uint64(0); slot <= s.index.mask; slot++ {
+		if s.index.slots[2*slot+1] != nilAllocatorOffset {
+			count++
+		}
+	}
+	return count
+}
+
+func TestNewHashIndex(t *testing.T) {
+	tests := []struct {
+		keyCount int
+		size     uint64
+	}{
+		{0, 2},
+		{1, 2},
+		{2, 4},
+		{1000, 2048},
+		{1024, 2048},
+	}
+	for _, test := range tests {
+		ix := newHashIndex(test.keyCount)
+		assert.Equal(t, test.size-1, ix.mask, "%d keys", test.keyCount)
+		assert.Equal(t, int(2*test.size), len(ix.slots), "%d keys", test.keyCount)
+	}
+}
+
+func TestSkipList_HashIndex(t *testing.T) {
+	lists := map[string]func() *SkipList{
+		"Compact": func() *SkipList { return NewSkipList(defaultAllocatorSize, WithHashIndex(100)) },
+		"Wide":    func() *SkipList { return NewWideSkipList(uint64(defaultAllocatorSize), WithHashIndex(100)) },
+		"Bloom": func() *SkipList {
+			return NewSkipList(defaultAllocatorSize, WithHashIndex(100), WithBloomFilter(100, 10))
+		},
+	}
+	for name, newList := range lists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			s := newList()
+			for _, data := range uniqueNodesData {
+				assert.Nil(t, s.Get(data.key))
+				assert.NoError(t, s.Set(data.key, []byte("old")))
+				assert.NoError(t, s.Set(data.key, data.val))
+			}
+			assert.Equal(t, len(uniqueNodesData), indexedNodeCount(s), "Nodes must be indexed once")
+			for _, data := range uniqueNodesData {
+				assert.NotNil(t, s.getIndexedNode(data.key))
+				assert.Equal(t, data.val, s.Get(data.key))
+			}
+			assert.Nil(t, s.getIndexedNode([]byte("missing")))
+			assert.Nil(t, s.Get([]byte("missing")))
+
+			// Iteration is not affected.
+			expected := make(map[string]string)
+			for _, data := range uniqueNodesData {
+				expected[string(data.key)] = string(data.val)
+			}
+			assert.Equal(t, expected, listPairs(s))
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+func TestSkipList_HashIndex_Full(t *testing.T) {
+	s := NewSkipList(1<<20, WithHashIndex(1))
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		assert.NoError(t, s.Set(key, key))
+	}
+	assert.Equal(t, 2, indexedNodeCount(s))
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		assert.Equal(t, key, s.Get(key), "Keys which are not indexed must be searched")
+	}
+}
+
+func TestSkipList_HashIndex_Collision(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithHashIndex(100))
+	assert.NoError(t, s.Set([]byte("key"), []byte("value")))
+	assert.NoError(t, s.Set([]byte("other"), []byte("other value")))
+	// Node of a different key with the same hash, and a slot whose offset
+	// is not stored yet.
+	node, _ := s.getClosestNode([]byte("other"))
+	s.index.add(indexHash([]byte("missing")), s.nodeOffset(node))
+	s.index.add(indexHash([]byte("pending")), nilAllocatorOffset)
+	assert.Nil(t, s.getIndexedNode([]byte("missing")))
+	assert.Nil(t, s.Get([]byte("missing")))
+	assert.Nil(t, s.getIndexedNode([]byte("pending")))
+	assert.NoError(t, s.Set([]byte("pending"), []byte("pending value")))
+	assert.Equal(t, []byte("pending value"), s.Get([]byte("pending")))
+}
+
+func TestSkipList_HashIndex_Parallel(t *testing.T) {
+	s := NewSkipList(1<<24, WithHashIndex(1000))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				// Writers race to insert the same keys.
+				key := []byte(fmt.Sprintf("key-%d", j))
+				assert.NoError(t, s.Set(key, key))
+				assert.Equal(t, key, s.Get(key), "Keys must be found once they are set")
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1000, indexedNodeCount(s))
+	assert.NoError(t, s.Validate())
+}
+
+func TestReadSnapshot_HashIndex(t *testing.T) {
+	loaded, err := ReadSnapshot(bytes.NewReader(newSnapshot(t)), 1<<20, WithHashIndex(100))
+	assert.NoError(t, err)
+	assert.Equal(t, len(uniqueNodesData), indexedNodeCount(loaded))
+	for _, data := range uniqueNodesData {
+		assert.NotNil(t, loaded.getIndexedNode(data.key))
+		assert.Equal(t, data.val, loaded.Get(data.key))
+	}
+	assert.NoError(t, loaded.Set([]byte("new-key"), []byte("new-value")))
+	assert.NotNil(t, loaded.getIndexedNode([]byte("new-key")))
+}
+
+func BenchmarkSkipList_Get_HashIndex(b *testing.B) {
+	lists := map[string][]Option{
+		"Off": nil,
+		"On":  {WithHashIndex(1 << 16)},
+	}
+	keys := make([][]byte, 1<<16)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%09d", i))
+	}
+	for name, opts := range lists {
+		s := NewSkipList(1<<26, opts...)
+		for _, key := range keys {
+			s.Set(key, key)
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Package metrics exports skip list statistics via expvar and
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zeyneloz/goskip"
+)
+
+// Content type of Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter keeps a set of named skip lists and exports their statistics.
+// Exporter implements http.Handler, serving metrics in Prometheus text format.
+type Exporter struct {
+	mu    sync.RWMutex
+	lists map[string]*goskip.SkipList
+}
+
+// NewExporter returns an empty exporter.
+func NewExporter() *Exporter {
+	return &Exporter{lists: make(map[string]*goskip.SkipList)}
+}
+
+// Register adds given list to the exporter with given name.
+// Name is used as the value of `list` label. An existing list with the
+// same name is replaced.
+func (e *Exporter) Register(name string, list *goskip.SkipList) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lists[name] = list
+}
+
+// Unregister removes the list with given name from the exporter.
+func (e *Exporter) Unregister(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.lists, name)
+}
+
+// Snapshot returns statistics of every registered list, by name.
+func (e *Exporter) Snapshot() map[string]goskip.Stats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	snapshot := make(map[string]goskip.Stats, len(e.lists))
+	for name, list := range e.lists {
+		snapshot[name] = list.Stats()
+	}
+	return snapshot
+}
+
+// Publish publishes statistics of every registered list as an expvar
+// variable with given name. Like expvar.Publish, it panics if the name
+// is already in use.
+func (e *Exporter) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return e.Snapshot()
+	}))
+}
+
+// ServeHTTP writes metrics of every registered list in Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	// Client went away if writing fails, nothing to do about it.
+	_ = e.WriteMetrics(w)
+}
+
+// WriteMetrics writes metrics of every registered list in Prometheus text format.
+func (e *Exporter) WriteMetrics(w io.Writer) error {
+	snapshot := e.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, m := range exportedMetrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.kind)
+		for _, name := range names {
+			m.write(bw, m.name, escapeLabel(name), snapshot[name])
+		}
+	}
+	return bw.Flush()
+}
+
+// Publish publishes statistics of a single list as an expvar variable
+// with given name. Like expvar.Publish, it panics if the name is already in use.
+func Publish(name string, list *goskip.SkipList) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return list.Stats()
+	}))
+}
+
+// metric describes a single exported metric family.
+type metric struct {
+	name string
+	help string
+	kind string
+	// write writes the samples of the metric for a single list.
+	write func(w io.Writer, name string, list string, stats goskip.Stats)
+}
+
+// writeSample writes a sample with only the `list` label.
+func writeSample(w io.Writer, name string, list string, value interface{}) {
+	fmt.Fprintf(w, "%s{list=\"%s\"} %v\n", name, list, value)
+}
+
+var exportedMetrics = []metric{
+	{
+		name: "goskip_height",
+		help: "Current height of the skip list.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			writeSample(w, name, list, stats.Height)
+		},
+	},
+	{
+		name: "goskip_nodes",
+		help: "Number of nodes in the skip list.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			writeSample(w, name, list, stats.NodeCount)
+		},
+	},
+	{
+		name: "goskip_nodes_per_height",
+		help: "Number of nodes in the skip list by node height.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			for i, count := range stats.NodesPerHeight {
+				fmt.Fprintf(w, "%s{list=\"%s\",height=\"%d\"} %d\n", name, list, i+1, count)
+			}
+		},
+	},
+	{
+		name: "goskip_link_cas_failures_total",
+		help: "Number of failed CAS operations while linking new nodes.",
+		kind: "counter",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			writeSample(w, name, list, stats.LinkCASFailures)
+		},
+	},
+	{
+		name: "goskip_height_cas_failures_total",
+		help: "Number of failed CAS operations while increasing list height.",
+		kind: "counter",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			writeSample(w, name, list, stats.HeightCASFailures)
+		},
+	},
+	{
+		name: "goskip_wasted_value_bytes",
+		help: "Number of value bytes which can be reclaimed by compaction.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			writeSample(w, name, list, stats.WastedValueBytes)
+		},
+	},
+	{
+		name: "goskip_allocator_used_bytes",
+		help: "Number of bytes reserved in the allocator.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			fmt.Fprintf(w, "%s{list=\"%s\",allocator=\"main\"} %d\n", name, list, stats.MainAllocator.Used)
+			fmt.Fprintf(w, "%s{list=\"%s\",allocator=\"value\"} %d\n", name, list, stats.ValueAllocator.Used)
+		},
+	},
+	{
+		name: "goskip_allocator_capacity_bytes",
+		help: "Total number of bytes in the allocator.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			fmt.Fprintf(w, "%s{list=\"%s\",allocator=\"main\"} %d\n", name, list, stats.MainAllocator.Capacity)
+			fmt.Fprintf(w, "%s{list=\"%s\",allocator=\"value\"} %d\n", name, list, stats.ValueAllocator.Capacity)
+		},
+	},
+	{
+		name: "goskip_allocator_tail_waste_bytes",
+		help: "Number of bytes abandoned at the tails of allocation chunks.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, list string, stats goskip.Stats) {
+			fmt.Fprintf(w, "%s{list=\"%s\",allocator=\"main\"} %d\n", name, list, stats.MainAllocator.TailWaste)
+			fmt.Fprintf(w, "%s{list=\"%s\",allocator=\"value\"} %d\n", name, list, stats.ValueAllocator.TailWaste)
+		},
+	},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value as described in Prometheus text format.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeyneloz/goskip"
+)
+
+// Allocator size of the lists used in tests. 64 KB
+const allocatorSize = uint32(1 << 16)
+
+// newList returns a list with a few keys in it.
+func newList(keys ...string) *goskip.SkipList {
+	list := goskip.NewSkipList(allocatorSize)
+	for _, key := range keys {
+		list.Set([]byte(key), []byte("value"))
+	}
+	return list
+}
+
+func TestExporter_ServeHTTP(t *testing.T) {
+	e := NewExporter()
+	e.Register("memtable", newList("a", "b", "c"))
+	e.Register(`odd"name`, newList("a"))
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	assert.Equal(t, contentType, recorder.Header().Get("Content-Type"))
+	assert.Contains(t, body, "# TYPE goskip_nodes gauge\n")
+	assert.Contains(t, body, "# TYPE goskip_link_cas_failures_total counter\n")
+	assert.Contains(t, body, "goskip_nodes{list=\"memtable\"} 3\n")
+	assert.Contains(t, body, "goskip_nodes{list=\"odd\\\"name\"} 1\n", "Label values must be escaped")
+	assert.Contains(t, body, "goskip_allocator_capacity_bytes{list=\"memtable\",allocator=\"value\"} 65536\n")
+	assert.Contains(t, body, "goskip_allocator_tail_waste_bytes{list=\"memtable\",allocator=\"main\"} 0\n")
+	assert.Contains(t, body, "goskip_nodes_per_height{list=\"memtable\",height=\"1\"}")
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		assert.Len(t, strings.Fields(line), 2, "Sample lines must consist of name and value")
+	}
+}
+
+func TestExporter_Unregister(t *testing.T) {
+	e := NewExporter()
+	e.Register("memtable", newList("a"))
+	e.Unregister("memtable")
+	assert.Empty(t, e.Snapshot())
+}
+
+func TestExporter_Publish(t *testing.T) {
+	e := NewExporter()
+	e.Register("memtable", newList("a", "b"))
+	e.Publish("goskip_exporter_test")
+
+	var snapshot map[string]goskip.Stats
+	err := json.Unmarshal([]byte(expvar.Get("goskip_exporter_test").String()), &snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), snapshot["memtable"].NodeCount)
+}
+
+func TestPublish(t *testing.T) {
+	Publish("goskip_list_test", newList("a", "b", "c"))
+
+	var stats goskip.Stats
+	err := json.Unmarshal([]byte(expvar.Get("goskip_list_test").String()), &stats)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), stats.NodeCount)
+}
@@ -0,0 +1,40 @@
+package goskip
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMmapUnsupported is returned by NewMmapAllocator on platforms without mmap.
+var ErrMmapUnsupported = errors.New("goskip: mmap is not supported on this platform")
+
+// NewMmapAllocator returns an allocator whose memory is mapped with anonymous
+// mmap instead of being allocated on Go heap. Its memory is not accounted in
+// heap size, so large lists do not raise the GC target and are never scanned.
+// Pages are only backed by physical memory once they are written.
+//
+// Memory is not released by GC, Close must be called once the allocator and
+// every list using it are not used anymore.
+func NewMmapAllocator(size uint64) (*Allocator, error) {
+	if size > uint64(^uint(0)>>1)-defaultNodeSize {
+		return nil, fmt.Errorf("goskip: can not map %d bytes", size)
+	}
+	// Keep room for a node at the end, see newAllocator.
+	mem, err := mmap(size + defaultNodeSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Allocator{offset: initialAllocatorOffset, mem: mem[:size], mapped: true}, nil
+}
+
+// Close unmaps memory of an allocator returned by NewMmapAllocator. Any access
+// to the memory after Close crashes the program, so lists using the allocator
+// must not be used anymore. It does nothing for other allocators.
+func (allc *Allocator) Close() error {
+	if !allc.mapped {
+		return nil
+	}
+	mem := allc.mem[:cap(allc.mem)]
+	allc.mem, allc.mapped = nil, false
+	return munmap(mem)
+}
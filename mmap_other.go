@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package goskip
+
+// mmap maps size bytes of zeroed anonymous memory.
+func mmap(size uint64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+// munmap unmaps memory returned by mmap.
+func munmap(mem []byte) error {
+	return ErrMmapUnsupported
+}
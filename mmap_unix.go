@@ -0,0 +1,16 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package goskip
+
+import "syscall"
+
+// mmap maps size bytes of zeroed anonymous memory.
+func mmap(size uint64) ([]byte, error) {
+	return syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
+
+// munmap unmaps memory returned by mmap.
+func munmap(mem []byte) error {
+	return syscall.Munmap(mem)
+}
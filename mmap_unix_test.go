@@ -0,0 +1,72 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package goskip
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMmapAllocator(t *testing.T) {
+	a, err := NewMmapAllocator(allocatorSize)
+	assert.NoError(t, err)
+	assert.Equal(t, allocatorSize, a.Capacity(), "Allocator memory size must be equal to given size")
+	assert.Equal(t, initialAllocatorOffset, a.Used(), "Allocator offset must be 1 offset after init")
+	val := []byte("such_a_small_value")
+	offset := putBytes(t, a, val)
+	assert.Equal(t, val, a.BytesAt(offset, uint64(len(val))))
+	assert.NoError(t, a.Close())
+	assert.NoError(t, a.Close(), "Closing twice must do nothing")
+}
+
+func TestNewMmapAllocator_OffHeap(t *testing.T) {
+	const size = 256 << 20
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	a, err := NewMmapAllocator(size)
+	assert.NoError(t, err)
+	defer a.Close()
+	for offset := uint64(0); offset < size; offset += 4096 {
+		a.BytesAt(offset, 1)[0] = 1
+	}
+	runtime.ReadMemStats(&after)
+	assert.True(t, after.HeapSys < before.HeapSys+size/2, "Mapped memory must not be on heap")
+}
+
+func TestAllocator_Close_Heap(t *testing.T) {
+	a := NewAllocator(allocatorSize)
+	assert.NoError(t, a.Close(), "Closing a heap allocator must do nothing")
+	assert.Equal(t, allocatorSize, a.Capacity())
+}
+
+func TestSkipList_Mmap(t *testing.T) {
+	mainArena, err := NewMmapAllocator(allocatorSize)
+	assert.NoError(t, err)
+	valueArena, err := NewMmapAllocator(allocatorSize)
+	assert.NoError(t, err)
+	s := NewSkipList(0, WithArenas(mainArena, valueArena))
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+		assert.NoError(t, s.Set(data.key, append(data.val, "-new"...)))
+	}
+	assertNodesAligned(t, s)
+	assert.NoError(t, s.Validate())
+
+	assert.Equal(t, ErrCompactArena, s.Compact(), "Mapped arenas must not be replaced by Compact")
+	assert.Equal(t, Arena(valueArena), s.getValueAllocator())
+
+	compacted, err := NewMmapAllocator(allocatorSize)
+	assert.NoError(t, err)
+	replaced, err := s.CompactInto(compacted)
+	assert.NoError(t, err)
+	assert.NoError(t, replaced.(*Allocator).Close())
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, append(data.val, "-new"...), s.Get(data.key))
+	}
+	assert.NoError(t, s.Validate())
+	assert.NoError(t, mainArena.Close())
+	assert.NoError(t, compacted.Close())
+}
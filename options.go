@@ -0,0 +1,177 @@
+package goskip
+
+// options keeps the configuration of a skip list.
+type options struct {
+	// Align nodes to cache line size instead of nodeAlignment.
+	cacheLineAlignment bool
+
+	// Size of allocation chunks of writers, 0 if chunks are not used.
+	allocationChunkSize uint64
+
+	// Arenas used instead of the allocators created by the list, if not nil.
+	mainArena  Arena
+	valueArena Arena
+
+	// Write-ahead log of updates, if not nil.
+	wal *WAL
+
+	// Keep values in value arena in the order they are written.
+	trackChanges bool
+
+	// Value log of large values and the size above which values are
+	// logged, if vlog is not nil.
+	vlog              *ValueLog
+	valueLogThreshold int
+
+	// Codec of values and the size above which values are compressed,
+	// if codec is not nil.
+	codec          Codec
+	codecThreshold int
+
+	// Keyring decrypting write-ahead logs in Recover.
+	recoveryKeyring *Keyring
+
+	// Number of keys and bits per key of the Bloom filter of keys, if
+	// bloomBitsPerKey is not 0.
+	bloomKeyCount   int
+	bloomBitsPerKey int
+
+	// Number of keys of the hash index of nodes, if not 0.
+	hashIndexKeyCount int
+}
+
+// Option configures a skip list created by NewSkipList or NewWideSkipList.
+type Option func(*options)
+
+// newOptions applies given options to the default configuration.
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithCacheLineAlignment aligns every node to a cache line, so that the node
+// header and its lowest layers, which are read on every hop of a search,
+// are loaded with a single cache line. Nodes of concurrent writers never
+// share a cache line either. It costs up to a cache line of memory per node.
+func WithCacheLineAlignment() Option {
+	return func(o *options) {
+		o.cacheLineAlignment = true
+	}
+}
+
+// WithAllocationChunks makes writers reserve chunks of given size from the
+// allocators and allocate nodes and values in their own chunk, instead of
+// updating the shared allocator offset on every allocation, which is
+// contended by concurrent writers. 4096 is a good size for most workloads.
+//
+// When a chunk is exhausted, its remaining bytes are abandoned, they are
+// reported as TailWaste in Stats. Blocks larger than an eighth of a chunk
+// are not allocated in chunks, so at most that much is abandoned per chunk.
+// ReleaseChunks drops the unused parts of chunks, and Compact reclaims the
+// tail waste of value allocator. Chunks are only used by the allocators
+// created by the list, not by the arenas passed with WithArenas.
+func WithAllocationChunks(size uint64) Option {
+	return func(o *options) {
+		o.allocationChunkSize = size
+	}
+}
+
+// WithArenas makes the list keep nodes and keys in main arena and values in
+// value arena, instead of allocators it creates. Both arenas must be empty,
+// and must not be shared with other lists. Compact returns ErrCompactArena
+// for custom value arenas, use CompactInto to move values into another arena.
+func WithArenas(main Arena, value Arena) Option {
+	return func(o *options) {
+		o.mainArena = main
+		o.valueArena = value
+	}
+}
+
+// WithWAL makes the list append every update to given write-ahead log before
+// it becomes visible, see OpenWAL and Recover. The log must not be shared with
+// other lists, and must be closed once the list is not updated anymore.
+func WithWAL(wal *WAL) Option {
+	return func(o *options) {
+		o.wal = wal
+	}
+}
+
+// WithChangeTracking makes every value, even of a new node, be written to
+// a new place in value arena instead of inline or over the previous value,
+// so that ChangesSince can find the pairs changed after a watermark. It costs
+// the space and speed gained by inline values and in-place updates. Values
+// are not allocated in the chunks of WithAllocationChunks either, so that
+// their order in value arena is the order they are set. Snapshots of
+// WriteSnapshot record it, and must be read with it by ReadSnapshot.
+func WithChangeTracking() Option {
+	return func(o *options) {
+		o.trackChanges = true
+	}
+}
+
+// WithValueLog makes the list append values larger than given threshold to
+// given value log, and keep only a pointer to them in value arena. Get reads
+// such values from the log, see ValueErr for read errors. Values up to
+// 16 bytes are stored in nodes regardless of threshold. CollectValueLog
+// reclaims the space of overwritten values in the log. The log must not be
+// shared with other lists, and must be passed to ReadSnapshot to load
+// snapshots of the list.
+func WithValueLog(vlog *ValueLog, threshold int) Option {
+	return func(o *options) {
+		o.vlog = vlog
+		o.valueLogThreshold = threshold
+	}
+}
+
+// WithValueCodec makes the list compress values larger than given threshold
+// with given codec, unless they do not shrink, and flag them in value arena.
+// Get decompresses them, see ValueErr for decoding errors. Values up to 16
+// bytes are stored in nodes regardless of threshold. If the list has a value
+// log as well, values are compressed before they are appended to the log.
+// Values must be smaller than 1GB unless the list has a value log, and the
+// same codec must be passed to ReadSnapshot to load snapshots of the list.
+func WithValueCodec(codec Codec, threshold int) Option {
+	return func(o *options) {
+		o.codec = codec
+		o.codecThreshold = threshold
+	}
+}
+
+// WithRecoveryKeyring makes Recover decrypt the records of the write-ahead
+// log, which must be encrypted, see WithWALEncryption. It is ignored by lists
+// created otherwise.
+func WithRecoveryKeyring(keyring *Keyring) Option {
+	return func(o *options) {
+		o.recoveryKeyring = keyring
+	}
+}
+
+// WithBloomFilter makes the list keep a Bloom filter of its keys, sized for
+// given number of keys with given number of bits per key. Get checks the
+// filter first, and returns nil without searching the list for most missing
+// keys. 10 bits per key give about 1% false positives, which grow once the
+// list has more keys than the filter is sized for. The filter is written in
+// snapshots of WriteSnapshot, and used by the lists loaded from them.
+func WithBloomFilter(keyCount int, bitsPerKey int) Option {
+	return func(o *options) {
+		o.bloomKeyCount = keyCount
+		o.bloomBitsPerKey = bitsPerKey
+	}
+}
+
+// WithHashIndex makes the list keep a hash index from its keys to their
+// nodes, sized for given number of keys. Get looks keys up in the index
+// first, and searches the list only for the keys which are not in it, such
+// as missing keys. Nodes are left out of the index once the slots they hash
+// to are full, which gets likely as the list grows past given number of
+// keys. Every key costs 32 bytes of index memory or more, and iteration is
+// not affected. The index is not written in snapshots, lists loaded from
+// them build one when WithHashIndex is given.
+func WithHashIndex(keyCount int) Option {
+	return func(o *options) {
+		o.hashIndexKeyCount = keyCount
+	}
+}
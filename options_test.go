@@ -0,0 +1,205 @@
+package goskip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOptions(t *testing.T) {
+	assert.Equal(t, &options{}, newOptions(nil), "Options must be disabled by default")
+	o := newOptions([]Option{WithCacheLineAlignment(), WithAllocationChunks(4096)})
+	assert.True(t, o.cacheLineAlignment)
+	assert.Equal(t, uint64(4096), o.allocationChunkSize)
+}
+
+func TestWithCacheLineAlignment(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Compact": NewSkipList(defaultAllocatorSize, WithCacheLineAlignment()),
+		"Wide":    NewWideSkipList(uint64(defaultAllocatorSize), WithCacheLineAlignment()),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			for _, data := range uniqueNodesData {
+				assert.NoError(t, s.Set(data.key, data.val))
+			}
+			for n := s.head; n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+				assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(n))%cacheLineSize,
+					"Node must be aligned to cache line")
+			}
+			for _, data := range uniqueNodesData {
+				assert.Equal(t, data.val, s.Get(data.key))
+			}
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+func TestWithAllocationChunks(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Compact": NewSkipList(1<<20, WithAllocationChunks(1024)),
+		"Wide":    NewWideSkipList(1<<20, WithAllocationChunks(1024), WithCacheLineAlignment()),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			t.Run("Group", func(t *testing.T) {
+				for i := 0; i < 8; i++ {
+					i := i
+					t.Run(fmt.Sprintf("Writer-%d", i), func(t *testing.T) {
+						t.Parallel()
+						for j := 0; j < 200; j++ {
+							key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+							assert.NoError(t, s.Set(key, bytes.Repeat(key, j%4)))
+						}
+					})
+				}
+			})
+			for i := 0; i < 8; i++ {
+				for j := 0; j < 200; j++ {
+					key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+					assert.Equal(t, bytes.Repeat(key, j%4), s.Get(key))
+				}
+			}
+			assertNodesAligned(t, s)
+			assert.NoError(t, s.Validate())
+
+			s.ReleaseChunks()
+			stats := s.Stats()
+			assert.True(t, stats.MainAllocator.TailWaste < stats.MainAllocator.Used/8,
+				"At most an eighth of chunks must be abandoned")
+			assert.NoError(t, s.Validate())
+			s.Compact()
+			assert.Equal(t, uint64(0), s.Stats().ValueAllocator.TailWaste, "Compact must reclaim tail waste")
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+// faultyArena is an instrumented arena which fails allocations after
+// a number of them.
+type faultyArena struct {
+	// Kept first so that they are 64-bit aligned for atomic access.
+	allocations int64
+	failAfter   int64
+	*Allocator
+}
+
+var errInjected = errors.New("injected fault")
+
+func (a *faultyArena) Allocate(size uint64, align uint64) (uint64, error) {
+	if atomic.AddInt64(&a.allocations, 1) > a.failAfter {
+		return 0, errInjected
+	}
+	return a.Allocator.Allocate(size, align)
+}
+
+func TestWithArenas(t *testing.T) {
+	mainArena := &faultyArena{Allocator: NewAllocator(1 << 16), failAfter: 1 << 30}
+	valueArena := &faultyArena{Allocator: NewAllocator(1 << 16), failAfter: 1 << 30}
+	s := NewSkipList(0, WithArenas(mainArena, valueArena))
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, data.val, s.Get(data.key))
+	}
+	assert.NoError(t, s.Validate())
+	assert.Equal(t, int64(len(uniqueNodesData)+1), mainArena.allocations, "Nodes must be allocated in main arena")
+	assert.NotEqual(t, int64(0), valueArena.allocations, "Values must be allocated in value arena")
+	assert.Equal(t, mainArena.Used(), s.Stats().MainAllocator.Used)
+	assert.Equal(t, valueArena.Used(), s.Stats().ValueAllocator.Used)
+}
+
+func TestWithArenas_Fault(t *testing.T) {
+	s := NewSkipList(0, WithArenas(
+		&faultyArena{Allocator: NewAllocator(1 << 16), failAfter: 6},
+		&faultyArena{Allocator: NewAllocator(1 << 16), failAfter: 1 << 30},
+	))
+	var err error
+	i := 0
+	for ; err == nil; i++ {
+		err = s.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+	assert.Equal(t, errInjected, err, "Errors of the arena must be returned")
+	assert.Equal(t, 6, i, "Every node allocation but the last one must succeed")
+	assert.Nil(t, s.Get([]byte(fmt.Sprintf("key%d", i-1))))
+	assert.Equal(t, []byte("value"), s.Get([]byte("key0")))
+	assert.NoError(t, s.Validate())
+}
+
+// Layouts compared in benchmarks.
+var benchmarkLayouts = []struct {
+	name string
+	opts []Option
+}{
+	{"Default", nil},
+	{"CacheLine", []Option{WithCacheLineAlignment()}},
+}
+
+func BenchmarkSkipList_Set_Layout(b *testing.B) {
+	for _, layout := range benchmarkLayouts {
+		layout := layout
+		b.Run(layout.name, func(b *testing.B) {
+			benchmarkSet(b, func(keyCount int) *SkipList {
+				return NewSkipList(uint32(keyCount)*192+1<<20, layout.opts...)
+			})
+		})
+	}
+}
+
+func BenchmarkSkipList_Get_Layout(b *testing.B) {
+	const keyCount = 1 << 18
+	keys := make([][]byte, keyCount)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%09d", i))
+	}
+	for _, layout := range benchmarkLayouts {
+		layout := layout
+		b.Run(layout.name, func(b *testing.B) {
+			s := NewSkipList(keyCount*192+1<<20, layout.opts...)
+			// Insert in random order, so that neighbours are not adjacent in memory.
+			for _, i := range rand.Perm(keyCount) {
+				s.Set(keys[i], []byte("value"))
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					s.Get(keys[r.Intn(keyCount)])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSkipList_Set_Chunks(b *testing.B) {
+	chunkSizes := []struct {
+		name string
+		size uint64
+	}{
+		{"Shared", 0},
+		{"Chunks-4KiB", 4096},
+	}
+	for _, chunkSize := range chunkSizes {
+		chunkSize := chunkSize
+		b.Run(chunkSize.name, func(b *testing.B) {
+			s := NewSkipList(uint32(b.N)*192+1<<20, WithAllocationChunks(chunkSize.size))
+			var writer uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				id := atomic.AddUint64(&writer, 1)
+				for i := 0; pb.Next(); i++ {
+					s.Set([]byte(fmt.Sprintf("key-%d-%09d", id, i)), []byte("value"))
+				}
+			})
+		})
+	}
+}
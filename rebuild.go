@@ -0,0 +1,153 @@
+package goskip
+
+import (
+	"fmt"
+	"sort"
+)
+
+// UndecodableEntry is a part of main arena which Rebuild could not decode.
+type UndecodableEntry struct {
+	// Offset and size of the part in main arena.
+	Offset uint64
+	Size   uint64
+
+	// Reason describes why the first node of the part could not be decoded.
+	Reason string
+}
+
+// RebuildReport describes the nodes found by Rebuild.
+type RebuildReport struct {
+	// Number of pairs in the rebuilt list.
+	Recovered int
+
+	// Number of nodes dropped since another node has the same key.
+	// Writers racing to insert the same key leave such nodes behind.
+	Duplicates int
+
+	// Parts of main arena which could not be decoded, in offset order.
+	Undecodable []UndecodableEntry
+}
+
+// Rebuild creates a new list with the same mode and capacity, and given
+// options, from the nodes found by scanning main arena from start to end.
+// Links between nodes are not followed, so a list whose links are damaged
+// can be recovered as long as its nodes are intact.
+//
+// A node is decoded if its layout, key and value lie within allocated memory
+// and its key prefix matches its key, see Validate. Parts of the arena which
+// can not be decoded are skipped until the next node, and reported. So are
+// nodes whose value can not be read from value log or decoded. Unused
+// memory must be zero, as it is in allocators of this package. If there are
+// multiple nodes with the same key, the one linked by another node is kept.
+// Writers are blocked during Rebuild; errors of the new list, such as
+// ErrArenaFull, are returned.
+func (s *SkipList) Rebuild(opts ...Option) (*SkipList, *RebuildReport, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	report := &RebuildReport{}
+	// Offsets of decoded nodes by key, and offsets linked by decoded nodes.
+	nodes := make(map[string][]uint64)
+	linked := make(map[uint64]bool)
+
+	headOffset := s.nodeOffset(s.head)
+	base := uint64(uintptr(s.mainAllocator.NodeAt(0)))
+	// alignUp returns the first offset from given one where a node can start.
+	alignUp := func(offset uint64) uint64 {
+		return (base+offset+s.nodeAlignment-1)&^(s.nodeAlignment-1) - base
+	}
+	mainUsed := s.mainAllocator.Used()
+	// Index of the undecodable entry which is being extended, or -1.
+	undecodable := -1
+	for offset := alignUp(initialAllocatorOffset); offset+s.nodeSize(1) <= mainUsed; {
+		node, err := s.validateNodeLayout(offset)
+		if err != nil {
+			// Unused memory, such as alignment padding, is zero. Corrupted
+			// nodes might have zero bytes too, so the entry being extended
+			// still covers them if undecodable bytes follow.
+			if isZero(s.mainAllocator.BytesAt(offset, s.nodeAlignment)) {
+				offset += s.nodeAlignment
+				continue
+			}
+			if undecodable < 0 {
+				report.Undecodable = append(report.Undecodable, UndecodableEntry{Offset: offset, Reason: err.Error()})
+				undecodable = len(report.Undecodable) - 1
+			}
+			entry := &report.Undecodable[undecodable]
+			entry.Size = offset + s.nodeAlignment - entry.Offset
+			offset += s.nodeAlignment
+			continue
+		}
+		undecodable = -1
+		for level := uint8(0); level < node.height; level++ {
+			linked[node.getNextNodeOffset(level)] = true
+		}
+		size := s.nodeBlockSize(node)
+		if offset != headOffset {
+			if err := s.validateNodeValue(offset, node); err != nil {
+				report.Undecodable = append(report.Undecodable, UndecodableEntry{
+					Offset: offset,
+					Size:   size,
+					Reason: fmt.Sprintf("value of node at offset %d %v", offset, err),
+				})
+			} else {
+				key := string(s.getNodeKey(node))
+				nodes[key] = append(nodes[key], offset)
+			}
+		}
+		offset = alignUp(offset + size)
+	}
+
+	capacity := s.mainAllocator.Capacity()
+	if valueCapacity := s.getValueAllocator().Capacity(); valueCapacity > capacity {
+		capacity = valueCapacity
+	}
+	rebuilt := newSkipList(capacity, s.wide, opts)
+	for key, offsets := range nodes {
+		chosen := offsets[0]
+		for _, offset := range offsets {
+			if linked[offset] {
+				chosen = offset
+				break
+			}
+		}
+		report.Duplicates += len(offsets) - 1
+		node := s.getNode(chosen)
+		val, err := s.readNodeValue(node)
+		if err != nil {
+			report.Undecodable = append(report.Undecodable, UndecodableEntry{
+				Offset: chosen,
+				Size:   s.nodeBlockSize(node),
+				Reason: fmt.Sprintf("value of node at offset %d can not be read: %v", chosen, err),
+			})
+			continue
+		}
+		if err := rebuilt.set([]byte(key), val); err != nil {
+			return nil, report, err
+		}
+		report.Recovered++
+	}
+	sort.Slice(report.Undecodable, func(i, j int) bool {
+		return report.Undecodable[i].Offset < report.Undecodable[j].Offset
+	})
+	return rebuilt, report, nil
+}
+
+// nodeBlockSize returns the size of the block allocated for given node.
+func (s *SkipList) nodeBlockSize(node *node) uint64 {
+	if node.flags&nodeFlagInlineValue != 0 {
+		return s.getInlineValueAreaOffset(node) + inlineValueAreaSize
+	}
+	keyOffset, keySize := s.getNodeKeyBounds(node)
+	return keyOffset + keySize
+}
+
+// isZero returns whether every byte of given slice is zero.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
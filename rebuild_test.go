@@ -0,0 +1,133 @@
+package goskip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listPairs returns the pairs of given list by following level 0.
+func listPairs(s *SkipList) map[string]string {
+	pairs := make(map[string]string)
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		pairs[string(s.getNodeKey(n))] = string(s.getNodeValue(n))
+	}
+	return pairs
+}
+
+func TestSkipList_Rebuild(t *testing.T) {
+	for name, newList := range snapshotLists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			s := newList()
+			expected := make(map[string]string)
+			for _, data := range uniqueNodesData {
+				assert.NoError(t, s.Set(data.key, []byte("old")))
+				assert.NoError(t, s.Set(data.key, data.val))
+				expected[string(data.key)] = string(data.val)
+			}
+			large := bytes.Repeat([]byte("k"), int(largeKeySize)+1)
+			assert.NoError(t, s.Set(large, []byte("large")))
+			expected[string(large)] = "large"
+
+			// Unlink every node.
+			for level := uint8(0); level < DefaultMaxHeight; level++ {
+				s.head.setNextNodeOffset(level, nilAllocatorOffset)
+			}
+			assert.Empty(t, listPairs(s))
+
+			rebuilt, report, err := s.Rebuild()
+			assert.NoError(t, err)
+			assert.Equal(t, &RebuildReport{Recovered: len(expected)}, report)
+			assert.Equal(t, expected, listPairs(rebuilt))
+			assert.Equal(t, s.wide, rebuilt.wide)
+			assert.NoError(t, rebuilt.Validate())
+		})
+	}
+}
+
+func TestSkipList_Rebuild_Empty(t *testing.T) {
+	rebuilt, report, err := NewSkipList(defaultAllocatorSize).Rebuild()
+	assert.NoError(t, err)
+	assert.Equal(t, &RebuildReport{}, report)
+	assert.Empty(t, listPairs(rebuilt))
+}
+
+func TestSkipList_Rebuild_InvalidNode(t *testing.T) {
+	s := newValidList(t)
+	expected := listPairs(s)
+	offset := s.head.getNextNodeOffset(0)
+	node := s.getNode(offset)
+	delete(expected, string(s.getNodeKey(node)))
+	node.height = DefaultMaxHeight + 1
+	// Zero bytes in the middle of a corrupted node are not unused memory.
+	node.keyPrefix = 0
+
+	rebuilt, report, err := s.Rebuild()
+	assert.NoError(t, err)
+	assert.Equal(t, len(expected), report.Recovered)
+	if assert.Len(t, report.Undecodable, 1) {
+		entry := report.Undecodable[0]
+		assert.Equal(t, offset, entry.Offset)
+		assert.True(t, entry.Size > 0)
+		assert.Contains(t, entry.Reason, "invalid height")
+	}
+	assert.Equal(t, expected, listPairs(rebuilt), "Nodes after an invalid one must be found")
+}
+
+func TestSkipList_Rebuild_InvalidValue(t *testing.T) {
+	s := newValidList(t)
+	expected := listPairs(s)
+	offset := s.head.getNextNodeOffset(0)
+	node := s.getNode(offset)
+	delete(expected, string(s.getNodeKey(node)))
+	node.encodeValue(uint32(s.getValueAllocator().Used()), 1)
+
+	rebuilt, report, err := s.Rebuild()
+	assert.NoError(t, err)
+	if assert.Len(t, report.Undecodable, 1) {
+		entry := report.Undecodable[0]
+		assert.Equal(t, offset, entry.Offset)
+		assert.Equal(t, s.nodeBlockSize(node), entry.Size)
+		assert.Contains(t, entry.Reason, "value of node")
+	}
+	assert.Equal(t, expected, listPairs(rebuilt))
+}
+
+func TestSkipList_Rebuild_ValueErr(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithValueCodec(failingCodec{newTestCodec(t)}, testCodecThreshold))
+	assert.NoError(t, s.Set([]byte("json"), jsonValue("json", 0)))
+	assert.NoError(t, s.Set([]byte("small"), []byte("value")))
+	node, _ := s.getClosestNode([]byte("json"))
+
+	rebuilt, report, err := s.Rebuild()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Recovered)
+	if assert.Len(t, report.Undecodable, 1) {
+		entry := report.Undecodable[0]
+		assert.Equal(t, s.nodeOffset(node), entry.Offset)
+		assert.Equal(t, s.nodeBlockSize(node), entry.Size)
+		assert.Contains(t, entry.Reason, "decode failed")
+	}
+	assert.Equal(t, map[string]string{"small": "value"}, listPairs(rebuilt))
+}
+
+func TestSkipList_Rebuild_Duplicates(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	assert.NoError(t, s.Set([]byte("key"), []byte("linked")))
+	// A node left behind by a writer which lost the race to insert the key.
+	_, _, err := s.newNode(1, []byte("key"), []byte("abandoned"))
+	assert.NoError(t, err)
+
+	rebuilt, report, err := s.Rebuild()
+	assert.NoError(t, err)
+	assert.Equal(t, &RebuildReport{Recovered: 1, Duplicates: 1}, report)
+	assert.Equal(t, map[string]string{"key": "linked"}, listPairs(rebuilt))
+}
+
+func TestSkipList_Rebuild_ArenaFull(t *testing.T) {
+	s := newValidList(t)
+	_, _, err := s.Rebuild(WithArenas(newAllocator(512), newAllocator(512)))
+	assert.Equal(t, ErrArenaFull, err)
+}
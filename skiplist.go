@@ -1,7 +1,12 @@
 package goskip
 
 import (
+	"encoding/binary"
+	"errors"
+	"math"
 	"math/rand"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
@@ -12,6 +17,53 @@ const (
 	defaultLevelP    = 0.5
 )
 
+const (
+	// Size of a layer of a node in wide mode, in bytes.
+	wideLayerSize = int(unsafe.Sizeof(uint64(0)))
+
+	// Offset of layers in a node in wide mode.
+	// Layers start right after node header, aligned to 8 bytes for atomic access.
+	wideLayersOffset = (unsafe.Offsetof(node{}.layers) + 7) &^ 7
+
+	// Size of the header that keeps the size of a value in wide mode.
+	wideValueHeaderSize = uint64(4)
+)
+
+const (
+	// Keys with at least this size are large keys. keySize of a large key
+	// node is set to largeKeySize and the actual size is stored in
+	// allocator, right before the key bytes.
+	largeKeySize = uint16(1<<16 - 1)
+
+	// Size of the header that keeps the actual size of a large key.
+	largeKeyHeaderSize = uint64(4)
+)
+
+const (
+	// Values up to this size are stored inline, in the node block, if the
+	// node is created with such a value. Reading them costs no access to
+	// value allocator.
+	maxInlineValueSize = 16
+
+	// Number of inline value slots of a node. Writers always fill the slot
+	// which is not being read, see setInlineValue.
+	inlineValueSlotCount = 2
+
+	// Size of the inline value area of a node: value slots followed by
+	// a uint32 writer lock.
+	inlineValueAreaSize = uint64(inlineValueSlotCount*maxInlineValueSize + 4)
+
+	// Inline values are flagged by the top bit of encodedValue in wide mode.
+	wideInlineValueFlag = uint64(1) << 63
+)
+
+// ErrKeyTooLarge is returned when a key does not fit into allocator.
+var ErrKeyTooLarge = errors.New("goskip: key is too large")
+
+// ErrCompactArena is returned by Compact for lists whose value arena is
+// mapped or custom, see CompactInto.
+var ErrCompactArena = errors.New("goskip: Compact requires a heap value allocator, use CompactInto")
+
 // A note on CPU Cache Performance:
 // Try to align your structures with cache line size.
 // For structures that generally contain data elements of different types,
@@ -28,21 +80,34 @@ const (
 // the parts of the structure that are touched together in memory,
 // which may lead to improved cache locality.
 type node struct {
-	// valSize (uint32) and valOffset (uint32) is encoded as a single uint64 value,
-	// so that we can atomically load this values.
+	// In compact mode, valSize (uint32) and valOffset (uint32) is encoded
+	// as a single uint64 value, so that we can atomically load this values.
 	// valSize -> bits 0-31
 	// valOffset -> bits 32-63
+	// In wide mode, it is the offset of the value, which starts with
+	// a wideValueHeaderSize bytes size header. Values are never
+	// overwritten in wide mode, so the size is read without atomics.
+	// Inline values are encoded differently, see encodeInlineValue.
 	encodedValue uint64
 
+	// First bytes of the key, see keyPrefix. Searches compare it before
+	// reading the key, which is needed only when prefixes are equal.
+	// keyPrefix never changes.
+	keyPrefix uint64
+
+	// Size of the key. Key bytes are placed right after the layers of the
+	// node, so that a node and its key are read from adjacent memory.
+	// keySize never changes
+	// If keySize is largeKeySize, key bytes are preceded by a size header.
+	keySize uint16 // 2 Bytes
+
 	// Height of the current node.
 	// 1 < height < maxHeight.
 	// Height never changes even on
 	height uint8 // 1 Byte
 
-	// Key offset and size in allocator.
-	// keyOffset and keySize never changes
-	keyOffset uint32 // 4 Bytes
-	keySize   uint16 // 2 Bytes
+	// Node flags, see nodeFlagWide and nodeFlagInlineValue.
+	flags uint8 // 1 Byte
 
 	// Instead of creating a new node for the same key,
 	// use existing node to save space (also for improved cache locality).
@@ -50,9 +115,20 @@ type node struct {
 	// layers definition should always be at the end of the struct since
 	// we might allocate less space for it in memory to reduce
 	// memory footprint.
+	// In wide mode layers are uint64 and start at wideLayersOffset,
+	// so this field must not be accessed directly.
 	layers [DefaultMaxHeight]uint32 // 4 Byte for each level. Average: 32 Byte
 }
 
+// nodeFlagWide is set for nodes of lists in wide mode.
+const nodeFlagWide = uint8(1)
+
+// nodeFlagInlineValue is set for nodes with an inline value area.
+// It is placed right after the key, aligned to 8 bytes for atomic access.
+// Keys are read for every node visited by a search, but values only for
+// the one found, so the key is kept closer to the layers.
+const nodeFlagInlineValue = uint8(2)
+
 // SkipList represents a skip list.
 type SkipList struct {
 	// Current height of the list.
@@ -62,83 +138,599 @@ type SkipList struct {
 	head *node
 
 	// Value Allocator is used for allocating node values.
-	valueAllocator *Allocator
+	// It is replaced by Compact, always load it with getValueAllocator.
+	valueAllocator *Arena
 
 	// Root Allocator is used for every other allocation: key, node etc...
-	mainAllocator *Allocator
+	mainAllocator Arena
+
+	// Size of allocation chunks of new allocators, see WithAllocationChunks.
+	allocationChunkSize uint64
+
+	// In wide mode offsets are 64 bits, otherwise 32 bits.
+	wide bool
+
+	// Alignment of nodes in main allocator.
+	nodeAlignment uint64
+
+	// Every value is written to a new place in value allocator, see
+	// WithChangeTracking.
+	trackChanges bool
+
+	// compactSeq is odd while Compact is swapping value allocators.
+	// Readers use it as a sequence lock to detect a concurrent swap.
+	compactSeq uint32
+
+	// Writers hold the read lock, Compact holds the write lock.
+	compactMu sync.RWMutex
+
+	// Counters reported by Stats.
+	stats *listStats
+
+	// Write-ahead log of updates, nil if updates are not logged.
+	wal *WAL
+
+	// Export in progress, see ExportSnapshot. Writers load it with getExport.
+	export *snapshotExport
+
+	// Held by ExportSnapshot, only one export runs at a time.
+	exportMu sync.Mutex
+
+	// Values larger than valueLogThreshold are stored in value log,
+	// see WithValueLog. vlog is nil if values are not logged.
+	vlog              *ValueLog
+	valueLogThreshold int
+
+	// Values larger than codecThreshold are compressed by codec,
+	// see WithValueCodec. codec is nil if values are not compressed.
+	codec          Codec
+	codecThreshold int
+
+	// First error of reading a value, see ValueErr.
+	valueErrMu sync.Mutex
+	valueErr   error
+
+	// Bloom filter of keys, see WithBloomFilter. nil if there is no filter.
+	bloom *bloomFilter
+
+	// Hash index of nodes, see WithHashIndex. nil if there is no index.
+	index *hashIndex
 }
 
 // newNode creates a node with given height and returns node and the offset.
-func newNode(allc *Allocator, valAllc *Allocator, height uint8, key []byte, val []byte) (*node, uint32) {
-	truncatedSize := (DefaultMaxHeight - int(height)) * LayerSize
-	keyOffset := allc.putBytes(key)
-	nodeOffset := allc.makeNode(uint32(truncatedSize))
-	valOffset := valAllc.putBytes(val)
-	node := allc.getNode(nodeOffset)
+// Node and its key are allocated as a single block. If given value is small
+// enough, node gets an inline value area and the value is stored there.
+func (s *SkipList) newNode(height uint8, key []byte, val []byte) (*node, uint64, error) {
+	var flags uint8
+	if s.wide {
+		flags |= nodeFlagWide
+	}
+	if len(val) <= maxInlineValueSize && !s.trackChanges {
+		flags |= nodeFlagInlineValue
+	}
+	size := s.nodeSize(height)
+	blockSize := size + keyStorageSize(key)
+	if flags&nodeFlagInlineValue != 0 {
+		blockSize = inlineValueAreaOffset(blockSize) + inlineValueAreaSize
+	}
+	// Value is allocated first, so that a failure does not leave an
+	// unreachable node behind.
+	var encodedValue uint64
+	if flags&nodeFlagInlineValue == 0 {
+		var err error
+		if encodedValue, err = s.putNodeValue(s.getValueAllocator(), val); err != nil {
+			return nil, nilAllocatorOffset, err
+		}
+	}
+	nodeOffset, err := s.mainAllocator.Allocate(blockSize, s.nodeAlignment)
+	if err != nil {
+		return nil, nilAllocatorOffset, err
+	}
+	node := s.getNode(nodeOffset)
 	node.height = height
-	node.keyOffset = keyOffset
-	// TODO key length should not exceed uint16 size, assert.
-	node.keySize = uint16(len(key))
-	node.encodeValue(valOffset, uint32(len(val)))
-	return node, nodeOffset
+	node.flags = flags
+	node.keySize = writeKey(blockBytes(unsafe.Pointer(node), size, keyStorageSize(key)), key)
+	node.keyPrefix = keyPrefix(key)
+	if flags&nodeFlagInlineValue != 0 {
+		s.storeInlineValue(node, 0, val)
+	} else {
+		node.storeValue(encodedValue)
+	}
+	return node, nodeOffset, nil
+}
+
+// nodeSize returns the number of bytes used by a node with given height, excluding its key.
+func (s *SkipList) nodeSize(height uint8) uint64 {
+	if s.wide {
+		return uint64(wideLayersOffset) + uint64(height)*uint64(wideLayerSize)
+	}
+	return uint64(unsafe.Offsetof(node{}.layers)) + uint64(height)*uint64(LayerSize)
+}
+
+// inlineValueAreaOffset returns the offset of the inline value area
+// following the key which ends at given offset, relative to the node.
+func inlineValueAreaOffset(keyEnd uint64) uint64 {
+	return (keyEnd + 7) &^ 7
+}
+
+// Max size of a block accessed with blockBytes, which must fit into address space.
+const maxBlockSize = 1 << (30 + 17*(^uintptr(0)>>63))
+
+// blockBytes returns size bytes at given offset from ptr. Arenas only
+// guarantee that a single block is contiguous, so they must belong to
+// the same block as ptr.
+func blockBytes(ptr unsafe.Pointer, offset uint64, size uint64) []byte {
+	return (*[maxBlockSize]byte)(unsafe.Pointer(uintptr(ptr) + uintptr(offset)))[:size:size]
+}
+
+// keyStorageSize returns the number of bytes required to store given key.
+func keyStorageSize(key []byte) uint64 {
+	if len(key) < int(largeKeySize) {
+		return uint64(len(key))
+	}
+	return largeKeyHeaderSize + uint64(len(key))
+}
+
+// writeKey copies given key into given storage, which must have
+// keyStorageSize bytes, and returns keySize for the node.
+// Large keys are prefixed with their actual size.
+func writeKey(storage []byte, key []byte) uint16 {
+	if len(key) < int(largeKeySize) {
+		copy(storage, key)
+		return uint16(len(key))
+	}
+	binary.LittleEndian.PutUint32(storage, uint32(len(key)))
+	copy(storage[largeKeyHeaderSize:], key)
+	return largeKeySize
+}
+
+// checkKeySize returns ErrKeyTooLarge if a key of given size can never fit
+// into arena. Sizes of large keys are stored in 32 bits, see writeKey.
+func checkKeySize(arena Arena, size uint64) error {
+	if size > math.MaxUint32 || size+largeKeyHeaderSize > arena.Capacity() {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// wideLayer returns a pointer to the layer of given level in wide mode.
+func (n *node) wideLayer(level uint8) *uint64 {
+	return (*uint64)(unsafe.Pointer(uintptr(unsafe.Pointer(n)) + wideLayersOffset + uintptr(level)*uintptr(wideLayerSize)))
 }
 
 // Returns the offset of next node on given level (height).
-func (n *node) getNextNodeOffset(level uint8) uint32 {
+func (n *node) getNextNodeOffset(level uint8) uint64 {
 	// Layers can be altered concurrently. Use atomic load.
-	return atomic.LoadUint32(&n.layers[level])
+	if n.flags&nodeFlagWide != 0 {
+		return atomic.LoadUint64(n.wideLayer(level))
+	}
+	return uint64(atomic.LoadUint32(&n.layers[level]))
+}
+
+// setNextNodeOffset sets the offset of next node on a level.
+// Must only be used before the node is visible to other goroutines.
+func (n *node) setNextNodeOffset(level uint8, offset uint64) {
+	if n.flags&nodeFlagWide != 0 {
+		*n.wideLayer(level) = offset
+		return
+	}
+	n.layers[level] = uint32(offset)
 }
 
 // casNextNodeOffset sets the offset of next node on a level, using cas operation.
-func (n *node) casNextNodeOffset(level uint8, old uint32, new uint32) bool {
-	return atomic.CompareAndSwapUint32(&n.layers[level], old, new)
+func (n *node) casNextNodeOffset(level uint8, old uint64, new uint64) bool {
+	if n.flags&nodeFlagWide != 0 {
+		return atomic.CompareAndSwapUint64(n.wideLayer(level), old, new)
+	}
+	return atomic.CompareAndSwapUint32(&n.layers[level], uint32(old), uint32(new))
 }
 
-// Set value offset and size.
-func (n *node) encodeValue(offset uint32, size uint32) {
-	encodedValue := uint64(size)
-	encodedValue += uint64(offset) << 32
+// Returns encoded value of the node.
+func (n *node) loadValue() uint64 {
+	return atomic.LoadUint64(&n.encodedValue)
+}
+
+// Sets encoded value of the node.
+func (n *node) storeValue(encodedValue uint64) {
 	atomic.StoreUint64(&n.encodedValue, encodedValue)
 }
 
-// Returns (offset, size) of value.
+// Set value offset and size in compact mode.
+func (n *node) encodeValue(offset uint32, size uint32) {
+	n.storeValue(encodeValue(offset, size))
+}
+
+// Returns (offset, size) of value in compact mode.
 func (n *node) decodeValue() (uint32, uint32) {
-	val := atomic.LoadUint64(&n.encodedValue)
-	return uint32(val >> 32), uint32(val)
+	return decodeValue(n.loadValue())
 }
 
-// Returns a pointer to node with given offset.
+// encodeValue encodes value offset and size in compact mode.
+func encodeValue(offset uint32, size uint32) uint64 {
+	return uint64(size) + uint64(offset)<<32
+}
+
+// decodeValue returns (offset, size) of an encoded value in compact mode.
+func decodeValue(encodedValue uint64) (uint32, uint32) {
+	return uint32(encodedValue >> 32), uint32(encodedValue)
+}
+
+// encodeInlineValue encodes an inline value with given version and size.
+// The low 32 bits are [version:24][size:8], the slot of the value is the
+// lowest bit of its version. In compact mode the high 32 bits, which keep
+// the offset of other values, are zero since it is nilAllocatorOffset.
+func (s *SkipList) encodeInlineValue(version uint32, size int) uint64 {
+	encodedValue := uint64(version&(1<<24-1))<<8 | uint64(size)
+	if s.wide {
+		encodedValue |= wideInlineValueFlag
+	}
+	return encodedValue
+}
+
+// isInlineValue returns whether given encoded value is an inline value.
+func (s *SkipList) isInlineValue(encodedValue uint64) bool {
+	if s.wide {
+		return encodedValue&wideInlineValueFlag != 0
+	}
+	return encodedValue>>32 == nilAllocatorOffset
+}
+
+// decodeInlineValue returns (slot, size) of an encoded inline value.
+func decodeInlineValue(encodedValue uint64) (uint32, uint64) {
+	return uint32(encodedValue>>8) % inlineValueSlotCount, uint64(uint8(encodedValue))
+}
+
+// inlineValueSlot returns the words of given inline value slot of the node.
+// Slots are accessed word by word with atomics, since readers might read
+// a slot while it is being written, see getNodeValue.
+func (s *SkipList) inlineValueSlot(node *node, slot uint32) *[maxInlineValueSize / 8]uint64 {
+	offset := s.getInlineValueAreaOffset(node) + uint64(slot)*maxInlineValueSize
+	return (*[maxInlineValueSize / 8]uint64)(unsafe.Pointer(uintptr(unsafe.Pointer(node)) + uintptr(offset)))
+}
+
+// inlineValueLock returns the writer lock of the node, which is
+// version<<1 | locked, version being the version of last inline value.
+func (s *SkipList) inlineValueLock(node *node) *uint32 {
+	offset := s.getInlineValueAreaOffset(node) + inlineValueSlotCount*maxInlineValueSize
+	return (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(node)) + uintptr(offset)))
+}
+
+// lockInlineValue acquires the writer lock of a node with inline value area
+// and returns the version of its last inline value.
+func (s *SkipList) lockInlineValue(node *node) uint32 {
+	lock := s.inlineValueLock(node)
+	for {
+		state := atomic.LoadUint32(lock)
+		if state&1 == 0 && atomic.CompareAndSwapUint32(lock, state, state|1) {
+			return state >> 1
+		}
+		runtime.Gosched()
+	}
+}
+
+// unlockInlineValue releases the writer lock of the node, recording given
+// version as the version of its last inline value.
+func (s *SkipList) unlockInlineValue(node *node, version uint32) {
+	atomic.StoreUint32(s.inlineValueLock(node), version<<1)
+}
+
+// storeInlineValue copies given value into the slot of given version and
+// makes it the value of the node.
+// Writer lock must be held, unless the node is not visible to other goroutines.
+func (s *SkipList) storeInlineValue(node *node, version uint32, val []byte) {
+	var buf [maxInlineValueSize]byte
+	copy(buf[:], val)
+	words := s.inlineValueSlot(node, version%inlineValueSlotCount)
+	for i := range words {
+		atomic.StoreUint64(&words[i], binary.LittleEndian.Uint64(buf[i*8:]))
+	}
+	node.storeValue(s.encodeInlineValue(version, len(val)))
+}
+
+// loadInlineValue returns a copy of the inline value with given encoded value.
+// Copy might be torn if the slot is reused in the meantime, which is the case
+// when the encoded value of the node is changed.
+func (s *SkipList) loadInlineValue(node *node, encodedValue uint64) []byte {
+	slot, size := decodeInlineValue(encodedValue)
+	var buf [maxInlineValueSize]byte
+	words := s.inlineValueSlot(node, slot)
+	for i := range words {
+		binary.LittleEndian.PutUint64(buf[i*8:], atomic.LoadUint64(&words[i]))
+	}
+	val := make([]byte, size)
+	copy(val, buf[:])
+	return val
+}
+
+// putNodeValue stores given value of a node and returns the encoded value.
+// Large values are compressed or appended to value log, see encodeNodeValue.
+func (s *SkipList) putNodeValue(allc Arena, val []byte) (uint64, error) {
+	data, flags, err := s.encodeNodeValue(val)
+	if err != nil {
+		return 0, err
+	}
+	return s.putStoredValue(allc, data, flags)
+}
+
+// putValuePointer copies given value pointer into allocator and returns
+// the encoded value, flagged with given flags as well.
+func (s *SkipList) putValuePointer(allc Arena, p valuePointer, flags uint32) (uint64, error) {
+	var buf [valuePointerSize]byte
+	p.encode(buf[:])
+	return s.putStoredValue(allc, buf[:], flags|valuePointerFlag)
+}
+
+// putValue copies given value into allocator and returns the encoded value.
+func (s *SkipList) putValue(allc Arena, val []byte) (uint64, error) {
+	return s.putStoredValue(allc, val, 0)
+}
+
+// checkValueSize returns ErrValueTooLarge if a value of given size can not be
+// stored in value arena. Sizes are stored in 32 bits, whose top bits are the
+// flags of the value in lists with flagged values.
+func (s *SkipList) checkValueSize(size uint64) error {
+	if size > math.MaxUint32 || s.hasValueFlags() && size >= uint64(valueCompressedFlag) {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// putStoredValue copies given bytes into allocator and returns the encoded
+// value, whose size is combined with given flags.
+func (s *SkipList) putStoredValue(allc Arena, val []byte, flags uint32) (uint64, error) {
+	if err := s.checkValueSize(uint64(len(val))); err != nil {
+		return 0, err
+	}
+	if !s.wide {
+		size := uint64(len(val))
+		// Empty values take a byte if changes are tracked, so that every
+		// value is below the watermarks taken after it, see takeWatermark.
+		if size == 0 && s.trackChanges {
+			size = 1
+		}
+		offset, err := allc.Allocate(size, 1)
+		if err != nil {
+			return 0, err
+		}
+		copy(allc.BytesAt(offset, uint64(len(val))), val)
+		return encodeValue(uint32(offset), uint32(len(val))|flags), nil
+	}
+	offset, err := allc.Allocate(wideValueHeaderSize+uint64(len(val)), wideValueHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	record := allc.BytesAt(offset, wideValueHeaderSize+uint64(len(val)))
+	binary.LittleEndian.PutUint32(record, uint32(len(val))|flags)
+	copy(record[wideValueHeaderSize:], val)
+	return offset, nil
+}
+
+// getStoredValueSize returns the size of the bytes stored in allocator for
+// given encoded value, including its flags.
+func (s *SkipList) getStoredValueSize(allc Arena, encodedValue uint64) uint32 {
+	if !s.wide {
+		_, size := decodeValue(encodedValue)
+		return size
+	}
+	return binary.LittleEndian.Uint32(allc.BytesAt(encodedValue, wideValueHeaderSize))
+}
+
+// getValueBounds returns (offset, size) of the bytes stored in allocator for
+// given encoded value. They are a value pointer for values in value log.
+func (s *SkipList) getValueBounds(allc Arena, encodedValue uint64) (uint64, uint64) {
+	size := s.getStoredValueSize(allc, encodedValue)
+	if s.hasValueFlags() {
+		size &^= valueFlagMask
+	}
+	if !s.wide {
+		offset, _ := decodeValue(encodedValue)
+		return uint64(offset), uint64(size)
+	}
+	return encodedValue + wideValueHeaderSize, uint64(size)
+}
+
+// getValueFlags returns the flags of the bytes stored in allocator for given
+// encoded value, see WithValueLog and WithValueCodec.
+func (s *SkipList) getValueFlags(allc Arena, encodedValue uint64) uint32 {
+	if !s.hasValueFlags() {
+		return 0
+	}
+	return s.getStoredValueSize(allc, encodedValue) & valueFlagMask
+}
+
+// isValuePointer returns whether a value pointer is stored in allocator for
+// given encoded value, see WithValueLog.
+func (s *SkipList) isValuePointer(allc Arena, encodedValue uint64) bool {
+	return s.getValueFlags(allc, encodedValue)&valuePointerFlag != 0
+}
+
+// valueStorageSize returns the number of bytes used in value allocator
+// by a value with given size.
+func (s *SkipList) valueStorageSize(size uint64) uint64 {
+	if s.wide {
+		return wideValueHeaderSize + size
+	}
+	return size
+}
+
+// Returns the key of given node.
 func (s *SkipList) getNodeKey(node *node) []byte {
-	return s.mainAllocator.getBytes(node.keyOffset, uint32(node.keySize))
+	offset, size := s.getNodeKeyBounds(node)
+	return blockBytes(unsafe.Pointer(node), offset, size)
 }
 
-// Returns a pointer to node with given offset.
+// Returns (offset, size) of the key bytes of given node, relative to the node.
+func (s *SkipList) getNodeKeyBounds(node *node) (uint64, uint64) {
+	keyOffset := s.nodeSize(node.height)
+	if node.keySize != largeKeySize {
+		return keyOffset, uint64(node.keySize)
+	}
+	header := blockBytes(unsafe.Pointer(node), keyOffset, largeKeyHeaderSize)
+	return keyOffset + largeKeyHeaderSize, uint64(binary.LittleEndian.Uint32(header))
+}
+
+// compareNodeKey compares the key of given node with given key, whose prefix
+// is also given. The result is the same as compareKeys(nodeKey, key).
+func (s *SkipList) compareNodeKey(node *node, key []byte, prefix uint64) int {
+	if node.keyPrefix < prefix {
+		return -1
+	}
+	if node.keyPrefix > prefix {
+		return 1
+	}
+	return compareKeys(s.getNodeKey(node), key)
+}
+
+// Returns the offset of the inline value area of given node, relative to the node.
+// Node must have an inline value area.
+func (s *SkipList) getInlineValueAreaOffset(node *node) uint64 {
+	keyOffset, keySize := s.getNodeKeyBounds(node)
+	return inlineValueAreaOffset(keyOffset + keySize)
+}
+
+// Returns the value of given node. If it can not be read from value log or
+// decoded, nil is returned and the error is kept for ValueErr.
 func (s *SkipList) getNodeValue(node *node) []byte {
-	offset, size := node.decodeValue()
-	return s.valueAllocator.getBytes(offset, size)
+	val, err := s.readNodeValue(node)
+	if err != nil {
+		s.setValueErr(err)
+	}
+	return val
+}
+
+// Returns the value of given node, or the error of reading it from value log
+// or decoding it.
+func (s *SkipList) readNodeValue(node *node) ([]byte, error) {
+	for {
+		seq := atomic.LoadUint32(&s.compactSeq)
+		// Compact is rewriting node values, wait for it to finish.
+		if seq&1 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		allc := s.getValueAllocator()
+		encodedValue := node.loadValue()
+		if s.isInlineValue(encodedValue) {
+			val := s.loadInlineValue(node, encodedValue)
+			// Writers never fill the slot of current value, so the copy is
+			// consistent unless value is changed in the meantime.
+			if node.loadValue() == encodedValue {
+				return val, nil
+			}
+			continue
+		}
+		// If allocators are swapped in the meantime, offset might belong to the other one.
+		// Check it before the size is read from the allocator in wide mode.
+		if atomic.LoadUint32(&s.compactSeq) != seq {
+			continue
+		}
+		offset, size := s.getValueBounds(allc, encodedValue)
+		flags := s.getValueFlags(allc, encodedValue)
+		if flags == 0 {
+			return allc.BytesAt(offset, size), nil
+		}
+		val, err := s.decodeNodeValue(allc.BytesAt(offset, size), flags)
+		if err == nil {
+			return val, nil
+		}
+		// The file might be deleted by CollectValueLog after the value
+		// is moved.
+		if node.loadValue() != encodedValue {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// getValueAllocator returns the current value allocator.
+func (s *SkipList) getValueAllocator() Arena {
+	// Value allocator can be replaced concurrently by Compact.
+	return *(*Arena)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&s.valueAllocator))))
+}
+
+// setValueAllocator replaces the current value allocator.
+func (s *SkipList) setValueAllocator(allc Arena) {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&s.valueAllocator)), unsafe.Pointer(&allc))
 }
 
 // Returns a pointer to node with given offset.
 // Returns nil if given offset is nilAllocatorOffset.
-func (s *SkipList) getNode(offset uint32) *node {
-	return s.mainAllocator.getNode(offset)
+func (s *SkipList) getNode(offset uint64) *node {
+	if offset == nilAllocatorOffset {
+		return nil
+	}
+	return (*node)(s.mainAllocator.NodeAt(offset))
 }
 
 // Set the value of given node.
-func (s *SkipList) setNodeValue(node *node, val []byte) {
-	newValSize := uint32(len(val))
-	valOffset, valSize := node.decodeValue()
+func (s *SkipList) setNodeValue(node *node, val []byte) error {
+	if export := s.getExport(); export != nil {
+		export.saveValue(s, node)
+	}
+	if node.flags&nodeFlagInlineValue == 0 {
+		return s.setAllocatedValue(node, val)
+	}
+	// Writers of a node with inline value area are serialized, so that two
+	// writers never fill the same slot. Readers do not wait for them.
+	version := s.lockInlineValue(node)
+	if len(val) > maxInlineValueSize {
+		err := s.setAllocatedValue(node, val)
+		s.unlockInlineValue(node, version)
+		return err
+	}
+	allc := s.getValueAllocator()
+	oldValue := node.loadValue()
+	version++
+	s.storeInlineValue(node, version, val)
+	if !s.isInlineValue(oldValue) {
+		// Previous value in value allocator will never be used again.
+		valOffset, valSize := s.getValueBounds(allc, oldValue)
+		s.stats.addWastedValueBytes(valOffset, s.valueStorageSize(valSize))
+	}
+	s.unlockInlineValue(node, version)
+	return nil
+}
+
+// setAllocatedValue sets the value of given node in value allocator.
+func (s *SkipList) setAllocatedValue(node *node, val []byte) error {
+	allc := s.getValueAllocator()
+	encodedValue := node.loadValue()
+	if s.isInlineValue(encodedValue) {
+		newValue, err := s.putNodeValue(allc, val)
+		if err != nil {
+			return err
+		}
+		node.storeValue(newValue)
+		return nil
+	}
+	data, flags, err := s.encodeNodeValue(val)
+	if err != nil {
+		return err
+	}
+	newValSize := uint64(len(data))
+	valOffset, valSize := s.getValueBounds(allc, encodedValue)
 	// If node currently has a value and the size of the value is bigger than new value,
 	// use previous value's memory for new value.
-	if valSize >= newValSize {
-		s.valueAllocator.putBytesTo(valOffset, val)
-		node.encodeValue(valOffset, newValSize)
-		return
+	// Values are immutable in wide mode, since size is not a part of encoded value.
+	// Values are immutable if changes are tracked, see ChangesSince.
+	// Flagged values are immutable, so readers never decode torn bytes.
+	if !s.wide && !s.trackChanges && valSize >= newValSize &&
+		flags == 0 && s.getValueFlags(allc, encodedValue) == 0 {
+		copy(allc.BytesAt(valOffset, newValSize), data)
+		node.encodeValue(uint32(valOffset), uint32(newValSize))
+		// Remaining part of the old value will never be used again.
+		s.stats.addWastedValueBytes(valOffset, valSize-newValSize)
+		return nil
 	}
 	// If the length of new node is greater than odl node, forget old value
 	// and allocate new space in memory for new value.
-	newOffset := s.valueAllocator.putBytes(val)
-	node.encodeValue(newOffset, newValSize)
+	newValue, err := s.putStoredValue(allc, data, flags)
+	if err != nil {
+		return err
+	}
+	node.storeValue(newValue)
+	s.stats.addWastedValueBytes(valOffset, s.valueStorageSize(valSize))
+	return nil
 }
 
 // getNeighbourNodes returns nodes (x, y, z) where
@@ -147,8 +739,9 @@ func (s *SkipList) setNodeValue(node *node, val []byte) {
 // z is true whenever x.key = key
 // startingNode is used as starting point for search (hint from previous calls.)
 // Key of the startingNode always must be less then given key.
-func (s *SkipList) getNeighbourNodes(startingNode *node, level uint8, key []byte) (*node, uint32, bool) {
+func (s *SkipList) getNeighbourNodes(startingNode *node, level uint8, key []byte) (*node, uint64, bool) {
 	currentNode := startingNode
+	prefix := keyPrefix(key)
 	for {
 
 		nextNodeOffset := currentNode.getNextNodeOffset(level)
@@ -157,8 +750,7 @@ func (s *SkipList) getNeighbourNodes(startingNode *node, level uint8, key []byte
 			return currentNode, nextNodeOffset, false
 		}
 
-		nextNodeKey := s.getNodeKey(nextNode)
-		cmp := compareKeys(nextNodeKey, key)
+		cmp := s.compareNodeKey(nextNode, key, prefix)
 
 		if cmp == 0 {
 			return nextNode, nextNodeOffset, true
@@ -176,8 +768,14 @@ func (s *SkipList) getNeighbourNodes(startingNode *node, level uint8, key []byte
 // along with a boolean value which designates whether returned nodes key
 // is equal to given key.
 func (s *SkipList) getClosestNode(key []byte) (*node, bool) {
-	currentNode := s.head        // points to current node in loop.
-	level := uint8(s.height - 1) // current level
+	listHeight := s.getHeight()
+	// There are no levels to search in an empty list.
+	if listHeight == 0 {
+		return s.head, false
+	}
+	currentNode := s.head          // points to current node in loop.
+	level := uint8(listHeight - 1) // current level
+	prefix := keyPrefix(key)
 	for {
 		nextNodeOffset := currentNode.getNextNodeOffset(level)
 		nextNode := s.getNode(nextNodeOffset)
@@ -192,8 +790,7 @@ func (s *SkipList) getClosestNode(key []byte) (*node, bool) {
 			return currentNode, false
 		}
 
-		nextNodeKey := s.getNodeKey(nextNode)
-		cmp := compareKeys(nextNodeKey, key)
+		cmp := s.compareNodeKey(nextNode, key, prefix)
 
 		// If the node is found, return it.
 		if cmp == 0 {
@@ -222,6 +819,14 @@ func (s *SkipList) getClosestNode(key []byte) (*node, bool) {
 // Get returns value for given key if it exists,
 // returns nil otherwise.
 func (s *SkipList) Get(key []byte) []byte {
+	if s.bloom != nil && !s.bloom.mayContain(key) {
+		return nil
+	}
+	if s.index != nil {
+		if node := s.getIndexedNode(key); node != nil {
+			return s.getNodeValue(node)
+		}
+	}
 	node, found := s.getClosestNode(key)
 	if !found {
 		return nil
@@ -230,11 +835,52 @@ func (s *SkipList) Get(key []byte) []byte {
 }
 
 // Set inserts given key-value pair into list.
-func (s *SkipList) Set(key []byte, val []byte) {
+// ErrKeyTooLarge is returned if the key can not fit into the list.
+// If the key or value can not be allocated, the error returned by the arena,
+// such as ErrArenaFull, is returned.
+// If the list has a write-ahead log, the update is appended to it before it
+// becomes visible, and errors of the log are returned. If the update fails
+// after it is logged, it is cancelled in the log, so Recover does not replay it.
+func (s *SkipList) Set(key []byte, val []byte) error {
+	if err := checkKeySize(s.mainAllocator, uint64(len(key))); err != nil {
+		return err
+	}
+	if s.wal == nil {
+		return s.set(key, val)
+	}
+	lock := s.wal.lockKey(key)
+	defer lock.Unlock()
+	offset, err := s.wal.appendSet(key, val)
+	if err != nil {
+		return err
+	}
+	if err := s.set(key, val); err != nil {
+		// The error of the log, if any, is returned by the following updates.
+		s.wal.appendCancel(offset, 0)
+		return err
+	}
+	return nil
+}
+
+// set inserts given key-value pair into list without logging it.
+func (s *SkipList) set(key []byte, val []byte) error {
+	if err := checkKeySize(s.mainAllocator, uint64(len(key))); err != nil {
+		return err
+	}
+
+	// Multiple writers can run concurrently, only Compact excludes them.
+	s.compactMu.RLock()
+	defer s.compactMu.RUnlock()
+
+	// Key must be in Bloom filter before its node is visible.
+	if s.bloom != nil {
+		s.bloom.add(key)
+	}
+
 	listHeight := s.getHeight()
 
 	var prevNodes [DefaultMaxHeight + 1]*node
-	var nextNodesOffsets [DefaultMaxHeight + 1]uint32
+	var nextNodesOffsets [DefaultMaxHeight + 1]uint64
 	var sameKey bool
 
 	prevNodes[listHeight] = s.head
@@ -246,14 +892,20 @@ func (s *SkipList) Set(key []byte, val []byte) {
 		// if there is already a node with the same key, there is no need to
 		// create a new node, just use it.
 		if sameKey {
-			s.setNodeValue(prevNodes[i], val)
-			return
+			return s.setNodeValue(prevNodes[i], val)
 		}
 	}
 
 	// Create a new node.
 	nodeHeight := s.randomHeight()
-	node, nodeOffset := newNode(s.mainAllocator, s.valueAllocator, nodeHeight, key, val)
+	node, nodeOffset, err := s.newNode(nodeHeight, key, val)
+	if err != nil {
+		return err
+	}
+	// Node must be known to the export in progress before it is visible.
+	if export := s.getExport(); export != nil {
+		export.addNode(nodeOffset, key)
+	}
 
 	// If the height of new node is more then current height of the list,
 	// try to increase list height using CAS, since it can be changed.
@@ -261,6 +913,7 @@ func (s *SkipList) Set(key []byte, val []byte) {
 		if s.casHeight(listHeight, uint32(nodeHeight)) {
 			break
 		}
+		s.stats.addHeightCASFailure(nodeOffset)
 		listHeight = s.getHeight()
 	}
 
@@ -276,19 +929,127 @@ func (s *SkipList) Set(key []byte, val []byte) {
 				prevNodes[i], nextNodesOffsets[i], _ = s.getNeighbourNodes(s.head, i, key)
 			}
 
-			node.layers[i] = nextNodesOffsets[i]
+			node.setNextNodeOffset(i, nextNodesOffsets[i])
 			if prevNodes[i].casNextNodeOffset(i, nextNodesOffsets[i], nodeOffset) {
+				// Node becomes visible once it is linked on base level.
+				if i == 0 {
+					s.stats.addNode(nodeOffset, nodeHeight)
+					if s.index != nil {
+						s.index.add(indexHash(key), nodeOffset)
+					}
+				}
 				break
 			}
+			s.stats.addLinkCASFailure(nodeOffset)
 			// If cas fails, we need to rediscover this level
 			prevNodes[i], nextNodesOffsets[i], sameKey = s.getNeighbourNodes(prevNodes[i], i, key)
 			if sameKey {
-				s.setNodeValue(prevNodes[i], val)
-				return
+				return s.setNodeValue(prevNodes[i], val)
 			}
 		}
 	}
+	return nil
+}
+
+// WastedValueBytes returns the number of bytes in value allocator which
+// are abandoned by value updates and can be reclaimed by Compact.
+func (s *SkipList) WastedValueBytes() uint64 {
+	return s.stats.getWastedValueBytes()
+}
 
+// Compact copies every live value into a fresh value allocator and drops the
+// old one, reclaiming the space wasted by value updates.
+// Writers are blocked during compaction, readers are not.
+// If the values do not fit into the new allocator, an error is returned and
+// the list is left unchanged.
+// The new allocator is allocated on heap, so lists whose value arena is
+// returned by NewMmapAllocator or is not an Allocator return ErrCompactArena,
+// and must be compacted by CompactInto instead, which leaves releasing the
+// replaced arena to the caller.
+func (s *SkipList) Compact() error {
+	if allc, ok := s.getValueAllocator().(*Allocator); !ok || allc.mapped {
+		return ErrCompactArena
+	}
+	allc := newAllocator(s.getValueAllocator().Capacity())
+	_, err := s.compactInto(allc, s.valueChunkSize())
+	return err
+}
+
+// CompactInto is like Compact, but copies live values into given arena,
+// which must be empty, and returns the replaced value arena. Values returned
+// by Get before compaction still refer to the replaced arena, so it must
+// not be released while they are in use.
+func (s *SkipList) CompactInto(arena Arena) (Arena, error) {
+	return s.compactInto(arena, 0)
+}
+
+// compactInto copies live values into given arena and replaces the value
+// arena with it. If chunkSize is not 0, chunks are enabled for the new
+// allocator once values are copied, chunks would only leave gaps between
+// values copied by a single goroutine.
+func (s *SkipList) compactInto(arena Arena, chunkSize uint64) (Arena, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	oldAllocator := s.getValueAllocator()
+
+	// Copy live values first. Readers keep using the old allocator meanwhile,
+	// so new values are kept aside until the swap.
+	// Inline values do not use value allocator, they are left as they are.
+	var nodes []*node
+	var values []uint64
+	for n := s.head; n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		encodedValue := n.loadValue()
+		if s.isInlineValue(encodedValue) {
+			continue
+		}
+		// Values in value log stay there, only their pointers are copied.
+		flags := s.getValueFlags(oldAllocator, encodedValue)
+		offset, size := s.getValueBounds(oldAllocator, encodedValue)
+		value, err := s.putStoredValue(arena, oldAllocator.BytesAt(offset, size), flags)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+		values = append(values, value)
+	}
+
+	if allc, ok := arena.(*Allocator); ok {
+		allc.enableChunks(chunkSize)
+	}
+
+	// Readers wait while node values and the allocator do not match.
+	atomic.AddUint32(&s.compactSeq, 1)
+	s.setValueAllocator(arena)
+	for i, n := range nodes {
+		n.storeValue(values[i])
+	}
+	s.stats.resetWastedValueBytes()
+	atomic.AddUint32(&s.compactSeq, 1)
+	return oldAllocator, nil
+}
+
+// ReleaseChunks drops the unused parts of the allocation chunks of writers,
+// see WithAllocationChunks. Parts at the end of allocated memory are given
+// back, others are abandoned and reported as TailWaste.
+// Call it once writes are finished, e.g. before taking a snapshot, so that
+// no memory is kept reserved for writers.
+func (s *SkipList) ReleaseChunks() {
+	for _, arena := range []Arena{s.mainAllocator, s.getValueAllocator()} {
+		if allc, ok := arena.(*Allocator); ok {
+			allc.releaseChunks()
+		}
+	}
+}
+
+// valueChunkSize returns the size of allocation chunks of value allocators.
+// Values of lists tracking changes are not allocated in chunks, their offsets
+// must follow the order they are set, see ChangesSince.
+func (s *SkipList) valueChunkSize() uint64 {
+	if s.trackChanges {
+		return 0
+	}
+	return s.allocationChunkSize
 }
 
 // casHeight performs cas operation on list height.
@@ -313,15 +1074,62 @@ func (s *SkipList) randomHeight() uint8 {
 }
 
 // NewSkipList initializes and returns a skip list instance.
-func NewSkipList(allocatorSize uint32) *SkipList {
-	mainAllocator := newAllocator(allocatorSize)
-	valueAllocator := newAllocator(allocatorSize)
+// Offsets are 32 bits, so each allocator is limited to 4GB.
+// allocatorSize is the size of the allocators created by the list, it is
+// ignored for the arenas passed with WithArenas. It panics if the head node
+// does not fit into main arena.
+func NewSkipList(allocatorSize uint32, opts ...Option) *SkipList {
+	return newSkipList(uint64(allocatorSize), false, opts)
+}
+
+// NewWideSkipList initializes and returns a skip list instance which uses
+// 64-bit offsets, so allocators can be larger than 4GB.
+// Each node and value costs more memory than the lists created by NewSkipList.
+func NewWideSkipList(allocatorSize uint64, opts ...Option) *SkipList {
+	return newSkipList(allocatorSize, true, opts)
+}
+
+// newSkipList initializes and returns a skip list instance.
+func newSkipList(allocatorSize uint64, wide bool, opts []Option) *SkipList {
+	o := newOptions(opts)
+	s := &SkipList{
+		mainAllocator:       o.mainArena,
+		height:              0,
+		wide:                wide,
+		nodeAlignment:       nodeAlignment,
+		allocationChunkSize: o.allocationChunkSize,
+		stats:               &listStats{},
+		wal:                 o.wal,
+		trackChanges:        o.trackChanges,
+		vlog:                o.vlog,
+		valueLogThreshold:   o.valueLogThreshold,
+		codec:               o.codec,
+		codecThreshold:      o.codecThreshold,
+	}
+	if o.bloomBitsPerKey != 0 {
+		s.bloom = newBloomFilter(o.bloomKeyCount, o.bloomBitsPerKey)
+	}
+	if o.hashIndexKeyCount != 0 {
+		s.index = newHashIndex(o.hashIndexKeyCount)
+	}
+	if s.mainAllocator == nil {
+		s.mainAllocator = newChunkedAllocator(allocatorSize, o.allocationChunkSize)
+	}
+	valueAllocator := o.valueArena
+	if valueAllocator == nil {
+		valueAllocator = newChunkedAllocator(allocatorSize, s.valueChunkSize())
+	}
+	s.setValueAllocator(valueAllocator)
+	if !wide && (s.mainAllocator.Capacity() > maxCompactAllocatorSize || valueAllocator.Capacity() > maxCompactAllocatorSize) {
+		panic("goskip: arenas larger than 4GB require NewWideSkipList")
+	}
+	if o.cacheLineAlignment {
+		s.nodeAlignment = cacheLineSize
+	}
 	var emptyValue []byte
-	head, _ := newNode(mainAllocator, valueAllocator, DefaultMaxHeight, emptyValue, emptyValue)
-	return &SkipList{
-		mainAllocator:  mainAllocator,
-		valueAllocator: valueAllocator,
-		height:         0,
-		head:           head,
+	var err error
+	if s.head, _, err = s.newNode(DefaultMaxHeight, emptyValue, emptyValue); err != nil {
+		panic("goskip: can not allocate head node: " + err.Error())
 	}
+	return s
 }
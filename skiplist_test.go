@@ -1,10 +1,14 @@
 package goskip
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
 	"sync/atomic"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -61,7 +65,7 @@ var sampleNodesData = []struct {
 }
 
 var sampleNodesNeighbors = []struct {
-	key []byte
+	key          []byte
 	leftNeighbor []byte
 }{
 	{[]byte("key45"), []byte("key44")},
@@ -71,67 +75,50 @@ var sampleNodesNeighbors = []struct {
 	{[]byte("key12"), []byte("key102")},
 }
 
-// Return value of given node encodedValue in bytes.
-func getNodeValue(allc *Allocator, encodedValue uint64) []byte {
-	val := atomic.LoadUint64(&encodedValue)
-	return allc.getBytes(uint32(val>>32), uint32(val))
-}
-
-// Return key of a node in bytes, using offset and size.
-func getNodeKey(allc *Allocator, offset uint32, size uint16) []byte {
-	return allc.getBytes(offset, uint32(size))
-}
-
-// createAllocators creates two allocator and returns them.
-func createAllocators(mainSize uint32, valSize uint32) (*Allocator, *Allocator) {
-	mainAllocator := newAllocator(mainSize)
-	valueAllocator := newAllocator(valSize)
-	return mainAllocator, valueAllocator
-}
-
 func TestNewNode(t *testing.T) {
-	keyAllc, valAllc := createAllocators(defaultAllocatorSize, defaultAllocatorSize)
+	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
-			node, _ := newNode(keyAllc, valAllc, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, data.height, node.height, "Height must be initialized correctly.")
-			assert.Equal(t, data.key, getNodeKey(keyAllc, node.keyOffset, node.keySize),
+			assert.Equal(t, data.key, s.getNodeKey(node),
 				"Key must be initialized correctly.")
-			assert.Equal(t, data.val, getNodeValue(valAllc, node.encodedValue),
+			assert.Equal(t, data.val, s.getNodeValue(node),
 				"Height must be initialized correctly.")
 		})
 	}
 }
 
 func TestNewNode_Parallel(t *testing.T) {
-	keyAllc, valAllc := createAllocators(defaultAllocatorSize, defaultAllocatorSize)
+	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			node, _ := newNode(keyAllc, valAllc, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, data.height, node.height, "Height must be initialized correctly.")
-			assert.Equal(t, data.key, getNodeKey(keyAllc, node.keyOffset, node.keySize),
+			assert.Equal(t, data.key, s.getNodeKey(node),
 				"Key must be initialized correctly.")
-			assert.Equal(t, data.val, getNodeValue(valAllc, node.encodedValue),
+			assert.Equal(t, data.val, s.getNodeValue(node),
 				"Height must be initialized correctly.")
 		})
 	}
 }
 
 func TestNode_GetNextNodeOffset(t *testing.T) {
-	keyAllc, valAllc := createAllocators(defaultAllocatorSize, defaultAllocatorSize)
-	node, _ := newNode(keyAllc, valAllc, uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
+	s := NewSkipList(defaultAllocatorSize)
+	node, _, _ := s.newNode(uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
 	node.layers[0] = 3
 	node.layers[1] = 65
 	node.layers[5] = 4441
-	assert.Equal(t, uint32(3), node.getNextNodeOffset(0))
-	assert.Equal(t, uint32(65), node.getNextNodeOffset(1))
-	assert.Equal(t, uint32(4441), node.getNextNodeOffset(5))
+	assert.Equal(t, uint64(3), node.getNextNodeOffset(0))
+	assert.Equal(t, uint64(65), node.getNextNodeOffset(1))
+	assert.Equal(t, uint64(4441), node.getNextNodeOffset(5))
 }
 
 func TestNode_EncodeValue(t *testing.T) {
-	keyAllc, valAllc := createAllocators(defaultAllocatorSize, defaultAllocatorSize)
-	node, _ := newNode(keyAllc, valAllc, uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
+	s := NewSkipList(defaultAllocatorSize)
+	node, _, _ := s.newNode(uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
 	offset := uint32(2 << 7)
 	size := uint32(2<<12) + 1
 	node.encodeValue(offset, size)
@@ -141,8 +128,8 @@ func TestNode_EncodeValue(t *testing.T) {
 }
 
 func TestNode_DecodeValue(t *testing.T) {
-	keyAllc, valAllc := createAllocators(defaultAllocatorSize, defaultAllocatorSize)
-	node, _ := newNode(keyAllc, valAllc, uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
+	s := NewSkipList(defaultAllocatorSize)
+	node, _, _ := s.newNode(uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
 	offset := uint32(2 << 7)
 	size := uint32(2<<12) + 1
 	node.encodeValue(offset, size)
@@ -163,7 +150,7 @@ func TestSkipList_GetNode(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
-			node, offset := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, offset, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, node, s.getNode(offset))
 		})
 	}
@@ -172,9 +159,10 @@ func TestSkipList_GetNode(t *testing.T) {
 func TestSkipList_GetNode_Parallel(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			node, offset := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, offset, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, node, s.getNode(offset))
 		})
 	}
@@ -184,7 +172,7 @@ func TestSkipList_GetNodeKey(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, data.key, s.getNodeKey(node))
 		})
 	}
@@ -193,9 +181,10 @@ func TestSkipList_GetNodeKey(t *testing.T) {
 func TestSkipList_GetNodeKey_Parallel(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, data.key, s.getNodeKey(node))
 		})
 	}
@@ -205,7 +194,7 @@ func TestSkipList_GetNodeValue(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, data.val, s.getNodeValue(node))
 		})
 	}
@@ -214,9 +203,10 @@ func TestSkipList_GetNodeValue(t *testing.T) {
 func TestSkipList_GetNodeValue_Parallel(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			assert.Equal(t, data.val, s.getNodeValue(node))
 		})
 	}
@@ -227,7 +217,7 @@ func TestSkipList_SetNodeValue(t *testing.T) {
 	// Run for the case that length of new value is less than length of old value.
 	for i, data := range uniqueNodesData {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			newVal := data.val[1:]
 			s.setNodeValue(node, newVal)
 			assert.Equal(t, newVal, s.getNodeValue(node))
@@ -236,7 +226,7 @@ func TestSkipList_SetNodeValue(t *testing.T) {
 	// Run for the case that length of new value is greater than length of old value.
 	for i, data := range uniqueNodesData {
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			newVal := append([]byte("new-"), data.val...)
 			s.setNodeValue(node, newVal)
 			assert.Equal(t, newVal, s.getNodeValue(node))
@@ -248,9 +238,10 @@ func TestSkipList_SetNodeValue_Parallel(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	// Run for the case that length of new value is less than length of old value.
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			newVal := data.val[1:]
 			s.setNodeValue(node, newVal)
 			assert.Equal(t, newVal, s.getNodeValue(node))
@@ -258,9 +249,10 @@ func TestSkipList_SetNodeValue_Parallel(t *testing.T) {
 	}
 	// Run for the case that length of new value is greater than length of old value.
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
-			node, _ := newNode(s.mainAllocator, s.valueAllocator, data.height, data.key, data.val)
+			node, _, _ := s.newNode(data.height, data.key, data.val)
 			newVal := append([]byte("new-"), data.val...)
 			s.setNodeValue(node, newVal)
 			assert.Equal(t, newVal, s.getNodeValue(node))
@@ -297,6 +289,7 @@ func TestSkipList_Set(t *testing.T) {
 func TestSkipList_Set_Parallel(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
 			s.Set(data.key, data.val)
@@ -318,6 +311,7 @@ func TestSkipList_SetGet(t *testing.T) {
 func TestSkipList_SetGet_Parallel(t *testing.T) {
 	s := NewSkipList(defaultAllocatorSize)
 	for i, data := range uniqueNodesData {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
 			s.Set(data.key, data.val)
@@ -346,6 +340,7 @@ func TestSkipList_GetNeighbourNodes_Parallel(t *testing.T) {
 		s.Set(data.key, data.val)
 	}
 	for i, data := range sampleNodesNeighbors {
+		data := data
 		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
 			t.Parallel()
 			node, _, _ := s.getNeighbourNodes(s.head, 0, data.key)
@@ -353,4 +348,497 @@ func TestSkipList_GetNeighbourNodes_Parallel(t *testing.T) {
 			assert.Equal(t, data.leftNeighbor, key)
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestSkipList_WastedValueBytes(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	// Values must not fit inline to be stored in value allocator.
+	s.Set([]byte("key"), bytes.Repeat([]byte("v"), maxInlineValueSize+4))
+	assert.Equal(t, uint64(0), s.WastedValueBytes(), "New keys must not waste space")
+	s.Set([]byte("key"), bytes.Repeat([]byte("v"), maxInlineValueSize+2))
+	assert.Equal(t, uint64(2), s.WastedValueBytes(), "Tail of the old value must be wasted")
+	s.Set([]byte("key"), bytes.Repeat([]byte("v"), maxInlineValueSize+10))
+	assert.Equal(t, uint64(maxInlineValueSize+4), s.WastedValueBytes(), "Old value must be wasted")
+}
+
+func TestSkipList_Compact(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for i := 0; i < 10; i++ {
+		for _, data := range uniqueNodesData {
+			// Values grow on every iteration, so old values are abandoned.
+			s.Set(data.key, append(bytes.Repeat([]byte("-"), i), data.val...))
+		}
+	}
+	usedBefore := s.getValueAllocator().Used()
+	assert.NotEqual(t, uint64(0), s.WastedValueBytes())
+
+	s.Compact()
+	assert.Equal(t, uint64(0), s.WastedValueBytes(), "Compact must reclaim wasted bytes")
+	assert.Less(t, s.getValueAllocator().Used(), usedBefore, "Compact must reduce used space")
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, append([]byte("---------"), data.val...), s.Get(data.key))
+	}
+
+	// List must still be writable after compaction.
+	s.Set(uniqueNodesData[0].key, []byte("after compaction"))
+	assert.Equal(t, []byte("after compaction"), s.Get(uniqueNodesData[0].key))
+}
+
+func TestSkipList_Compact_Parallel(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+		s.Set(data.key, append([]byte("new-"), data.val...))
+	}
+	t.Run("Compact", func(t *testing.T) {
+		t.Parallel()
+		for i := 0; i < 10; i++ {
+			s.Compact()
+		}
+	})
+	for i, data := range uniqueNodesData {
+		data := data
+		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
+			t.Parallel()
+			for j := 0; j < 10; j++ {
+				assert.Equal(t, append([]byte("new-"), data.val...), s.Get(data.key))
+			}
+		})
+	}
+}
+
+func TestSkipList_SetGet_LargeKey(t *testing.T) {
+	s := NewSkipList(1 << 20)
+	keys := [][]byte{
+		bytes.Repeat([]byte("k"), int(largeKeySize)-1),
+		bytes.Repeat([]byte("k"), int(largeKeySize)),
+		bytes.Repeat([]byte("k"), int(largeKeySize)+1),
+		append(bytes.Repeat([]byte("k"), 1<<17), 'a'),
+		[]byte("k"),
+	}
+	for i, key := range keys {
+		assert.NoError(t, s.Set(key, []byte(fmt.Sprintf("value%d", i))))
+	}
+	for i, key := range keys {
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), s.Get(key))
+	}
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_Set_KeyTooLarge(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	key := make([]byte, defaultAllocatorSize)
+	assert.Equal(t, ErrKeyTooLarge, s.Set(key, []byte("value")))
+	assert.Nil(t, s.Get(key))
+	assert.NoError(t, s.Validate())
+}
+
+// unboundedArena is an arena whose capacity is not bounded.
+type unboundedArena struct {
+	Arena
+}
+
+func (unboundedArena) Capacity() uint64 {
+	return math.MaxUint64 - largeKeyHeaderSize
+}
+
+func TestCheckKeySize(t *testing.T) {
+	allc := NewAllocator(uint64(defaultAllocatorSize))
+	assert.NoError(t, checkKeySize(allc, allc.Capacity()-largeKeyHeaderSize))
+	assert.Equal(t, ErrKeyTooLarge, checkKeySize(allc, allc.Capacity()-largeKeyHeaderSize+1))
+	arena := unboundedArena{allc}
+	assert.NoError(t, checkKeySize(arena, math.MaxUint32))
+	assert.Equal(t, ErrKeyTooLarge, checkKeySize(arena, math.MaxUint32+1), "Sizes must fit into 32 bits")
+}
+
+func TestSkipList_CheckValueSize(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Plain": NewWideSkipList(uint64(defaultAllocatorSize)),
+		"Codec": NewWideSkipList(uint64(defaultAllocatorSize), WithValueCodec(newTestCodec(t), testCodecThreshold)),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, s.checkValueSize(uint64(valueCompressedFlag)-1))
+			assert.Equal(t, ErrValueTooLarge, s.checkValueSize(math.MaxUint32+1), "Sizes must fit into 32 bits")
+			if s.hasValueFlags() {
+				assert.Equal(t, ErrValueTooLarge, s.checkValueSize(uint64(valueCompressedFlag)), "Sizes must not overlap flags")
+			} else {
+				assert.NoError(t, s.checkValueSize(math.MaxUint32))
+			}
+		})
+	}
+}
+
+func TestNode_NextNodeOffset_Wide(t *testing.T) {
+	s := NewWideSkipList(uint64(defaultAllocatorSize))
+	node, offset, _ := s.newNode(uniqueNodesData[0].height, uniqueNodesData[0].key, uniqueNodesData[0].val)
+	assert.Equal(t, inlineValueAreaOffset(offset+s.nodeSize(node.height)+keyStorageSize(uniqueNodesData[0].key))+inlineValueAreaSize, s.mainAllocator.Used(), "Node must fit into its size")
+	node.setNextNodeOffset(0, 1<<40)
+	node.setNextNodeOffset(3, 5)
+	assert.Equal(t, uint64(1<<40), node.getNextNodeOffset(0))
+	assert.Equal(t, uint64(5), node.getNextNodeOffset(3))
+	assert.True(t, node.casNextNodeOffset(3, 5, 1<<33))
+	assert.False(t, node.casNextNodeOffset(3, 5, 6))
+	assert.Equal(t, uint64(1<<33), node.getNextNodeOffset(3))
+}
+
+func TestSkipList_SetGet_Wide(t *testing.T) {
+	s := NewWideSkipList(uint64(defaultAllocatorSize))
+	for _, data := range sampleNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+		assert.Equal(t, data.val, s.Get(data.key))
+	}
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+		// Shrinking values must not be written in place.
+		assert.NoError(t, s.Set(data.key, data.val[1:]))
+		assert.Equal(t, data.val[1:], s.Get(data.key))
+	}
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_SetGet_Wide_Parallel(t *testing.T) {
+	s := NewWideSkipList(uint64(defaultAllocatorSize))
+	for i, data := range uniqueNodesData {
+		data := data
+		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
+			t.Parallel()
+			s.Set(data.key, data.val)
+			assert.Equal(t, data.val, s.Get(data.key))
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+func TestSkipList_Compact_Wide(t *testing.T) {
+	s := NewWideSkipList(uint64(defaultAllocatorSize))
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+		s.Set(data.key, data.val[1:])
+	}
+	assert.NotEqual(t, uint64(0), s.WastedValueBytes())
+	s.Compact()
+	assert.NoError(t, s.Validate())
+	assert.Equal(t, uint64(0), s.WastedValueBytes())
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, data.val[1:], s.Get(data.key))
+	}
+}
+
+func TestSkipList_InlineValue(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Compact": NewSkipList(defaultAllocatorSize),
+		"Wide":    NewWideSkipList(uint64(defaultAllocatorSize)),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			small := bytes.Repeat([]byte("s"), maxInlineValueSize)
+			large := bytes.Repeat([]byte("l"), maxInlineValueSize+1)
+			usedBefore := s.getValueAllocator().Used()
+			s.Set([]byte("key"), small)
+			node, _ := s.getClosestNode([]byte("key"))
+			assert.NotEqual(t, uint8(0), node.flags&nodeFlagInlineValue, "Node must have inline value area")
+			assert.True(t, s.isInlineValue(node.loadValue()))
+			assert.Equal(t, usedBefore, s.getValueAllocator().Used(), "Small value must not use value allocator")
+			assert.Equal(t, small, s.Get([]byte("key")))
+
+			// Large values fall back to value allocator.
+			s.Set([]byte("key"), large)
+			assert.False(t, s.isInlineValue(node.loadValue()))
+			assert.Equal(t, large, s.Get([]byte("key")))
+			assert.Equal(t, uint64(0), s.WastedValueBytes())
+
+			s.Set([]byte("key"), []byte("x"))
+			assert.True(t, s.isInlineValue(node.loadValue()))
+			assert.Equal(t, []byte("x"), s.Get([]byte("key")))
+			assert.Equal(t, s.valueStorageSize(uint64(len(large))), s.WastedValueBytes(), "Large value must be wasted")
+
+			// Returned value is a copy, it must not change with the node.
+			val := s.Get([]byte("key"))
+			s.Set([]byte("key"), []byte("y"))
+			assert.Equal(t, []byte("x"), val)
+			assert.Equal(t, []byte("y"), s.Get([]byte("key")))
+
+			// Empty values must still be found.
+			s.Set([]byte("empty"), nil)
+			assert.Equal(t, []byte{}, s.Get([]byte("empty")))
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+func TestSkipList_InlineValue_NotAllocatedForLargeValues(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	s.Set([]byte("key"), longValue[:])
+	node, _ := s.getClosestNode([]byte("key"))
+	assert.Equal(t, uint8(0), node.flags&nodeFlagInlineValue, "Node must not have inline value area")
+	s.Set([]byte("key"), []byte("small"))
+	assert.False(t, s.isInlineValue(node.loadValue()))
+	assert.Equal(t, []byte("small"), s.Get([]byte("key")))
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_InlineValue_Parallel(t *testing.T) {
+	s := NewSkipList(1 << 20)
+	values := [][]byte{
+		bytes.Repeat([]byte("a"), maxInlineValueSize),
+		bytes.Repeat([]byte("b"), maxInlineValueSize-1),
+		bytes.Repeat([]byte("c"), maxInlineValueSize+1),
+		[]byte("d"),
+	}
+	s.Set([]byte("key"), values[0])
+	for i := range values {
+		i := i
+		t.Run(fmt.Sprintf("Writer-%d", i), func(t *testing.T) {
+			t.Parallel()
+			for j := 0; j < 1000; j++ {
+				s.Set([]byte("key"), values[(i+j)%len(values)])
+			}
+		})
+		t.Run(fmt.Sprintf("Reader-%d", i), func(t *testing.T) {
+			t.Parallel()
+			for j := 0; j < 1000; j++ {
+				// A value must never be a mix of two values.
+				assert.Contains(t, values, s.Get([]byte("key")))
+			}
+		})
+	}
+}
+
+func TestSkipList_Set_ArenaFull(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Main":  NewSkipList(1<<10, WithArenas(NewAllocator(1<<10), NewAllocator(1<<20))),
+		"Value": NewSkipList(1<<10, WithArenas(NewAllocator(1<<20), NewAllocator(1<<10))),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			value := bytes.Repeat([]byte("v"), maxInlineValueSize+1)
+			var err error
+			i := 0
+			for ; err == nil; i++ {
+				err = s.Set([]byte(fmt.Sprintf("key%d", i)), value)
+			}
+			assert.Equal(t, ErrArenaFull, err)
+			assert.Nil(t, s.Get([]byte(fmt.Sprintf("key%d", i-1))))
+			for j := 0; j < i-1; j++ {
+				assert.Equal(t, value, s.Get([]byte(fmt.Sprintf("key%d", j))))
+			}
+			assert.NoError(t, s.Validate())
+		})
+	}
+}
+
+func TestSkipList_CompactInto(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+		s.Set(data.key, append(data.val, "-new"...))
+	}
+	oldArena := s.getValueAllocator()
+	arena := NewAllocator(uint64(defaultAllocatorSize))
+	replaced, err := s.CompactInto(arena)
+	assert.NoError(t, err)
+	assert.Equal(t, oldArena, replaced, "Replaced arena must be returned")
+	assert.Equal(t, Arena(arena), s.getValueAllocator())
+	assert.NoError(t, s.Validate())
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, append(data.val, "-new"...), s.Get(data.key))
+	}
+
+	// List must be unchanged if values do not fit.
+	_, err = s.CompactInto(NewAllocator(16))
+	assert.Equal(t, ErrArenaFull, err)
+	assert.Equal(t, Arena(arena), s.getValueAllocator())
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_CompactInto_Wide_Parallel(t *testing.T) {
+	s := NewWideSkipList(1 << 16)
+	val := bytes.Repeat([]byte("v"), 2*maxInlineValueSize)
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, val))
+	}
+	t.Run("CompactInto", func(t *testing.T) {
+		t.Parallel()
+		for i := 0; i < 100; i++ {
+			// Values are moved past the end of the replaced arena.
+			arena := NewAllocator(1 << 20)
+			_, err := arena.Allocate(1<<19, 1)
+			assert.NoError(t, err)
+			_, err = s.CompactInto(arena)
+			assert.NoError(t, err)
+		}
+	})
+	for i, data := range uniqueNodesData {
+		data := data
+		t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
+			t.Parallel()
+			for j := 0; j < 1000; j++ {
+				assert.Equal(t, val, s.Get(data.key))
+			}
+		})
+	}
+}
+
+func TestSkipList_Compact_Arena(t *testing.T) {
+	valueArena := &faultyArena{Allocator: NewAllocator(1 << 16), failAfter: 1 << 30}
+	s := NewSkipList(0, WithArenas(NewAllocator(1<<16), valueArena))
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	assert.Equal(t, ErrCompactArena, s.Compact(), "Custom arenas must not be replaced by Compact")
+	assert.Equal(t, Arena(valueArena), s.getValueAllocator())
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, data.val, s.Get(data.key))
+	}
+}
+
+// Values of Set benchmarks: inline values cost no value arena, so the cost
+// of value encoding only shows with values larger than maxInlineValueSize.
+var benchmarkSetValues = []struct {
+	name  string
+	value []byte
+}{
+	{"Inline", []byte("value")},
+	{"Value", bytes.Repeat([]byte("v"), 2*maxInlineValueSize)},
+}
+
+// benchmarkSet runs Set benchmarks of every value in benchmarkSetValues with
+// the lists returned by newList for given number of keys.
+func benchmarkSet(b *testing.B, newList func(keyCount int) *SkipList) {
+	for _, value := range benchmarkSetValues {
+		value := value
+		b.Run(value.name, func(b *testing.B) {
+			benchmarkSetValue(b, newList(b.N), value.value)
+		})
+	}
+}
+
+// benchmarkSetValue inserts b.N unique keys with given value and reports
+// memory used per node.
+func benchmarkSetValue(b *testing.B, s *SkipList, value []byte) {
+	keys := make([][]byte, b.N)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%09d", i))
+	}
+	mainBefore := s.mainAllocator.Used()
+	valueBefore := s.getValueAllocator().Used()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Set(keys[i], value)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(s.mainAllocator.Used()-mainBefore)/float64(b.N), "main-B/node")
+	b.ReportMetric(float64(s.getValueAllocator().Used()-valueBefore)/float64(b.N), "value-B/node")
+}
+
+func BenchmarkSkipList_Set_Compact(b *testing.B) {
+	benchmarkSet(b, func(keyCount int) *SkipList {
+		return NewSkipList(uint32(keyCount)*128 + 1<<20)
+	})
+}
+
+func BenchmarkSkipList_Set_Wide(b *testing.B) {
+	benchmarkSet(b, func(keyCount int) *SkipList {
+		return NewWideSkipList(uint64(keyCount)*256 + 1<<20)
+	})
+}
+
+// assertNodesAligned asserts that every node in the list, including
+// words accessed atomically, is properly aligned.
+func assertNodesAligned(t *testing.T, s *SkipList) {
+	for n := s.head; n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(n))%uintptr(nodeAlignment), "Node must be aligned")
+		assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&n.encodedValue))%8, "Value must be aligned")
+		if s.wide {
+			assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(n.wideLayer(0)))%8, "Wide layers must be aligned")
+		} else {
+			assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&n.layers[0]))%4, "Layers must be aligned")
+		}
+		if n.flags&nodeFlagInlineValue != 0 {
+			assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(s.inlineValueSlot(n, 0)))%8, "Inline values must be aligned")
+		}
+	}
+}
+
+func TestSkipList_NodeAlignment(t *testing.T) {
+	lists := map[string]*SkipList{
+		"Compact": NewSkipList(defaultAllocatorSize),
+		"Wide":    NewWideSkipList(uint64(defaultAllocatorSize)),
+	}
+	for name, s := range lists {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			// Keys of odd sizes leave the allocator misaligned.
+			for _, data := range uniqueNodesData {
+				s.Set(data.key, data.val)
+			}
+			assertNodesAligned(t, s)
+		})
+	}
+}
+
+func BenchmarkSkipList_Get_ValueSize(b *testing.B) {
+	const keyCount = 1 << 18
+	keys := make([][]byte, keyCount)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%09d", i))
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"Inline", maxInlineValueSize},
+		{"Allocated", maxInlineValueSize + 1},
+	}
+	for _, size := range sizes {
+		value := bytes.Repeat([]byte("v"), size.size)
+		b.Run(size.name, func(b *testing.B) {
+			s := NewSkipList(keyCount*192 + 1<<20)
+			for _, i := range rand.Perm(keyCount) {
+				s.Set(keys[i], value)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					s.Get(keys[r.Intn(keyCount)])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSkipList_Get_LongKeys(b *testing.B) {
+	const keyCount = 1 << 16
+	prefixes := []struct {
+		name   string
+		prefix string
+	}{
+		{"DistinctPrefix", ""},
+		{"SharedPrefix", "shared-prefix-"},
+	}
+	for _, prefix := range prefixes {
+		keys := make([][]byte, keyCount)
+		for i := range keys {
+			// Numbers are at the beginning of keys with distinct prefixes.
+			keys[i] = []byte(fmt.Sprintf("%s%09d-%s", prefix.prefix, i, bytes.Repeat([]byte("k"), 256)))
+		}
+		b.Run(prefix.name, func(b *testing.B) {
+			s := NewSkipList(keyCount*512 + 1<<20)
+			for _, i := range rand.Perm(keyCount) {
+				s.Set(keys[i], []byte("value"))
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					s.Get(keys[r.Intn(keyCount)])
+				}
+			})
+		})
+	}
+}
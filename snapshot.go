@@ -0,0 +1,633 @@
+package goskip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unsafe"
+)
+
+/*
+ Snapshot file layout, integers of headers are little-endian:
+
+	[8 bytes snapshotMagic][uint32 version][uint32 endianness marker]
+	[uint32 CRC-32C of previous bytes]
+	sections...
+
+ Section layout:
+
+	[uint32 section type][uint64 data size][data]
+	[uint32 CRC-32C of type, size and data]
+
+ Sections of version 1 written by WriteSnapshot are, in order: meta, main
+ arena, value arena, Bloom filter for lists with one, and end. Arenas are copied as they are in memory, so nodes
+ are in native byte order and layout. The endianness marker is written in
+ native byte order, and meta keeps the node size, so snapshots are only
+ loaded on compatible machines.
+
+ ExportSnapshot writes records sections followed by end instead. Data of
+ a records section is a sequence of key-value pairs in key order:
+
+	[uvarint key size][key][uvarint value size][value]
+
+ The end section makes a file truncated at a section boundary detectable.
+*/
+
+// snapshotMagic starts every snapshot file.
+const snapshotMagic = "GOSKIPSN"
+
+// Version of the snapshot format written by WriteSnapshot.
+const snapshotVersion = uint32(1)
+
+// Written in native byte order, read as a different value on other machines.
+const snapshotEndiannessMarker = uint32(0x01020304)
+
+// Sizes of the file header and section headers, in bytes.
+const snapshotHeaderSize = len(snapshotMagic) + 12
+const snapshotSectionHeaderSize = 12
+
+// Types of snapshot sections.
+const (
+	snapshotSectionEnd = uint32(iota)
+	snapshotSectionMeta
+	snapshotSectionMainArena
+	snapshotSectionValueArena
+	snapshotSectionRecords
+	snapshotSectionBloomFilter
+)
+
+// snapshotSectionNames are used in errors.
+var snapshotSectionNames = map[uint32]string{
+	snapshotSectionEnd:        "end",
+	snapshotSectionMeta:       "meta",
+	snapshotSectionMainArena:  "main arena",
+	snapshotSectionValueArena: "value arena",
+	snapshotSectionRecords:    "records",
+
+	snapshotSectionBloomFilter: "Bloom filter",
+}
+
+// Errors of ReadSnapshot, they are returned in a *SnapshotError.
+var (
+	ErrNotSnapshot          = errors.New("goskip: not a snapshot file")
+	ErrSnapshotVersion      = errors.New("goskip: unsupported snapshot version")
+	ErrSnapshotEndianness   = errors.New("goskip: snapshot byte order differs from this machine")
+	ErrSnapshotIncompatible = errors.New("goskip: snapshot node layout differs from this build")
+	ErrSnapshotTruncated    = errors.New("goskip: snapshot is truncated")
+	ErrSnapshotChecksum     = errors.New("goskip: snapshot checksum mismatch")
+	ErrSnapshotInvalid      = errors.New("goskip: snapshot is invalid")
+)
+
+// ErrSnapshotArena is returned by WriteSnapshot for lists with custom arenas.
+var ErrSnapshotArena = errors.New("goskip: snapshots require Allocator arenas")
+
+// ErrSnapshotChangeTracking is the error of a *SnapshotError returned by
+// ReadSnapshot if WithChangeTracking is given for a snapshot of WriteSnapshot
+// whose list does not track changes, or the other way around.
+var ErrSnapshotChangeTracking = errors.New("goskip: snapshot change tracking differs from options, see WithChangeTracking")
+
+// SnapshotError describes why a snapshot can not be loaded.
+type SnapshotError struct {
+	// Section which is invalid, "header" for the file header.
+	Section string
+
+	// Offset of the section in snapshot file.
+	Offset int64
+
+	// One of the snapshot errors above, such as ErrSnapshotChecksum.
+	Err error
+
+	// Details of the error, if any.
+	Reason string
+}
+
+func (e *SnapshotError) Error() string {
+	msg := fmt.Sprintf("%v: %s section at offset %d", e.Err, e.Section, e.Offset)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// Unwrap returns Err.
+func (e *SnapshotError) Unwrap() error {
+	return e.Err
+}
+
+// Flags of snapshot meta sections.
+const (
+	// The list is in wide mode.
+	snapshotFlagWide = 1 << iota
+
+	// The list tracks changes, see WithChangeTracking.
+	snapshotFlagChangeTracking
+
+	// Every known flag.
+	snapshotFlags = snapshotFlagWide | snapshotFlagChangeTracking
+)
+
+// snapshotMeta is the data of meta section.
+type snapshotMeta struct {
+	// Combination of snapshot flags. Snapshots of earlier versions only
+	// have snapshotFlagWide.
+	Flags uint32
+
+	// Size of the node type.
+	NodeSize uint32
+
+	NodeAlignment uint64
+	Height        uint64
+	HeadOffset    uint64
+
+	// Used bytes of arenas, and addresses of their memory modulo cache line
+	// size. Nodes are aligned by address, so loaded arenas are placed at the
+	// same address modulo cache line size.
+	MainUsed     uint64
+	MainAddress  uint64
+	ValueUsed    uint64
+	ValueAddress uint64
+
+	// Value bytes abandoned by value updates, see WastedValueBytes.
+	WastedValueBytes uint64
+}
+
+// snapshotWriter writes snapshot sections.
+type snapshotWriter struct {
+	w io.Writer
+}
+
+// write writes given bytes, updating given checksum.
+func (sw *snapshotWriter) write(crc uint32, data []byte) (uint32, error) {
+	_, err := sw.w.Write(data)
+	return crc32.Update(crc, castagnoliTable, data), err
+}
+
+// writeHeader writes the file header.
+func (sw *snapshotWriter) writeHeader() error {
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint32(header[len(snapshotMagic):], snapshotVersion)
+	marker := snapshotEndiannessMarker
+	copy(header[len(snapshotMagic)+4:], (*[4]byte)(unsafe.Pointer(&marker))[:])
+	binary.LittleEndian.PutUint32(header[len(snapshotMagic)+8:],
+		crc32.Checksum(header[:len(snapshotMagic)+8], castagnoliTable))
+	_, err := sw.write(0, header)
+	return err
+}
+
+// writeSection writes a section of given type with given data.
+func (sw *snapshotWriter) writeSection(sectionType uint32, data []byte) error {
+	var header [snapshotSectionHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], sectionType)
+	binary.LittleEndian.PutUint64(header[4:], uint64(len(data)))
+	crc, err := sw.write(0, header[:])
+	if err != nil {
+		return err
+	}
+	if crc, err = sw.write(crc, data); err != nil {
+		return err
+	}
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], crc)
+	_, err = sw.write(0, footer[:])
+	return err
+}
+
+// WriteSnapshot writes the list to w in the snapshot format, see ReadSnapshot.
+// Both arenas are written as they are, including the space wasted by value
+// updates, call Compact first to leave it out. Writers are blocked while the
+// snapshot is written, readers are not, see ExportSnapshot to keep writers
+// running. Lists with arenas other than Allocator return ErrSnapshotArena.
+func (s *SkipList) WriteSnapshot(w io.Writer) error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	mainAllocator, ok := s.mainAllocator.(*Allocator)
+	if !ok {
+		return ErrSnapshotArena
+	}
+	valueAllocator, ok := s.getValueAllocator().(*Allocator)
+	if !ok {
+		return ErrSnapshotArena
+	}
+
+	sw := &snapshotWriter{w: w}
+	if err := sw.writeHeader(); err != nil {
+		return err
+	}
+
+	meta := snapshotMeta{
+		NodeSize:      uint32(defaultNodeSize),
+		NodeAlignment: s.nodeAlignment,
+		Height:        uint64(s.getHeight()),
+		HeadOffset:    s.nodeOffset(s.head),
+		MainUsed:      mainAllocator.Used(),
+		MainAddress:   mainAllocator.address() % cacheLineSize,
+		ValueUsed:     valueAllocator.Used(),
+		ValueAddress:  valueAllocator.address() % cacheLineSize,
+
+		WastedValueBytes: s.stats.getWastedValueBytes(),
+	}
+	if s.wide {
+		meta.Flags |= snapshotFlagWide
+	}
+	if s.trackChanges {
+		meta.Flags |= snapshotFlagChangeTracking
+	}
+	var metaData bytes.Buffer
+	binary.Write(&metaData, binary.LittleEndian, &meta)
+
+	type section struct {
+		sectionType uint32
+		data        []byte
+	}
+	sections := []section{
+		{snapshotSectionMeta, metaData.Bytes()},
+		{snapshotSectionMainArena, mainAllocator.BytesAt(0, meta.MainUsed)},
+		{snapshotSectionValueArena, valueAllocator.BytesAt(0, meta.ValueUsed)},
+	}
+	if s.bloom != nil {
+		sections = append(sections, section{snapshotSectionBloomFilter, s.bloom.marshal()})
+	}
+	sections = append(sections, section{snapshotSectionEnd, nil})
+	for _, section := range sections {
+		if err := sw.writeSection(section.sectionType, section.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotReader reads sections and keeps the offset in file.
+type snapshotReader struct {
+	r      io.Reader
+	offset int64
+
+	// Name and offset of the section being read.
+	section       string
+	sectionOffset int64
+}
+
+// fail returns a *SnapshotError for the section being read.
+func (sr *snapshotReader) fail(err error, reason string) error {
+	return &SnapshotError{Section: sr.section, Offset: sr.sectionOffset, Err: err, Reason: reason}
+}
+
+// read fills given buffer, updating given checksum.
+func (sr *snapshotReader) read(crc uint32, buf []byte) (uint32, error) {
+	n, err := io.ReadFull(sr.r, buf)
+	sr.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return crc, sr.fail(ErrSnapshotTruncated, "")
+	} else if err != nil {
+		return crc, err
+	}
+	return crc32.Update(crc, castagnoliTable, buf), nil
+}
+
+// readHeader reads and checks the file header.
+func (sr *snapshotReader) readHeader() error {
+	sr.section = "header"
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := sr.read(0, header[:len(snapshotMagic)]); err != nil {
+		return err
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return sr.fail(ErrNotSnapshot, "")
+	}
+	if _, err := sr.read(0, header[len(snapshotMagic):]); err != nil {
+		return err
+	}
+	checksum := binary.LittleEndian.Uint32(header[len(snapshotMagic)+8:])
+	if crc32.Checksum(header[:len(snapshotMagic)+8], castagnoliTable) != checksum {
+		return sr.fail(ErrSnapshotChecksum, "")
+	}
+	if version := binary.LittleEndian.Uint32(header[len(snapshotMagic):]); version != snapshotVersion {
+		return sr.fail(ErrSnapshotVersion, fmt.Sprintf("version %d, supported version %d", version, snapshotVersion))
+	}
+	if marker := *(*uint32)(unsafe.Pointer(&header[len(snapshotMagic)+4])); marker != snapshotEndiannessMarker {
+		return sr.fail(ErrSnapshotEndianness, "")
+	}
+	return nil
+}
+
+// readSectionHeader reads the header of the next section, and returns its
+// type, size and the checksum of the header.
+func (sr *snapshotReader) readSectionHeader() (uint32, uint64, uint32, error) {
+	sr.section, sr.sectionOffset = "next", sr.offset
+	var header [snapshotSectionHeaderSize]byte
+	crc, err := sr.read(0, header[:])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	sectionType := binary.LittleEndian.Uint32(header[:])
+	if name, ok := snapshotSectionNames[sectionType]; ok {
+		sr.section = name
+	}
+	return sectionType, binary.LittleEndian.Uint64(header[4:]), crc, nil
+}
+
+// readSectionData reads data of the section being read, whose header has
+// given checksum, and checks the checksum of the section.
+func (sr *snapshotReader) readSectionData(crc uint32, data []byte) error {
+	crc, err := sr.read(crc, data)
+	if err != nil {
+		return err
+	}
+	var footer [4]byte
+	if _, err := sr.read(0, footer[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(footer[:]) != crc {
+		return sr.fail(ErrSnapshotChecksum, "")
+	}
+	return nil
+}
+
+// readSection reads a section of given type whose data must fill data.
+func (sr *snapshotReader) readSection(sectionType uint32, data []byte) error {
+	actualType, size, crc, err := sr.readSectionHeader()
+	if err != nil {
+		return err
+	}
+	return sr.readExpectedSection(sectionType, actualType, size, crc, data)
+}
+
+// readExpectedSection checks type and size of the section being read, whose
+// header is already read, and reads its data.
+func (sr *snapshotReader) readExpectedSection(sectionType uint32, actualType uint32, size uint64, crc uint32, data []byte) error {
+	if err := sr.checkSection(sectionType, actualType, size, uint64(len(data))); err != nil {
+		return err
+	}
+	return sr.readSectionData(crc, data)
+}
+
+// checkSection checks type and size of the section being read, whose header
+// is already read.
+func (sr *snapshotReader) checkSection(sectionType uint32, actualType uint32, size uint64, expectedSize uint64) error {
+	if actualType != sectionType {
+		sr.section = snapshotSectionNames[sectionType]
+		return sr.fail(ErrSnapshotInvalid, fmt.Sprintf("found section type %d", actualType))
+	}
+	if size != expectedSize {
+		return sr.fail(ErrSnapshotInvalid, fmt.Sprintf("section size is %d, expected %d", size, expectedSize))
+	}
+	return nil
+}
+
+// Memory of an arena section beyond the allocator size given to ReadSnapshot
+// is allocated in steps of at least this size as the section is read.
+const snapshotArenaReadSize = uint64(1 << 20)
+
+// readArena reads an arena section of given type, whose data fills the first
+// used bytes of a new allocator with given capacity, see newAllocatorAt.
+// Sizes in the snapshot are not verified before the data is read, so the
+// memory beyond trustedSize only grows as data is read.
+func (sr *snapshotReader) readArena(sectionType uint32, used uint64, capacity uint64, trustedSize uint64, address uint64) (*Allocator, error) {
+	actualType, size, crc, err := sr.readSectionHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := sr.checkSection(sectionType, actualType, size, used); err != nil {
+		return nil, err
+	}
+	size = capacity
+	if size > trustedSize && size > snapshotArenaReadSize {
+		size = trustedSize
+		if size < snapshotArenaReadSize {
+			size = snapshotArenaReadSize
+		}
+	}
+	allc := newAllocatorAt(size, address)
+	for read := uint64(0); ; {
+		end := allc.Capacity()
+		if end > used {
+			end = used
+		}
+		if crc, err = sr.read(crc, allc.mem[read:end]); err != nil {
+			return nil, err
+		}
+		read = end
+		if read == used {
+			break
+		}
+		size = capacity
+		if allc.Capacity() < capacity-allc.Capacity() {
+			size = 2 * allc.Capacity()
+		}
+		grown := newAllocatorAt(size, address)
+		copy(grown.mem, allc.mem[:read])
+		allc = grown
+	}
+	if err := sr.readSectionData(crc, nil); err != nil {
+		return nil, err
+	}
+	return allc, nil
+}
+
+// ReadSnapshot loads a list written by WriteSnapshot or ExportSnapshot.
+// For snapshots of ExportSnapshot, the list is created with NewSkipList, or
+// NewWideSkipList if allocatorSize exceeds 4GB, and given options.
+//
+// For snapshots of WriteSnapshot, arenas of the list have the capacity of the
+// written ones or allocatorSize, whichever is larger, up to 4GB for lists in
+// compact mode. Mode and node alignment are taken from the snapshot, so
+// WithCacheLineAlignment and WithArenas are ignored. Other options apply to
+// the loaded list as they do to new lists; values of the snapshot which are
+// in a value log or encoded need the log of WithValueLog and the codec of
+// WithValueCodec. WithChangeTracking must be given if and only if the written
+// list tracks changes, otherwise ErrSnapshotChangeTracking is returned. The
+// Bloom filter of the snapshot is loaded with the list; if there is none,
+// WithBloomFilter builds one. WithHashIndex builds a hash index of the
+// loaded nodes.
+//
+// Loaded pairs are not appended to the write-ahead log of WithWAL.
+//
+// Every section is checked against its checksum, and the list is validated
+// before it is returned. Truncated, corrupted or incompatible snapshots are
+// refused with a *SnapshotError.
+func ReadSnapshot(r io.Reader, allocatorSize uint64, opts ...Option) (*SkipList, error) {
+	o := newOptions(opts)
+	sr := &snapshotReader{r: r}
+	if err := sr.readHeader(); err != nil {
+		return nil, err
+	}
+
+	sectionType, size, crc, err := sr.readSectionHeader()
+	if err != nil {
+		return nil, err
+	}
+	// Snapshots of ExportSnapshot have no meta section.
+	if sectionType == snapshotSectionRecords || sectionType == snapshotSectionEnd {
+		return readExport(sr, sectionType, size, crc, allocatorSize, opts)
+	}
+	metaData := make([]byte, binary.Size(snapshotMeta{}))
+	if err := sr.readExpectedSection(snapshotSectionMeta, sectionType, size, crc, metaData); err != nil {
+		return nil, err
+	}
+	var meta snapshotMeta
+	binary.Read(bytes.NewReader(metaData), binary.LittleEndian, &meta)
+	if meta.NodeSize != uint32(defaultNodeSize) {
+		return nil, sr.fail(ErrSnapshotIncompatible, fmt.Sprintf("node size is %d, expected %d", meta.NodeSize, defaultNodeSize))
+	}
+	if meta.NodeAlignment != nodeAlignment && meta.NodeAlignment != cacheLineSize {
+		return nil, sr.fail(ErrSnapshotInvalid, fmt.Sprintf("invalid node alignment %d", meta.NodeAlignment))
+	}
+	if meta.Height > DefaultMaxHeight {
+		return nil, sr.fail(ErrSnapshotInvalid, fmt.Sprintf("list height %d exceeds max height %d", meta.Height, DefaultMaxHeight))
+	}
+	if meta.Flags&^snapshotFlags != 0 {
+		return nil, sr.fail(ErrSnapshotInvalid, fmt.Sprintf("unknown flags %#x", meta.Flags&^snapshotFlags))
+	}
+	if trackChanges := meta.Flags&snapshotFlagChangeTracking != 0; trackChanges != o.trackChanges {
+		return nil, sr.fail(ErrSnapshotChangeTracking, fmt.Sprintf("snapshot tracks changes: %t", trackChanges))
+	}
+	maxSize := ^uint64(0)
+	if meta.Flags&snapshotFlagWide == 0 {
+		maxSize = maxCompactAllocatorSize
+	}
+	if meta.MainUsed < initialAllocatorOffset || meta.MainUsed > maxSize ||
+		meta.ValueUsed < initialAllocatorOffset || meta.ValueUsed > maxSize {
+		return nil, sr.fail(ErrSnapshotInvalid, fmt.Sprintf("invalid arena sizes %d and %d", meta.MainUsed, meta.ValueUsed))
+	}
+
+	// Arenas are read right into the memory of new allocators.
+	readArena := func(sectionType uint32, used uint64, address uint64, chunkSize uint64) (*Allocator, error) {
+		capacity := allocatorSize
+		if capacity < used {
+			capacity = used
+		}
+		if capacity > maxSize {
+			capacity = maxSize
+		}
+		allc, err := sr.readArena(sectionType, used, capacity, allocatorSize, address)
+		if err != nil {
+			return nil, err
+		}
+		allc.offset = used
+		allc.enableChunks(chunkSize)
+		return allc, nil
+	}
+	mainOffset := sr.offset
+	mainAllocator, err := readArena(snapshotSectionMainArena, meta.MainUsed, meta.MainAddress, o.allocationChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	// Values of lists tracking changes are not allocated in chunks, see
+	// valueChunkSize.
+	valueChunkSize := o.allocationChunkSize
+	if o.trackChanges {
+		valueChunkSize = 0
+	}
+	valueAllocator, err := readArena(snapshotSectionValueArena, meta.ValueUsed, meta.ValueAddress, valueChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if sectionType, size, crc, err = sr.readSectionHeader(); err != nil {
+		return nil, err
+	}
+	var bloom *bloomFilter
+	if sectionType == snapshotSectionBloomFilter {
+		if bloom, err = sr.readBloomFilter(size, crc); err != nil {
+			return nil, err
+		}
+		if sectionType, size, crc, err = sr.readSectionHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if err := sr.readExpectedSection(snapshotSectionEnd, sectionType, size, crc, nil); err != nil {
+		return nil, err
+	}
+
+	s := &SkipList{
+		mainAllocator:       mainAllocator,
+		height:              uint32(meta.Height),
+		wide:                meta.Flags&snapshotFlagWide != 0,
+		nodeAlignment:       meta.NodeAlignment,
+		allocationChunkSize: o.allocationChunkSize,
+		stats:               &listStats{},
+		wal:                 o.wal,
+		vlog:                o.vlog,
+		valueLogThreshold:   o.valueLogThreshold,
+		codec:               o.codec,
+		codecThreshold:      o.codecThreshold,
+		bloom:               bloom,
+		trackChanges:        o.trackChanges,
+	}
+	s.setValueAllocator(valueAllocator)
+	// Checksums only guarantee that the arenas are the ones written,
+	// make sure that the offsets in them are usable as well.
+	head, err := s.validateNode(meta.HeadOffset)
+	if err == nil {
+		s.head = head
+		err = s.Validate()
+	}
+	if err != nil {
+		sr.section, sr.sectionOffset = snapshotSectionNames[snapshotSectionMainArena], mainOffset
+		return nil, sr.fail(ErrSnapshotInvalid, err.Error())
+	}
+	s.restoreStats(meta.WastedValueBytes)
+	if s.bloom == nil && o.bloomBitsPerKey != 0 {
+		s.bloom = newBloomFilter(o.bloomKeyCount, o.bloomBitsPerKey)
+		s.fillBloomFilter()
+	}
+	if o.hashIndexKeyCount != 0 {
+		s.index = newHashIndex(o.hashIndexKeyCount)
+		s.fillHashIndex()
+	}
+	return s, nil
+}
+
+// readBloomFilter reads the data of Bloom filter section, whose header with
+// given size and checksum is already read.
+func (sr *snapshotReader) readBloomFilter(size uint64, crc uint32) (*bloomFilter, error) {
+	// Size is not verified before the data is read, so the buffer only
+	// grows as data is read.
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, sr.r, int64(size))
+	sr.offset += n
+	if err == io.EOF {
+		return nil, sr.fail(ErrSnapshotTruncated, "")
+	} else if err != nil {
+		return nil, err
+	}
+	if err := sr.readSectionData(crc32.Update(crc, castagnoliTable, buf.Bytes()), nil); err != nil {
+		return nil, err
+	}
+	bloom, err := unmarshalBloomFilter(buf.Bytes())
+	if err != nil {
+		return nil, sr.fail(ErrSnapshotInvalid, err.Error())
+	}
+	return bloom, nil
+}
+
+// newAllocatorAt returns an allocator with given size whose memory address
+// modulo cache line size is given address.
+func newAllocatorAt(size uint64, address uint64) *Allocator {
+	mem := make([]byte, size+cacheLineSize, size+cacheLineSize+defaultNodeSize)
+	shift := (address - uint64(uintptr(unsafe.Pointer(&mem[0])))) % cacheLineSize
+	return &Allocator{offset: initialAllocatorOffset, mem: mem[shift : shift+size]}
+}
+
+// address returns the address of allocator memory.
+func (allc *Allocator) address() uint64 {
+	return uint64(uintptr(unsafe.Pointer(&allc.mem[0])))
+}
+
+// nodeOffset returns the offset of given node in main arena.
+func (s *SkipList) nodeOffset(node *node) uint64 {
+	return uint64(uintptr(unsafe.Pointer(node)) - uintptr(s.mainAllocator.NodeAt(0)))
+}
+
+// restoreStats counts the nodes of a loaded list.
+func (s *SkipList) restoreStats(wastedValueBytes uint64) {
+	for offset := s.head.getNextNodeOffset(0); offset != nilAllocatorOffset; {
+		node := s.getNode(offset)
+		s.stats.addNode(offset, node.height)
+		offset = node.getNextNodeOffset(0)
+	}
+	s.stats.addWastedValueBytes(0, wastedValueBytes)
+}
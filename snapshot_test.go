@@ -0,0 +1,232 @@
+package goskip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Lists written and read in snapshot tests.
+var snapshotLists = map[string]func() *SkipList{
+	"Compact":   func() *SkipList { return NewSkipList(defaultAllocatorSize) },
+	"Wide":      func() *SkipList { return NewWideSkipList(uint64(defaultAllocatorSize)) },
+	"CacheLine": func() *SkipList { return NewSkipList(defaultAllocatorSize, WithCacheLineAlignment()) },
+	"Chunks":    func() *SkipList { return NewSkipList(defaultAllocatorSize, WithAllocationChunks(1024)) },
+	"Bloom":     func() *SkipList { return NewSkipList(defaultAllocatorSize, WithBloomFilter(1000, 10)) },
+}
+
+// newSnapshot returns a snapshot of a list filled with uniqueNodesData.
+func newSnapshot(t *testing.T) []byte {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+	return buf.Bytes()
+}
+
+// assertSnapshotError checks that given snapshot is refused with given error.
+func assertSnapshotError(t *testing.T, snapshot []byte, err error, section string) {
+	_, actual := ReadSnapshot(bytes.NewReader(snapshot), 0)
+	if assert.IsType(t, &SnapshotError{}, actual) {
+		assert.Equal(t, err, actual.(*SnapshotError).Err, actual.Error())
+		assert.Equal(t, section, actual.(*SnapshotError).Section, actual.Error())
+	}
+}
+
+// setHeaderChecksum updates the header checksum of given snapshot.
+func setHeaderChecksum(snapshot []byte) {
+	end := len(snapshotMagic) + 8
+	binary.LittleEndian.PutUint32(snapshot[end:], crc32.Checksum(snapshot[:end], castagnoliTable))
+}
+
+func TestSkipList_WriteSnapshot(t *testing.T) {
+	for name, newList := range snapshotLists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			s := newList()
+			for _, data := range uniqueNodesData {
+				assert.NoError(t, s.Set(data.key, bytes.Repeat([]byte("old"), 11)))
+				assert.NoError(t, s.Set(data.key, data.val))
+			}
+			var buf bytes.Buffer
+			assert.NoError(t, s.WriteSnapshot(&buf))
+
+			loaded, err := ReadSnapshot(&buf, 1<<20)
+			assert.NoError(t, err)
+			for _, data := range uniqueNodesData {
+				assert.Equal(t, data.val, loaded.Get(data.key))
+			}
+			assert.Equal(t, s.wide, loaded.wide)
+			assert.Equal(t, s.nodeAlignment, loaded.nodeAlignment)
+			assertNodesAligned(t, loaded)
+
+			stats, loadedStats := s.Stats(), loaded.Stats()
+			assert.Equal(t, stats.Height, loadedStats.Height)
+			assert.Equal(t, stats.NodesPerHeight, loadedStats.NodesPerHeight)
+			assert.Equal(t, stats.MainAllocator.Used, loadedStats.MainAllocator.Used)
+			assert.Equal(t, uint64(1<<20), loadedStats.MainAllocator.Capacity)
+			assert.NotEqual(t, uint64(0), loadedStats.WastedValueBytes)
+			assert.Equal(t, stats.WastedValueBytes, loadedStats.WastedValueBytes, "Wasted value bytes must be restored")
+
+			// Loaded list can be updated.
+			assert.NoError(t, loaded.Set([]byte("new-key"), []byte("new-value")))
+			assert.NoError(t, loaded.Compact())
+			assert.Equal(t, []byte("new-value"), loaded.Get([]byte("new-key")))
+			assert.NoError(t, loaded.Validate())
+		})
+	}
+}
+
+func TestSkipList_WriteSnapshot_CustomArena(t *testing.T) {
+	s := NewSkipList(0, WithArenas(&faultyArena{Allocator: NewAllocator(1 << 16), failAfter: 1 << 30}, NewAllocator(1<<16)))
+	assert.Equal(t, ErrSnapshotArena, s.WriteSnapshot(&bytes.Buffer{}))
+}
+
+func TestReadSnapshot_ChangeTracking(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize, WithChangeTracking())
+	assert.NoError(t, s.Set([]byte("b"), []byte("value-b")))
+	assert.NoError(t, s.Set([]byte("a"), []byte("value-a")))
+	_, watermark := collectChanges(t, s, Watermark{})
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+
+	loaded, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<20, WithChangeTracking(), WithAllocationChunks(1024))
+	assert.NoError(t, err)
+	assert.True(t, loaded.trackChanges)
+	assert.Equal(t, uint64(0), loaded.getValueAllocator().(*Allocator).chunkSize, "Values must not be allocated in chunks")
+	assert.NoError(t, loaded.Set([]byte("c"), []byte("value-c")))
+	changes, _ := collectChanges(t, loaded, watermark)
+	assert.Equal(t, []string{"c=value-c"}, changes)
+
+	_, err = ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<20)
+	if assert.IsType(t, &SnapshotError{}, err) {
+		assert.Equal(t, ErrSnapshotChangeTracking, err.(*SnapshotError).Err, "Tracking must not be dropped")
+	}
+	_, err = ReadSnapshot(bytes.NewReader(newSnapshot(t)), 1<<20, WithChangeTracking())
+	if assert.IsType(t, &SnapshotError{}, err) {
+		assert.Equal(t, ErrSnapshotChangeTracking, err.(*SnapshotError).Err, "Untracked lists must not be tracked")
+	}
+}
+
+func TestReadSnapshot_Truncated(t *testing.T) {
+	snapshot := newSnapshot(t)
+	for size := 0; size < len(snapshot); size++ {
+		_, err := ReadSnapshot(bytes.NewReader(snapshot[:size]), 0)
+		if assert.IsType(t, &SnapshotError{}, err, "Size %d", size) {
+			assert.Equal(t, ErrSnapshotTruncated, err.(*SnapshotError).Err, "Size %d", size)
+		}
+	}
+}
+
+func TestReadSnapshot_Corrupted(t *testing.T) {
+	snapshot := newSnapshot(t)
+	for offset := 0; offset < len(snapshot); offset++ {
+		corrupted := append([]byte{}, snapshot...)
+		corrupted[offset] ^= 0x10
+		s, err := ReadSnapshot(bytes.NewReader(corrupted), 0)
+		assert.Nil(t, s, "Offset %d", offset)
+		assert.IsType(t, &SnapshotError{}, err, "Offset %d", offset)
+	}
+}
+
+func TestReadSnapshot_Errors(t *testing.T) {
+	metaOffset := snapshotHeaderSize
+	mainOffset := metaOffset + snapshotSectionHeaderSize + binary.Size(snapshotMeta{}) + 4
+	tests := []struct {
+		name    string
+		corrupt func(snapshot []byte)
+		err     error
+		section string
+	}{
+		{"Magic", func(snapshot []byte) { snapshot[0] = 'X' }, ErrNotSnapshot, "header"},
+		{"HeaderChecksum", func(snapshot []byte) { snapshot[len(snapshotMagic)]++ }, ErrSnapshotChecksum, "header"},
+		{"Version", func(snapshot []byte) {
+			snapshot[len(snapshotMagic)]++
+			setHeaderChecksum(snapshot)
+		}, ErrSnapshotVersion, "header"},
+		{"Endianness", func(snapshot []byte) {
+			marker := snapshot[len(snapshotMagic)+4 : len(snapshotMagic)+8]
+			marker[0], marker[1], marker[2], marker[3] = marker[3], marker[2], marker[1], marker[0]
+			setHeaderChecksum(snapshot)
+		}, ErrSnapshotEndianness, "header"},
+		{"SectionType", func(snapshot []byte) { snapshot[metaOffset] = 9 }, ErrSnapshotInvalid, "meta"},
+		{"SectionSize", func(snapshot []byte) { snapshot[mainOffset+4]++ }, ErrSnapshotInvalid, "main arena"},
+		{"MetaChecksum", func(snapshot []byte) { snapshot[metaOffset+snapshotSectionHeaderSize]++ }, ErrSnapshotChecksum, "meta"},
+		{"MainChecksum", func(snapshot []byte) { snapshot[mainOffset+snapshotSectionHeaderSize+1]++ }, ErrSnapshotChecksum, "main arena"},
+		{"ValueChecksum", func(snapshot []byte) { snapshot[len(snapshot)-snapshotSectionHeaderSize-5]++ }, ErrSnapshotChecksum, "value arena"},
+		{"End", func(snapshot []byte) { snapshot[len(snapshot)-snapshotSectionHeaderSize-4] = 9 }, ErrSnapshotInvalid, "end"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			snapshot := newSnapshot(t)
+			test.corrupt(snapshot)
+			assertSnapshotError(t, snapshot, test.err, test.section)
+		})
+	}
+}
+
+func TestReadSnapshot_LargeArena(t *testing.T) {
+	s := NewWideSkipList(4 * snapshotArenaReadSize)
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, s.Set([]byte(fmt.Sprintf("key-%d", i)), bytes.Repeat([]byte{byte(i)}, 1<<16)))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+
+	// Memory of arenas beyond the allocator size grows as they are read.
+	loaded, err := ReadSnapshot(&buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, listPairs(s), listPairs(loaded))
+	used := s.getValueAllocator().Used()
+	assert.True(t, used > 2*snapshotArenaReadSize)
+	assert.Equal(t, used, loaded.getValueAllocator().Capacity())
+	assertNodesAligned(t, loaded)
+}
+
+func TestReadSnapshot_ArenaSize(t *testing.T) {
+	metaOffset := snapshotHeaderSize + snapshotSectionHeaderSize
+	mainOffset := metaOffset + binary.Size(snapshotMeta{}) + 4
+	// setMainUsed sets the used bytes of main arena in the meta section.
+	setMainUsed := func(snapshot []byte, used uint64) {
+		var meta snapshotMeta
+		assert.NoError(t, binary.Read(bytes.NewReader(snapshot[metaOffset:]), binary.LittleEndian, &meta))
+		meta.MainUsed = used
+		var buf bytes.Buffer
+		assert.NoError(t, binary.Write(&buf, binary.LittleEndian, &meta))
+		copy(snapshot[metaOffset:], buf.Bytes())
+		binary.LittleEndian.PutUint32(snapshot[mainOffset-4:], crc32.Checksum(snapshot[snapshotHeaderSize:mainOffset-4], castagnoliTable))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, NewWideSkipList(uint64(defaultAllocatorSize)).WriteSnapshot(&buf))
+
+	// Sizes must not be trusted before the data is read.
+	snapshot := append([]byte{}, buf.Bytes()...)
+	setMainUsed(snapshot, 1<<62)
+	assertSnapshotError(t, snapshot, ErrSnapshotInvalid, "main arena")
+	binary.LittleEndian.PutUint64(snapshot[mainOffset+4:], 1<<62)
+	assertSnapshotError(t, snapshot, ErrSnapshotTruncated, "main arena")
+}
+
+func TestReadSnapshot_InvalidOffsets(t *testing.T) {
+	s := newValidList(t)
+	// Offsets pointing into garbage are refused even with valid checksums.
+	s.head.setNextNodeOffset(0, s.mainAllocator.Used())
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSnapshot(&buf))
+	assertSnapshotError(t, buf.Bytes(), ErrSnapshotInvalid, "main arena")
+}
+
+func TestSnapshotError(t *testing.T) {
+	err := &SnapshotError{Section: "meta", Offset: 24, Err: ErrSnapshotInvalid, Reason: "invalid node alignment 3"}
+	assert.Equal(t, "goskip: snapshot is invalid: meta section at offset 24: invalid node alignment 3", err.Error())
+	assert.Equal(t, ErrSnapshotInvalid, err.Unwrap())
+	assert.Equal(t, fmt.Sprintf("%v: header section at offset 0", ErrNotSnapshot),
+		(&SnapshotError{Section: "header", Err: ErrNotSnapshot}).Error())
+}
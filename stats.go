@@ -0,0 +1,146 @@
+package goskip
+
+import (
+	"sync/atomic"
+)
+
+// Number of stripes used for list counters. Must be a power of 2.
+const statsStripeCount = 8
+
+// Size of the counters in a single stripe, in bytes.
+const statsStripeSize = (DefaultMaxHeight + 3) * 8
+
+// statsStripe holds one copy of every counter of the list.
+// Writers update the stripe picked by a hint (usually an offset they just
+// allocated), so concurrent writers rarely touch the same cache line.
+type statsStripe struct {
+	// nodeHeights[i] is the number of nodes with height i+1.
+	nodeHeights [DefaultMaxHeight]uint64
+
+	// Number of failed CAS operations while linking new nodes.
+	linkCASFailures uint64
+
+	// Number of failed CAS operations while increasing list height.
+	heightCASFailures uint64
+
+	// Number of bytes abandoned in value allocator.
+	wastedValueBytes uint64
+
+	// Pad the stripe to a multiple of cache line size to prevent false sharing.
+	_ [cacheLineSize - statsStripeSize%cacheLineSize]byte
+}
+
+// listStats keeps striped counters of a skip list.
+type listStats struct {
+	stripes [statsStripeCount]statsStripe
+}
+
+// stripe returns the stripe for given hint.
+func (ls *listStats) stripe(hint uint64) *statsStripe {
+	// Offsets are not uniformly distributed in low bits, use fibonacci hashing.
+	return &ls.stripes[(uint32(hint)*2654435769)>>29&(statsStripeCount-1)]
+}
+
+// addNode records a new node with given height.
+func (ls *listStats) addNode(hint uint64, height uint8) {
+	atomic.AddUint64(&ls.stripe(hint).nodeHeights[height-1], 1)
+}
+
+// addLinkCASFailure records a failed CAS while linking a node.
+func (ls *listStats) addLinkCASFailure(hint uint64) {
+	atomic.AddUint64(&ls.stripe(hint).linkCASFailures, 1)
+}
+
+// addHeightCASFailure records a failed CAS while increasing list height.
+func (ls *listStats) addHeightCASFailure(hint uint64) {
+	atomic.AddUint64(&ls.stripe(hint).heightCASFailures, 1)
+}
+
+// addWastedValueBytes records value bytes which will never be used again.
+func (ls *listStats) addWastedValueBytes(hint uint64, size uint64) {
+	atomic.AddUint64(&ls.stripe(hint).wastedValueBytes, size)
+}
+
+// getWastedValueBytes returns the total number of wasted value bytes.
+func (ls *listStats) getWastedValueBytes() uint64 {
+	total := uint64(0)
+	for i := range ls.stripes {
+		total += atomic.LoadUint64(&ls.stripes[i].wastedValueBytes)
+	}
+	return total
+}
+
+// resetWastedValueBytes sets wasted value bytes to 0.
+// Must not be called concurrently with addWastedValueBytes.
+func (ls *listStats) resetWastedValueBytes() {
+	for i := range ls.stripes {
+		atomic.StoreUint64(&ls.stripes[i].wastedValueBytes, 0)
+	}
+}
+
+// AllocatorStats represents memory usage of an allocator.
+type AllocatorStats struct {
+	// Number of bytes reserved so far.
+	Used uint64
+
+	// Total number of bytes.
+	Capacity uint64
+
+	// Number of bytes abandoned at the tails of allocation chunks, see
+	// WithAllocationChunks. They are included in Used.
+	TailWaste uint64
+}
+
+// Utilization returns the ratio of used bytes to capacity.
+func (as AllocatorStats) Utilization() float64 {
+	if as.Capacity == 0 {
+		return 0
+	}
+	return float64(as.Used) / float64(as.Capacity)
+}
+
+// Stats is a snapshot of skip list statistics.
+// Counters are read one by one, so a snapshot taken while writers are
+// active is not necessarily consistent between fields.
+type Stats struct {
+	// Current height of the list.
+	Height uint32
+
+	// Total number of nodes, excluding head.
+	NodeCount uint64
+
+	// NodesPerHeight[i] is the number of nodes with height i+1.
+	NodesPerHeight [DefaultMaxHeight]uint64
+
+	// Number of failed CAS operations while linking new nodes in Set.
+	// Each failure results in a retry.
+	LinkCASFailures uint64
+
+	// Number of failed CAS operations while increasing list height in Set.
+	HeightCASFailures uint64
+
+	// Number of bytes abandoned in value allocator, see Compact.
+	WastedValueBytes uint64
+
+	MainAllocator  AllocatorStats
+	ValueAllocator AllocatorStats
+}
+
+// Stats returns a snapshot of list statistics.
+func (s *SkipList) Stats() Stats {
+	stats := Stats{Height: s.getHeight()}
+	for i := range s.stats.stripes {
+		stripe := &s.stats.stripes[i]
+		for h := range stripe.nodeHeights {
+			count := atomic.LoadUint64(&stripe.nodeHeights[h])
+			stats.NodesPerHeight[h] += count
+			stats.NodeCount += count
+		}
+		stats.LinkCASFailures += atomic.LoadUint64(&stripe.linkCASFailures)
+		stats.HeightCASFailures += atomic.LoadUint64(&stripe.heightCASFailures)
+		stats.WastedValueBytes += atomic.LoadUint64(&stripe.wastedValueBytes)
+	}
+	stats.MainAllocator = arenaStats(s.mainAllocator)
+	stats.ValueAllocator = arenaStats(s.getValueAllocator())
+	return stats
+}
@@ -0,0 +1,59 @@
+package goskip
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsStripe_Size(t *testing.T) {
+	assert.Equal(t, uintptr(0), unsafe.Sizeof(statsStripe{})%cacheLineSize,
+		"Stripe size must be a multiple of cache line size")
+}
+
+func TestAllocatorStats_Utilization(t *testing.T) {
+	assert.Equal(t, float64(0), AllocatorStats{}.Utilization())
+	assert.Equal(t, 0.25, AllocatorStats{Used: 16, Capacity: 64}.Utilization())
+}
+
+func TestSkipList_Stats(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	heights := [DefaultMaxHeight]uint64{}
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+	}
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		heights[n.height-1]++
+	}
+	// Value of this node is not inline, so its tail is wasted.
+	s.Set(uniqueNodesData[6].key, []byte("v"))
+
+	stats := s.Stats()
+	assert.Equal(t, s.getHeight(), stats.Height)
+	assert.Equal(t, uint64(len(uniqueNodesData)), stats.NodeCount)
+	assert.Equal(t, heights, stats.NodesPerHeight)
+	assert.Equal(t, uint64(len(uniqueNodesData[6].val)-1), stats.WastedValueBytes)
+	assert.Equal(t, uint64(0), stats.LinkCASFailures, "Sequential writes must not fail CAS")
+	assert.Equal(t, uint64(0), stats.HeightCASFailures, "Sequential writes must not fail CAS")
+	assert.Equal(t, s.mainAllocator.Used(), stats.MainAllocator.Used)
+	assert.Equal(t, uint64(defaultAllocatorSize), stats.MainAllocator.Capacity)
+	assert.Equal(t, s.getValueAllocator().Used(), stats.ValueAllocator.Used)
+	assert.Equal(t, uint64(defaultAllocatorSize), stats.ValueAllocator.Capacity)
+}
+
+func TestSkipList_Stats_Parallel(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	t.Run("Set", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			i := i
+			t.Run(fmt.Sprintf("Test-%d", i), func(t *testing.T) {
+				t.Parallel()
+				s.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+				s.Stats()
+			})
+		}
+	})
+	assert.Equal(t, uint64(200), s.Stats().NodeCount)
+}
@@ -1,6 +1,9 @@
 package goskip
 
-import "bytes"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
 // compareKeys returns an integer comparing two keys lexicographically.
 // The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
@@ -8,3 +11,35 @@ import "bytes"
 func compareKeys(keyA []byte, keyB []byte) int {
 	return bytes.Compare(keyA, keyB)
 }
+
+// Size of the key prefix kept in nodes, in bytes.
+const keyPrefixSize = 8
+
+// keyPrefix returns the first keyPrefixSize bytes of given key as a big-endian
+// uint64, padded with zeros. If prefixes of two keys differ, they compare
+// the same way as the keys, so only equal prefixes require comparing keys.
+func keyPrefix(key []byte) uint64 {
+	if len(key) >= keyPrefixSize {
+		return binary.BigEndian.Uint64(key)
+	}
+	var buf [keyPrefixSize]byte
+	copy(buf[:], key)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// keyHash returns the hash of given key: FNV-1a followed by the finalizer of
+// MurmurHash3, which spreads it over every bit. Bloom filters are written in
+// snapshots, so it must never change.
+func keyHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
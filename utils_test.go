@@ -14,3 +14,35 @@ func TestCompareKeys(t *testing.T) {
 	assert.Equal(t, compareKeys(key2, key1), 1, "Must return 1")
 	assert.Equal(t, compareKeys(key3, key1), -1, "Must return -1")
 }
+
+func TestKeyPrefix(t *testing.T) {
+	assert.Equal(t, uint64(0), keyPrefix(nil))
+	assert.Equal(t, uint64(0x6100000000000000), keyPrefix([]byte("a")))
+	assert.Equal(t, uint64(0x6162636465666768), keyPrefix([]byte("abcdefghij")))
+
+	// Different prefixes must compare the same way as their keys.
+	keys := [][]byte{
+		nil, []byte("a"), []byte("a\x00"), []byte("a\x01"), []byte("ab"),
+		[]byte("abcdefgh"), []byte("abcdefgh\x00"), []byte("abcdefgi"), []byte("b"),
+	}
+	for _, keyA := range keys {
+		for _, keyB := range keys {
+			prefixA, prefixB := keyPrefix(keyA), keyPrefix(keyB)
+			if prefixA == prefixB {
+				continue
+			}
+			if prefixA < prefixB {
+				assert.Equal(t, -1, compareKeys(keyA, keyB), "%q must be less than %q", keyA, keyB)
+			} else {
+				assert.Equal(t, 1, compareKeys(keyA, keyB), "%q must be greater than %q", keyA, keyB)
+			}
+		}
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	// Hashes are written in snapshots, they must never change.
+	assert.Equal(t, uint64(0xefd01f60ba992926), keyHash(nil))
+	assert.Equal(t, uint64(0x82a2a958a9bece5b), keyHash([]byte("a")))
+	assert.Equal(t, uint64(0xcf8c79838f3b3030), keyHash([]byte("key")))
+}
@@ -0,0 +1,180 @@
+package goskip
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Maximum number of key bytes printed in error messages.
+const maxPrintedKeySize = 32
+
+// formatKey returns a printable, possibly truncated form of the key.
+func formatKey(key []byte) string {
+	if len(key) > maxPrintedKeySize {
+		return fmt.Sprintf("%q...", key[:maxPrintedKeySize])
+	}
+	return fmt.Sprintf("%q", key)
+}
+
+// Validate checks structural invariants of the list and returns a
+// descriptive error for the first violation found:
+//   - list and node heights are within bounds,
+//   - node, key and value ranges lie within allocated memory,
+//   - every level is sorted by key,
+//   - every node on level i also appears on level i-1.
+//
+// Writers are blocked while Validate runs, readers are not. Otherwise a node
+// linked on the lower levels after they are checked would be reported as
+// missing there.
+func (s *SkipList) Validate() error {
+	// Writers and Compact hold the read lock.
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	listHeight := s.getHeight()
+	if listHeight > DefaultMaxHeight {
+		return fmt.Errorf("goskip: list height %d exceeds max height %d", listHeight, DefaultMaxHeight)
+	}
+	if s.head.height != DefaultMaxHeight {
+		return fmt.Errorf("goskip: head height is %d, expected %d", s.head.height, DefaultMaxHeight)
+	}
+	for level := uint8(listHeight); level < DefaultMaxHeight; level++ {
+		if offset := s.head.getNextNodeOffset(level); offset != nilAllocatorOffset {
+			return fmt.Errorf("goskip: level %d is above list height %d but links to offset %d",
+				level, listHeight, offset)
+		}
+	}
+
+	// Offsets of the nodes on the level below the current one.
+	var lowerLevel map[uint64]bool
+	for level := uint8(0); level < uint8(listHeight); level++ {
+		currentLevel := make(map[uint64]bool)
+		var prevKey []byte
+		for offset := s.head.getNextNodeOffset(level); offset != nilAllocatorOffset; {
+			node, err := s.validateNode(offset)
+			if err != nil {
+				return fmt.Errorf("goskip: level %d: %v", level, err)
+			}
+			if node.height <= level {
+				return fmt.Errorf("goskip: level %d: node at offset %d has height %d",
+					level, offset, node.height)
+			}
+			key := s.getNodeKey(node)
+			// Strict ordering also guarantees there are no cycles.
+			if prevKey != nil && compareKeys(prevKey, key) >= 0 {
+				return fmt.Errorf("goskip: level %d is not sorted: key %s at offset %d follows key %s",
+					level, formatKey(key), offset, formatKey(prevKey))
+			}
+			if level > 0 && !lowerLevel[offset] {
+				return fmt.Errorf("goskip: level %d: node at offset %d with key %s is missing on level %d",
+					level, offset, formatKey(key), level-1)
+			}
+			currentLevel[offset] = true
+			prevKey = key
+			offset = node.getNextNodeOffset(level)
+		}
+		lowerLevel = currentLevel
+	}
+	return nil
+}
+
+// validateNode checks that the node at given offset, along with its key
+// and value, lies within allocated memory and returns the node.
+func (s *SkipList) validateNode(offset uint64) (*node, error) {
+	node, err := s.validateNodeLayout(offset)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validateNodeValue(offset, node); err != nil {
+		return nil, fmt.Errorf("value of node at offset %d %v", offset, err)
+	}
+	return node, nil
+}
+
+// validateNodeLayout checks that the node at given offset and its key lie
+// within allocated memory and returns the node. Its value is not checked.
+func (s *SkipList) validateNodeLayout(offset uint64) (*node, error) {
+	mainUsed := s.mainAllocator.Used()
+	if offset < initialAllocatorOffset || offset+s.nodeSize(1) > mainUsed {
+		return nil, fmt.Errorf("node offset %d is out of allocated range [%d, %d)",
+			offset, initialAllocatorOffset, mainUsed)
+	}
+	node := s.getNode(offset)
+	if uintptr(unsafe.Pointer(node))%uintptr(nodeAlignment) != 0 {
+		return nil, fmt.Errorf("node at offset %d is not aligned to %d bytes", offset, nodeAlignment)
+	}
+	if node.height < 1 || node.height > DefaultMaxHeight {
+		return nil, fmt.Errorf("node at offset %d has invalid height %d", offset, node.height)
+	}
+	if (node.flags&nodeFlagWide != 0) != s.wide {
+		return nil, fmt.Errorf("node at offset %d has flags %#x not matching the offset mode of the list",
+			offset, node.flags)
+	}
+	if offset+s.nodeSize(node.height) > mainUsed {
+		return nil, fmt.Errorf("node at offset %d with height %d exceeds allocated range %d",
+			offset, node.height, mainUsed)
+	}
+	if err := s.validateNodeKey(offset, node); err != nil {
+		return nil, fmt.Errorf("key of node at offset %d %v", offset, err)
+	}
+	if prefix := keyPrefix(s.getNodeKey(node)); node.keyPrefix != prefix {
+		return nil, fmt.Errorf("node at offset %d has key prefix %#x not matching its key %s",
+			offset, node.keyPrefix, formatKey(s.getNodeKey(node)))
+	}
+	return node, nil
+}
+
+// validateNodeKey checks that the key of the node at given offset lies
+// within allocated memory.
+func (s *SkipList) validateNodeKey(offset uint64, node *node) error {
+	mainUsed := s.mainAllocator.Used()
+	// Size header of a large key must be readable before the key itself.
+	headerOffset := offset + s.nodeSize(node.height)
+	if node.keySize == largeKeySize && headerOffset+largeKeyHeaderSize > mainUsed {
+		return fmt.Errorf("has size header at %d exceeding allocated range %d", headerOffset, mainUsed)
+	}
+	keyOffset, keySize := s.getNodeKeyBounds(node)
+	keyOffset += offset
+	if keyOffset+keySize > mainUsed {
+		return fmt.Errorf("[%d, %d) exceeds allocated range %d", keyOffset, keyOffset+keySize, mainUsed)
+	}
+	return nil
+}
+
+// validateNodeValue checks that the value of the node at given offset lies
+// within allocated memory.
+func (s *SkipList) validateNodeValue(offset uint64, node *node) error {
+	allc := s.getValueAllocator()
+	valueUsed := allc.Used()
+	encodedValue := node.loadValue()
+	if s.isInlineValue(encodedValue) {
+		if node.flags&nodeFlagInlineValue == 0 {
+			return fmt.Errorf("is inline but node has no inline value area")
+		}
+		mainUsed := s.mainAllocator.Used()
+		if areaOffset := offset + s.getInlineValueAreaOffset(node); areaOffset+inlineValueAreaSize > mainUsed {
+			return fmt.Errorf("has inline value area at %d exceeding allocated range %d", areaOffset, mainUsed)
+		}
+		if _, size := decodeInlineValue(encodedValue); size > maxInlineValueSize {
+			return fmt.Errorf("is inline with size %d exceeding %d", size, maxInlineValueSize)
+		}
+		return nil
+	}
+	// Size header of a value in wide mode must be readable before the value itself.
+	if s.wide && encodedValue+wideValueHeaderSize > valueUsed {
+		return fmt.Errorf("has size header at %d exceeding allocated range %d", encodedValue, valueUsed)
+	}
+	valOffset, valSize := s.getValueBounds(allc, encodedValue)
+	if valOffset+valSize > valueUsed {
+		return fmt.Errorf("[%d, %d) exceeds allocated range %d", valOffset, valOffset+valSize, valueUsed)
+	}
+	if s.isValuePointer(allc, encodedValue) {
+		if valSize != valuePointerSize {
+			return fmt.Errorf("is a value pointer with size %d, expected %d", valSize, valuePointerSize)
+		}
+		if p := s.loadValuePointer(allc, encodedValue); !s.vlog.hasFile(p.file) {
+			return fmt.Errorf("is in value log file %d which does not exist", p.file)
+		}
+	}
+	return nil
+}
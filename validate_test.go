@@ -0,0 +1,158 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newValidList returns a list filled with uniqueNodesData.
+func newValidList(t *testing.T) *SkipList {
+	s := NewSkipList(defaultAllocatorSize)
+	for _, data := range uniqueNodesData {
+		s.Set(data.key, data.val)
+	}
+	assert.NoError(t, s.Validate())
+	return s
+}
+
+func TestFormatKey(t *testing.T) {
+	assert.Equal(t, `"key\n"`, formatKey([]byte("key\n")))
+	longKey := bytes.Repeat([]byte("k"), maxPrintedKeySize+1)
+	assert.Equal(t, `"`+string(longKey[:maxPrintedKeySize])+`"...`, formatKey(longKey))
+}
+
+func TestSkipList_Validate_Empty(t *testing.T) {
+	s := NewSkipList(defaultAllocatorSize)
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_Validate_Writers(t *testing.T) {
+	s := newValidList(t)
+	// Writers hold the read lock while they link nodes.
+	s.compactMu.RLock()
+	validated := make(chan error)
+	go func() {
+		validated <- s.Validate()
+	}()
+	select {
+	case <-validated:
+		t.Fatal("Validate must wait for writers in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.compactMu.RUnlock()
+	assert.NoError(t, <-validated)
+}
+
+func TestSkipList_Validate_Parallel(t *testing.T) {
+	s := NewSkipList(1 << 24)
+	var wg sync.WaitGroup
+	var done int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				assert.NoError(t, s.Set([]byte(fmt.Sprintf("k%d-%d", i, j)), []byte("value")))
+			}
+			atomic.StoreInt32(&done, 1)
+		}(i)
+	}
+	// Nodes linked by writers while the list is checked must not be
+	// reported as missing.
+	for atomic.LoadInt32(&done) == 0 {
+		assert.NoError(t, s.Validate())
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	assert.NoError(t, s.Validate())
+}
+
+func TestSkipList_Validate_Unsorted(t *testing.T) {
+	s := newValidList(t)
+	// Make the key of the first node greater than every other key.
+	first := s.getNode(s.head.getNextNodeOffset(0))
+	key := s.getNodeKey(first)
+	copy(key, bytes.Repeat([]byte{0xff}, len(key)))
+	first.keyPrefix = keyPrefix(key)
+	assert.Contains(t, s.Validate().Error(), "is not sorted")
+}
+
+func TestSkipList_Validate_MissingOnLowerLevel(t *testing.T) {
+	s := newValidList(t)
+	// Skip the first node on base level, it is still linked on upper levels.
+	var first *node
+	for first = s.getNode(s.head.getNextNodeOffset(0)); first.height < 2; {
+		first = s.getNode(first.getNextNodeOffset(0))
+	}
+	s.head.setNextNodeOffset(0, first.getNextNodeOffset(0))
+	assert.Contains(t, s.Validate().Error(), "is missing on level")
+}
+
+func TestSkipList_Validate_InvalidHeight(t *testing.T) {
+	s := newValidList(t)
+	s.getNode(s.head.getNextNodeOffset(0)).height = DefaultMaxHeight + 1
+	assert.Contains(t, s.Validate().Error(), "invalid height")
+}
+
+func TestSkipList_Validate_OffsetOutOfRange(t *testing.T) {
+	s := newValidList(t)
+	s.head.setNextNodeOffset(0, s.mainAllocator.Used())
+	assert.Contains(t, s.Validate().Error(), "out of allocated range")
+}
+
+func TestSkipList_Validate_KeyOutOfRange(t *testing.T) {
+	s := newValidList(t)
+	s.getNode(s.head.getNextNodeOffset(0)).keySize = largeKeySize - 1
+	assert.Contains(t, s.Validate().Error(), "key of node")
+}
+
+func TestSkipList_Validate_ValueOutOfRange(t *testing.T) {
+	s := newValidList(t)
+	s.getNode(s.head.getNextNodeOffset(0)).encodeValue(uint32(s.getValueAllocator().Used()), 1)
+	assert.Contains(t, s.Validate().Error(), "value of node")
+}
+
+func TestSkipList_Validate_AboveListHeight(t *testing.T) {
+	s := newValidList(t)
+	s.head.setNextNodeOffset(DefaultMaxHeight-1, s.head.getNextNodeOffset(0))
+	s.height = DefaultMaxHeight - 1
+	assert.Contains(t, s.Validate().Error(), "is above list height")
+}
+
+func TestSkipList_Validate_LargeKeyOutOfRange(t *testing.T) {
+	s := NewSkipList(1 << 20)
+	s.Set(make([]byte, largeKeySize), []byte("value"))
+	assert.NoError(t, s.Validate())
+	// Corrupt the size header of the key.
+	node := s.getNode(s.head.getNextNodeOffset(0))
+	offset, _ := s.getNodeKeyBounds(node)
+	copy(blockBytes(unsafe.Pointer(node), offset-largeKeyHeaderSize, largeKeyHeaderSize), []byte{0xff, 0xff, 0xff, 0xff})
+	assert.Contains(t, s.Validate().Error(), "exceeds allocated range")
+}
+
+func TestSkipList_Validate_Misaligned(t *testing.T) {
+	s := newValidList(t)
+	s.head.setNextNodeOffset(0, s.head.getNextNodeOffset(0)+1)
+	assert.Contains(t, s.Validate().Error(), "is not aligned")
+}
+
+func TestSkipList_Validate_InlineValueTooLarge(t *testing.T) {
+	s := newValidList(t)
+	node := s.getNode(s.head.getNextNodeOffset(0))
+	assert.True(t, s.isInlineValue(node.loadValue()))
+	node.storeValue(s.encodeInlineValue(0, maxInlineValueSize+1))
+	assert.Contains(t, s.Validate().Error(), "exceeding")
+}
+
+func TestSkipList_Validate_KeyPrefixMismatch(t *testing.T) {
+	s := newValidList(t)
+	s.getNode(s.head.getNextNodeOffset(0)).keyPrefix++
+	assert.Contains(t, s.Validate().Error(), "key prefix")
+}
@@ -0,0 +1,447 @@
+package goskip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ Value log files are named by their number, e.g. 000001.vlog, in the
+ directory of the log. Records are appended to the file with the highest
+ number, integers are little-endian:
+
+	[uint32 value size][uint32 CRC-32C of value][value]
+
+ Values of encrypted records are sealed with the file number and record
+ offset as additional data, and their size is flagged with
+ valueLogEncryptedFlag, see WithValueLogEncryption.
+
+ Nodes whose value is stored in the log keep a value pointer in value arena
+ instead of the value. Its size in value arena is flagged with
+ valuePointerFlag:
+
+	[uint32 file number][uint32 value size][uint64 record offset]
+*/
+
+// Size of the record header, in bytes.
+const valueLogHeaderSize = 8
+
+// Size of a value pointer in value arena, in bytes.
+const valuePointerSize = 16
+
+// Value pointers are flagged by the top bit of their size in value arena.
+const valuePointerFlag = uint32(1) << 31
+
+// Encrypted records are flagged by the top bit of their size.
+const valueLogEncryptedFlag = uint32(1) << 31
+
+// Default size of value log files, see WithValueLogFileSize.
+const defaultValueLogFileSize = 64 << 20
+
+// Extension of value log file names.
+const valueLogFileExt = ".vlog"
+
+// ErrValueLogClosed is returned by Set for lists whose value log is closed.
+var ErrValueLogClosed = errors.New("goskip: value log is closed")
+
+// ErrNoValueLog is returned by CollectValueLog for lists created without
+// WithValueLog.
+var ErrNoValueLog = errors.New("goskip: list has no value log, see WithValueLog")
+
+// ValueLogError is returned when a value can not be read from a value log.
+type ValueLogError struct {
+	// Number of the file and offset of the record in it.
+	File   uint32
+	Offset uint64
+
+	// Reason describes why the value can not be read.
+	Reason string
+}
+
+func (e *ValueLogError) Error() string {
+	return fmt.Sprintf("goskip: value log file %d is invalid at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// valueLogOptions keeps the configuration of a value log.
+type valueLogOptions struct {
+	fileSize int64
+	keyring  *Keyring
+}
+
+// ValueLogOption configures a value log opened by OpenValueLog.
+type ValueLogOption func(*valueLogOptions)
+
+// WithValueLogFileSize sets the size after which values are appended to a new
+// file, 64MB by default. CollectValueLog reclaims space a file at a time.
+func WithValueLogFileSize(size int64) ValueLogOption {
+	return func(o *valueLogOptions) {
+		o.fileSize = size
+	}
+}
+
+// WithValueLogEncryption encrypts the values appended to the log with the
+// current key of given keyring, and decrypts values with its keys. Values
+// appended before are left as they are.
+func WithValueLogEncryption(keyring *Keyring) ValueLogOption {
+	return func(o *valueLogOptions) {
+		o.keyring = keyring
+	}
+}
+
+// valueRecordAdditionalData returns the additional data of the encrypted
+// record at given offset of the file with given number.
+func valueRecordAdditionalData(number uint32, offset int64) []byte {
+	var data [12]byte
+	binary.LittleEndian.PutUint32(data[:], number)
+	binary.LittleEndian.PutUint64(data[4:], uint64(offset))
+	return data[:]
+}
+
+// valuePointer is the location of a value in a value log.
+type valuePointer struct {
+	file   uint32
+	size   uint32
+	offset uint64
+}
+
+// encode writes the pointer to given buffer of valuePointerSize bytes.
+func (p valuePointer) encode(buf []byte) {
+	binary.LittleEndian.PutUint32(buf, p.file)
+	binary.LittleEndian.PutUint32(buf[4:], p.size)
+	binary.LittleEndian.PutUint64(buf[8:], p.offset)
+}
+
+// decodeValuePointer reads a pointer from given buffer of valuePointerSize bytes.
+func decodeValuePointer(buf []byte) valuePointer {
+	return valuePointer{
+		file:   binary.LittleEndian.Uint32(buf),
+		size:   binary.LittleEndian.Uint32(buf[4:]),
+		offset: binary.LittleEndian.Uint64(buf[8:]),
+	}
+}
+
+// ValueLog keeps large values of a skip list in append-only files, so that
+// they take no space in value arena, see OpenValueLog and WithValueLog.
+type ValueLog struct {
+	dir     string
+	options valueLogOptions
+
+	// Appends are serialized, they are written to the active file.
+	appendMu   sync.Mutex
+	active     uint32
+	activeSize int64
+
+	// Open files by number. Readers hold the read lock while they read,
+	// files are closed holding the write lock.
+	mu     sync.RWMutex
+	files  map[uint32]*os.File
+	closed bool
+}
+
+// OpenValueLog opens the value log in given directory, creating it if it does
+// not exist. Existing files are kept for the lists loaded from snapshots, and
+// values are appended to a new file.
+func OpenValueLog(dir string, opts ...ValueLogOption) (*ValueLog, error) {
+	o := valueLogOptions{fileSize: defaultValueLogFileSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	vlog := &ValueLog{dir: dir, options: o, files: make(map[uint32]*os.File)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, valueLogFileExt) {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimSuffix(name, valueLogFileExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR, 0644)
+		if err != nil {
+			vlog.Close()
+			return nil, err
+		}
+		vlog.files[uint32(number)] = file
+		if uint32(number) > vlog.active {
+			vlog.active = uint32(number)
+		}
+	}
+	if err := vlog.rotate(); err != nil {
+		vlog.Close()
+		return nil, err
+	}
+	return vlog, nil
+}
+
+// path returns the path of the file with given number.
+func (vlog *ValueLog) path(number uint32) string {
+	return filepath.Join(vlog.dir, fmt.Sprintf("%06d%s", number, valueLogFileExt))
+}
+
+// rotate creates the next file and makes it the active file.
+// It is called holding appendMu.
+func (vlog *ValueLog) rotate() error {
+	file, err := os.OpenFile(vlog.path(vlog.active+1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	if vlog.closed {
+		file.Close()
+		return ErrValueLogClosed
+	}
+	vlog.active++
+	vlog.activeSize = 0
+	vlog.files[vlog.active] = file
+	return nil
+}
+
+// Close closes the files of the log. Set returns ErrValueLogClosed afterwards
+// for large values, and Get returns nil for the values in the log.
+func (vlog *ValueLog) Close() error {
+	vlog.appendMu.Lock()
+	defer vlog.appendMu.Unlock()
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	if vlog.closed {
+		return nil
+	}
+	vlog.closed = true
+	var err error
+	for _, file := range vlog.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Sync flushes the active file to stable storage. Values are not synced as
+// they are appended, updates are made durable by a write-ahead log.
+// Sync before writing a snapshot, which refers to the values in the log.
+func (vlog *ValueLog) Sync() error {
+	vlog.appendMu.Lock()
+	defer vlog.appendMu.Unlock()
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	if vlog.closed {
+		return ErrValueLogClosed
+	}
+	return vlog.files[vlog.active].Sync()
+}
+
+// append appends given value to the active file and returns its pointer.
+func (vlog *ValueLog) append(val []byte) (valuePointer, error) {
+	vlog.appendMu.Lock()
+	defer vlog.appendMu.Unlock()
+	keyring := vlog.options.keyring
+	recordSize := int64(valueLogHeaderSize + len(val))
+	if keyring != nil {
+		recordSize += int64(keyring.sealOverhead())
+	}
+	if vlog.activeSize > 0 && vlog.activeSize+recordSize > vlog.options.fileSize {
+		if err := vlog.rotate(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+	record := make([]byte, valueLogHeaderSize, recordSize)
+	size := uint32(len(val))
+	if keyring != nil {
+		var err error
+		if record, err = keyring.seal(record, val, valueRecordAdditionalData(vlog.active, vlog.activeSize)); err != nil {
+			return valuePointer{}, err
+		}
+		size = uint32(len(record)-valueLogHeaderSize) | valueLogEncryptedFlag
+	} else {
+		record = append(record, val...)
+	}
+	binary.LittleEndian.PutUint32(record, size)
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(record[valueLogHeaderSize:], castagnoliTable))
+
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	if vlog.closed {
+		return valuePointer{}, ErrValueLogClosed
+	}
+	if _, err := vlog.files[vlog.active].WriteAt(record, vlog.activeSize); err != nil {
+		return valuePointer{}, err
+	}
+	p := valuePointer{file: vlog.active, size: uint32(len(record) - valueLogHeaderSize), offset: uint64(vlog.activeSize)}
+	vlog.activeSize += int64(len(record))
+	return p, nil
+}
+
+// read returns the value with given pointer.
+func (vlog *ValueLog) read(p valuePointer) ([]byte, error) {
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	if vlog.closed {
+		return nil, ErrValueLogClosed
+	}
+	file, ok := vlog.files[p.file]
+	if !ok {
+		return nil, &ValueLogError{File: p.file, Offset: p.offset, Reason: "file does not exist"}
+	}
+	record := make([]byte, valueLogHeaderSize+uint64(p.size))
+	if _, err := file.ReadAt(record, int64(p.offset)); err != nil {
+		return nil, &ValueLogError{File: p.file, Offset: p.offset, Reason: err.Error()}
+	}
+	size := binary.LittleEndian.Uint32(record)
+	if size&^valueLogEncryptedFlag != p.size {
+		return nil, &ValueLogError{File: p.file, Offset: p.offset, Reason: fmt.Sprintf("value size is %d, expected %d", size&^valueLogEncryptedFlag, p.size)}
+	}
+	val := record[valueLogHeaderSize:]
+	if binary.LittleEndian.Uint32(record[4:]) != crc32.Checksum(val, castagnoliTable) {
+		return nil, &ValueLogError{File: p.file, Offset: p.offset, Reason: "checksum mismatch"}
+	}
+	if size&valueLogEncryptedFlag != 0 {
+		return vlog.options.keyring.open(val, valueRecordAdditionalData(p.file, int64(p.offset)))
+	}
+	return val, nil
+}
+
+// hasFile returns whether the file with given number exists.
+func (vlog *ValueLog) hasFile(number uint32) bool {
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	_, ok := vlog.files[number]
+	return ok
+}
+
+// sealedFiles returns the sizes of the files which are not appended to
+// anymore, by file number.
+func (vlog *ValueLog) sealedFiles() (map[uint32]int64, error) {
+	vlog.appendMu.Lock()
+	defer vlog.appendMu.Unlock()
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	if vlog.closed {
+		return nil, ErrValueLogClosed
+	}
+	sizes := make(map[uint32]int64)
+	for number, file := range vlog.files {
+		if number == vlog.active {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sizes[number] = info.Size()
+	}
+	return sizes, nil
+}
+
+// remove closes and deletes the file with given number. Readers of the file
+// fail afterwards.
+func (vlog *ValueLog) remove(number uint32) error {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	file, ok := vlog.files[number]
+	if !ok {
+		return nil
+	}
+	delete(vlog.files, number)
+	file.Close()
+	return os.Remove(vlog.path(number))
+}
+
+// isValueLogged returns whether given value is stored in value log.
+func (s *SkipList) isValueLogged(val []byte) bool {
+	return s.vlog != nil && (len(val) > s.valueLogThreshold || uint64(len(val)) >= uint64(valueCompressedFlag))
+}
+
+// loadValuePointer returns the value pointer stored for given encoded value
+// in given allocator.
+func (s *SkipList) loadValuePointer(allc Arena, encodedValue uint64) valuePointer {
+	offset, _ := s.getValueBounds(allc, encodedValue)
+	return decodeValuePointer(allc.BytesAt(offset, valuePointerSize))
+}
+
+// CollectValueLog reclaims the space of the value log files which are not
+// appended to anymore and have at least given ratio of their bytes taken by
+// values which are overwritten. Live values of such a file are appended to
+// the log again, and the file is deleted. It returns the number of deleted
+// files.
+//
+// Writers are blocked during collection, readers are not. Value pointers in
+// value arena are replaced, adding to WastedValueBytes. Snapshots written by
+// WriteSnapshot refer to log files, so they can not be loaded once the files
+// are deleted, unlike snapshots of ExportSnapshot.
+func (s *SkipList) CollectValueLog(discardRatio float64) (int, error) {
+	if s.vlog == nil {
+		return 0, ErrNoValueLog
+	}
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	sizes, err := s.vlog.sealedFiles()
+	if err != nil {
+		return 0, err
+	}
+	allc := s.getValueAllocator()
+	liveBytes := make(map[uint32]int64)
+	liveNodes := make(map[uint32][]*node)
+	for n := s.getNode(s.head.getNextNodeOffset(0)); n != nil; n = s.getNode(n.getNextNodeOffset(0)) {
+		encodedValue := n.loadValue()
+		if s.isInlineValue(encodedValue) || !s.isValuePointer(allc, encodedValue) {
+			continue
+		}
+		p := s.loadValuePointer(allc, encodedValue)
+		liveBytes[p.file] += valueLogHeaderSize + int64(p.size)
+		liveNodes[p.file] = append(liveNodes[p.file], n)
+	}
+
+	// Older files are collected first.
+	var numbers []uint32
+	for number, size := range sizes {
+		if float64(size-liveBytes[number]) >= discardRatio*float64(size) {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for i, number := range numbers {
+		for _, n := range liveNodes[number] {
+			encodedValue := n.loadValue()
+			val, err := s.vlog.read(s.loadValuePointer(allc, encodedValue))
+			if err != nil {
+				return i, err
+			}
+			p, err := s.vlog.append(val)
+			if err != nil {
+				return i, err
+			}
+			// Compressed values stay compressed.
+			newValue, err := s.putValuePointer(allc, p, s.getValueFlags(allc, encodedValue))
+			if err != nil {
+				return i, err
+			}
+			// Readers of the old pointer find out that it is replaced
+			// once the file is deleted, see getNodeValue.
+			n.storeValue(newValue)
+			valOffset, valSize := s.getValueBounds(allc, encodedValue)
+			s.stats.addWastedValueBytes(valOffset, s.valueStorageSize(valSize))
+		}
+		if err := s.vlog.remove(number); err != nil {
+			return i, err
+		}
+	}
+	return len(numbers), nil
+}
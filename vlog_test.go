@@ -0,0 +1,261 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Values larger than this are logged in value log tests.
+const testValueLogThreshold = 32
+
+// tempValueLog opens a value log in a new temporary directory, and returns
+// it with the directory and a function closing the log and removing the
+// directory.
+func tempValueLog(t *testing.T, opts ...ValueLogOption) (*ValueLog, string, func()) {
+	dir, err := ioutil.TempDir("", "goskip-vlog")
+	assert.NoError(t, err)
+	vlog, err := OpenValueLog(dir, opts...)
+	assert.NoError(t, err)
+	return vlog, dir, func() {
+		vlog.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// valueLogFiles returns the number of files in given value log directory.
+func valueLogFiles(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+valueLogFileExt))
+	assert.NoError(t, err)
+	return len(files)
+}
+
+// largeValue returns a value which is logged in value log tests.
+func largeValue(key string, version int) []byte {
+	return []byte(fmt.Sprintf("%s-%d-%s", key, version, bytes.Repeat([]byte("v"), testValueLogThreshold)))
+}
+
+func TestSkipList_ValueLog(t *testing.T) {
+	lists := map[string]func(vlog *ValueLog) *SkipList{
+		"Compact": func(vlog *ValueLog) *SkipList {
+			return NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold))
+		},
+		"Wide": func(vlog *ValueLog) *SkipList {
+			return NewWideSkipList(uint64(defaultAllocatorSize), WithValueLog(vlog, testValueLogThreshold))
+		},
+		"Tracked": func(vlog *ValueLog) *SkipList {
+			return NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold), WithChangeTracking())
+		},
+	}
+	for name, newList := range lists {
+		newList := newList
+		t.Run(name, func(t *testing.T) {
+			vlog, _, remove := tempValueLog(t)
+			defer remove()
+			s := newList(vlog)
+			large := bytes.Repeat([]byte("large"), 100)
+			assert.NoError(t, s.Set([]byte("large"), large))
+			assert.NoError(t, s.Set([]byte("medium"), bytes.Repeat([]byte("m"), testValueLogThreshold)))
+			assert.NoError(t, s.Set([]byte("small"), []byte("small")))
+			assert.True(t, s.getValueAllocator().Used() < uint64(len(large)), "Large values must not be in value arena")
+			assert.Equal(t, large, s.Get([]byte("large")))
+			assert.Equal(t, bytes.Repeat([]byte("m"), testValueLogThreshold), s.Get([]byte("medium")))
+			assert.Equal(t, []byte("small"), s.Get([]byte("small")))
+
+			// Values move between value log and value arena.
+			assert.NoError(t, s.Set([]byte("large"), []byte("now small")))
+			assert.NoError(t, s.Set([]byte("medium"), large))
+			assert.NoError(t, s.Set([]byte("small"), large))
+			assert.Equal(t, []byte("now small"), s.Get([]byte("large")))
+			assert.Equal(t, large, s.Get([]byte("medium")))
+			assert.Equal(t, large, s.Get([]byte("small")))
+			assert.NoError(t, s.Validate())
+
+			assert.NoError(t, s.Compact())
+			assert.Equal(t, large, s.Get([]byte("medium")))
+			assert.NoError(t, s.Validate())
+			assert.NoError(t, s.ValueErr())
+		})
+	}
+}
+
+func TestSkipList_CollectValueLog(t *testing.T) {
+	vlog, dir, remove := tempValueLog(t, WithValueLogFileSize(1024))
+	defer remove()
+	s := NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold))
+	for version := 0; version < 10; version++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			assert.NoError(t, s.Set([]byte(key), largeValue(key, version)))
+		}
+	}
+	files := valueLogFiles(t, dir)
+	removed, err := s.CollectValueLog(0.5)
+	assert.NoError(t, err)
+	assert.True(t, removed > 0)
+	assert.True(t, valueLogFiles(t, dir) < files, "Files must be deleted")
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.Equal(t, largeValue(key, 9), s.Get([]byte(key)))
+	}
+	assert.NoError(t, s.Validate())
+
+	// Only files with enough overwritten values are collected.
+	removed, err = s.CollectValueLog(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestSkipList_CollectValueLog_NoValueLog(t *testing.T) {
+	_, err := NewSkipList(defaultAllocatorSize).CollectValueLog(0.5)
+	assert.Equal(t, ErrNoValueLog, err)
+}
+
+func TestSkipList_CollectValueLog_Parallel(t *testing.T) {
+	vlog, _, remove := tempValueLog(t, WithValueLogFileSize(4096))
+	defer remove()
+	s := NewSkipList(1<<24, WithValueLog(vlog, testValueLogThreshold))
+	const keyCount = 100
+	for i := 0; i < keyCount; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.NoError(t, s.Set([]byte(key), largeValue(key, 0)))
+	}
+	var stop uint32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; atomic.LoadUint32(&stop) == 0; j++ {
+				key := fmt.Sprintf("key-%d", j%keyCount)
+				if i == 0 {
+					assert.NoError(t, s.Set([]byte(key), largeValue(key, j)))
+					continue
+				}
+				val := s.Get([]byte(key))
+				assert.True(t, bytes.HasPrefix(val, []byte(key+"-")), "Value of %s is %q", key, val)
+			}
+		}(i)
+	}
+	for k := 0; k < 20; k++ {
+		_, err := s.CollectValueLog(0.3)
+		assert.NoError(t, err)
+	}
+	atomic.StoreUint32(&stop, 1)
+	wg.Wait()
+	assert.NoError(t, s.ValueErr())
+	assert.NoError(t, s.Validate())
+}
+
+func TestReadSnapshot_ValueLog(t *testing.T) {
+	vlog, dir, remove := tempValueLog(t)
+	defer remove()
+	s := NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold))
+	assert.NoError(t, s.Set([]byte("large"), largeValue("large", 0)))
+	assert.NoError(t, s.Set([]byte("small"), []byte("small")))
+	var buf bytes.Buffer
+	assert.NoError(t, vlog.Sync())
+	assert.NoError(t, s.WriteSnapshot(&buf))
+	assert.NoError(t, vlog.Close())
+
+	_, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<20)
+	assert.IsType(t, &SnapshotError{}, err, "Snapshot must not be loaded without its value log")
+
+	reopened, err := OpenValueLog(dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	loaded, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<20, WithValueLog(reopened, testValueLogThreshold))
+	assert.NoError(t, err)
+	assert.Equal(t, largeValue("large", 0), loaded.Get([]byte("large")))
+	assert.Equal(t, []byte("small"), loaded.Get([]byte("small")))
+
+	// New values are appended to a new file.
+	assert.NoError(t, loaded.Set([]byte("large"), largeValue("large", 1)))
+	assert.Equal(t, 2, valueLogFiles(t, dir))
+	assert.Equal(t, largeValue("large", 1), loaded.Get([]byte("large")))
+}
+
+func TestValueLog_Corrupted(t *testing.T) {
+	vlog, dir, remove := tempValueLog(t)
+	defer remove()
+	s := NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold))
+	assert.NoError(t, s.Set([]byte("large"), largeValue("large", 0)))
+
+	path := filepath.Join(dir, fmt.Sprintf("%06d%s", 1, valueLogFileExt))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 0x10
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	assert.Nil(t, s.Get([]byte("large")))
+	if assert.IsType(t, &ValueLogError{}, s.ValueErr()) {
+		assert.Contains(t, s.ValueErr().Error(), "checksum mismatch")
+	}
+}
+
+func TestValueLog_Closed(t *testing.T) {
+	vlog, _, remove := tempValueLog(t)
+	defer remove()
+	s := NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold))
+	assert.NoError(t, s.Set([]byte("large"), largeValue("large", 0)))
+	assert.NoError(t, vlog.Close())
+	assert.NoError(t, vlog.Close())
+	assert.Equal(t, ErrValueLogClosed, s.Set([]byte("large"), largeValue("large", 1)))
+	assert.NoError(t, s.Set([]byte("small"), []byte("small")), "Small values must not be logged")
+	assert.Nil(t, s.Get([]byte("large")))
+	assert.Equal(t, ErrValueLogClosed, s.ValueErr())
+}
+
+func BenchmarkSkipList_Get_ValueLog(b *testing.B) {
+	dir, _ := ioutil.TempDir("", "goskip-vlog")
+	defer os.RemoveAll(dir)
+	vlog, _ := OpenValueLog(dir)
+	defer vlog.Close()
+	s := NewSkipList(1<<26, WithValueLog(vlog, testValueLogThreshold))
+	for i := 0; i < 1<<12; i++ {
+		key := fmt.Sprintf("key-%09d", i)
+		s.Set([]byte(key), largeValue(key, 0))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Get([]byte(fmt.Sprintf("key-%09d", i%(1<<12))))
+	}
+}
+
+func TestValueLog_Encrypted(t *testing.T) {
+	vlog, dir, remove := tempValueLog(t, WithValueLogEncryption(newTestKeyring(t, 1)))
+	defer remove()
+	s := NewSkipList(defaultAllocatorSize, WithValueLog(vlog, testValueLogThreshold))
+	assert.NoError(t, s.Set([]byte("large"), largeValue("large", 0)))
+	assert.Equal(t, largeValue("large", 0), s.Get([]byte("large")))
+	assert.NoError(t, vlog.Close())
+
+	path := filepath.Join(dir, fmt.Sprintf("%06d%s", 1, valueLogFileExt))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("large-0")), "Values must be encrypted")
+
+	// Values are read after rotation.
+	reopened, err := OpenValueLog(dir, WithValueLogEncryption(newTestKeyring(t, 2, 1)))
+	assert.NoError(t, err)
+	defer reopened.Close()
+	s.vlog = reopened
+	assert.NoError(t, s.Set([]byte("other"), largeValue("other", 0)))
+	assert.Equal(t, largeValue("large", 0), s.Get([]byte("large")))
+	assert.Equal(t, largeValue("other", 0), s.Get([]byte("other")))
+	assert.NoError(t, s.ValueErr())
+
+	unknown, err := OpenValueLog(dir, WithValueLogEncryption(newTestKeyring(t, 2)))
+	assert.NoError(t, err)
+	defer unknown.Close()
+	s.vlog = unknown
+	assert.Nil(t, s.Get([]byte("large")))
+	assert.Equal(t, ErrUnknownKey, s.ValueErr())
+}
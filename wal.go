@@ -0,0 +1,652 @@
+package goskip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ Write-ahead log record layout, integers are little-endian:
+
+	[uint32 payload size][uint32 CRC-32C of payload][payload]
+
+ Payload of a set record:
+
+	[uint8 recordSet][uvarint key size][key][value]
+
+ Payload of a batch record, whose pairs are replayed together, see Batch:
+
+	[uint8 recordBatch]{[uvarint key size][key][uvarint value size][value]}...
+
+ Payload of a cancel record, appended once an update of the set or batch
+ record at given offset failed, so that only the updates applied before it
+ are replayed:
+
+	[uint8 recordCancel][uvarint offset of the record][uvarint applied updates]
+
+ Payload of an encrypted record, whose plaintext is the payload of another
+ record, see WithWALEncryption:
+
+	[uint8 recordEncrypted][sealed payload]
+
+ Payloads are sealed with the offset of their record in the log as additional
+ data, so that records can not be moved within the log. Records of a log are
+ either all encrypted or all plain.
+
+ A record is only valid if it is complete and its checksum matches. A crash
+ in the middle of a write leaves a torn record at the end of the log, which
+ is dropped by recovery. An invalid record followed by other data means the
+ log is corrupted.
+*/
+
+// Size of the record header, in bytes.
+const walHeaderSize = 8
+
+// Types of log records.
+const (
+	recordSet       = uint8(1)
+	recordEncrypted = uint8(2)
+	recordCancel    = uint8(3)
+	recordBatch     = uint8(4)
+)
+
+// Number of key locks of a log, must be a power of 2.
+const walKeyLockCount = 256
+
+// Default interval of SyncPeriodic.
+const defaultSyncInterval = 100 * time.Millisecond
+
+// CRC-32C is computed by hardware on most CPUs.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrWALClosed is returned by Set and Apply for lists whose log is closed.
+var ErrWALClosed = errors.New("goskip: write-ahead log is closed")
+
+// ErrWALRecordTooLarge is returned by Set and Apply for updates whose log
+// record payload would be 4GB or more, see the record layout.
+var ErrWALRecordTooLarge = errors.New("goskip: update is too large for write-ahead log")
+
+// ErrWALEncryption is returned by OpenWAL and Recover if records of a log
+// are encrypted but no keyring is given, or the other way around.
+var ErrWALEncryption = errors.New("goskip: write-ahead log encryption differs from options")
+
+// WALCorruptionError is returned when a log contains an invalid record
+// which is not at its end, so it can not be a torn write.
+type WALCorruptionError struct {
+	// Offset of the invalid record in log file.
+	Offset int64
+
+	// Reason describes what is invalid.
+	Reason string
+}
+
+func (e *WALCorruptionError) Error() string {
+	return fmt.Sprintf("goskip: write-ahead log is corrupted at offset %d: %s", e.Offset, e.Reason)
+}
+
+// SyncPolicy decides when a write-ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log before Set returns. Set survives both process
+	// and OS crashes once it returns. Concurrent writers share syncs.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodic syncs the log in background, see WithSyncInterval.
+	// Set survives process crashes once it returns, but updates of the
+	// last interval might be lost on OS crashes.
+	SyncPeriodic
+
+	// SyncNever leaves flushing to the OS. Set survives process crashes
+	// once it returns.
+	SyncNever
+)
+
+// walOptions keeps the configuration of a write-ahead log.
+type walOptions struct {
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	keyring      *Keyring
+}
+
+// WALOption configures a write-ahead log opened by OpenWAL.
+type WALOption func(*walOptions)
+
+// WithSyncPolicy sets when the log is synced, SyncAlways by default.
+func WithSyncPolicy(policy SyncPolicy) WALOption {
+	return func(o *walOptions) {
+		o.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets the interval of SyncPeriodic, 100ms by default.
+func WithSyncInterval(interval time.Duration) WALOption {
+	return func(o *walOptions) {
+		o.syncInterval = interval
+	}
+}
+
+// WithWALEncryption encrypts the records appended to the log with the current
+// key of given keyring, pass the keyring to Recover with WithRecoveryKeyring
+// to read the log. Every record of a log must be encrypted, so logs with plain
+// records are refused with it, and logs with encrypted records without it.
+func WithWALEncryption(keyring *Keyring) WALOption {
+	return func(o *walOptions) {
+		o.keyring = keyring
+	}
+}
+
+// WAL is a write-ahead log of a skip list, see OpenWAL and WithWAL.
+//
+// Records of concurrent writers are committed in groups: the first writer
+// which finds no commit in progress becomes the leader, writes every record
+// appended so far with a single write and sync, then wakes up the others.
+// Records appended during a commit are committed by the next leader.
+type WAL struct {
+	file    *os.File
+	options walOptions
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Records appended but not written to file yet.
+	pending []byte
+
+	// Buffer of the last commit, reused for pending records.
+	spare []byte
+
+	// Number of records appended and committed so far.
+	appended  uint64
+	committed uint64
+
+	// Size of the log once pending records are written, which is the offset
+	// of the next record.
+	size int64
+
+	// Whether a leader is committing records.
+	committing bool
+
+	// Error of the last failed commit, records can not be committed after it.
+	err error
+
+	// Closed to stop periodic syncs.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Writers of the same key append and apply their records holding the
+	// same lock, so that records of a key are in the order they became visible.
+	keyLocks [walKeyLockCount]sync.Mutex
+}
+
+// OpenWAL opens the log at given path for appending, creating it if it does
+// not exist. A torn record at the end, left by a crash, is truncated so that
+// new records follow the valid ones. If the log is corrupted, an error of type
+// *WALCorruptionError is returned. ErrWALEncryption is returned if the records
+// of the log are encrypted but WithWALEncryption is not given, or the other
+// way around.
+func OpenWAL(path string, opts ...WALOption) (*WAL, error) {
+	o := walOptions{syncPolicy: SyncAlways, syncInterval: defaultSyncInterval}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, encrypted, err := readWAL(file, nil, nil)
+	if err == nil && size > 0 && encrypted != (o.keyring != nil) {
+		err = ErrWALEncryption
+	}
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &WAL{file: file, options: o, size: size, done: make(chan struct{})}
+	w.cond = sync.NewCond(&w.mu)
+	if o.syncPolicy == SyncPeriodic {
+		w.wg.Add(1)
+		go w.syncPeriodically()
+	}
+	return w, nil
+}
+
+// syncPeriodically syncs the log at every sync interval until it is closed.
+func (w *WAL) syncPeriodically() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.options.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.file.Sync(); err != nil {
+				w.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// Close syncs and closes the log. Set and Apply return ErrWALClosed afterwards.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	for w.committing {
+		w.cond.Wait()
+	}
+	if w.err == ErrWALClosed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.err = ErrWALClosed
+	w.mu.Unlock()
+
+	close(w.done)
+	w.wg.Wait()
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fail makes every following commit return given error.
+func (w *WAL) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+// keyLockIndex returns the index of the key lock of given key.
+func keyLockIndex(key []byte) int {
+	return int(crc32.Checksum(key, castagnoliTable) & (walKeyLockCount - 1))
+}
+
+// lockKey locks the key lock of given key.
+func (w *WAL) lockKey(key []byte) *sync.Mutex {
+	lock := &w.keyLocks[keyLockIndex(key)]
+	lock.Lock()
+	return lock
+}
+
+// lockKeys locks the key locks of given keys and returns them. Locks are
+// taken in index order, so that writers of overlapping keys do not deadlock.
+func (w *WAL) lockKeys(keys [][]byte) []*sync.Mutex {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = keyLockIndex(key)
+	}
+	sort.Ints(indexes)
+	var locks []*sync.Mutex
+	for i, index := range indexes {
+		if i > 0 && index == indexes[i-1] {
+			continue
+		}
+		lock := &w.keyLocks[index]
+		lock.Lock()
+		locks = append(locks, lock)
+	}
+	return locks
+}
+
+// appendSet appends a set record, and returns its offset once it is committed.
+func (w *WAL) appendSet(key []byte, val []byte) (int64, error) {
+	return w.appendRecord(appendSetPayload(nil, key, val))
+}
+
+// appendCancel appends a cancel record of the record at given offset, whose
+// given number of updates are applied, and returns once it is committed.
+func (w *WAL) appendCancel(offset int64, applied int) error {
+	var payload [1 + 2*binary.MaxVarintLen64]byte
+	payload[0] = recordCancel
+	n := 1 + binary.PutUvarint(payload[1:], uint64(offset))
+	n += binary.PutUvarint(payload[n:], uint64(applied))
+	_, err := w.appendRecord(payload[:n])
+	return err
+}
+
+// appendRecord appends a record of given payload, and returns its offset
+// once it is committed.
+func (w *WAL) appendRecord(payload []byte) (int64, error) {
+	if err := checkWALRecordSize(w.options.keyring, uint64(len(payload))); err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	offset, start := w.size, len(w.pending)
+	if w.options.keyring != nil {
+		// Payloads are sealed with the offset of their record, which is
+		// only known holding the lock.
+		pending, err := appendEncryptedRecord(w.pending, w.options.keyring, payload, offset)
+		if err != nil {
+			return 0, err
+		}
+		w.pending = pending
+	} else {
+		w.pending = appendRecord(w.pending, payload)
+	}
+	w.size += int64(len(w.pending) - start)
+	w.appended++
+	seq := w.appended
+	for w.committed < seq {
+		if w.err != nil {
+			return 0, w.err
+		}
+		if w.committing {
+			w.cond.Wait()
+			continue
+		}
+		w.commit()
+	}
+	return offset, nil
+}
+
+// commit writes pending records to file as the leader of a group.
+// It is called holding mu, which is released during the write.
+func (w *WAL) commit() {
+	w.committing = true
+	records, seq := w.pending, w.appended
+	w.pending = w.spare[:0]
+	w.mu.Unlock()
+
+	_, err := w.file.Write(records)
+	if err == nil && w.options.syncPolicy == SyncAlways {
+		err = w.file.Sync()
+	}
+
+	w.mu.Lock()
+	w.spare = records
+	w.committing = false
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	if err == nil {
+		w.committed = seq
+	}
+	w.cond.Broadcast()
+}
+
+// appendSetPayload appends the payload of a set record of given key and
+// value to buf.
+func appendSetPayload(buf []byte, key []byte, val []byte) []byte {
+	var keySize [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(keySize[:], uint64(len(key)))
+	buf = append(buf, recordSet)
+	buf = append(buf, keySize[:n]...)
+	buf = append(buf, key...)
+	return append(buf, val...)
+}
+
+// appendRecord appends a record of given payload to buf.
+func appendRecord(buf []byte, payload []byte) []byte {
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, castagnoliTable))
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// checkWALRecordSize returns ErrWALRecordTooLarge if the record of a payload
+// with given size, encrypted with given keyring if it is not nil, does not
+// fit into the 32-bit size of record header.
+func checkWALRecordSize(keyring *Keyring, size uint64) error {
+	if keyring != nil {
+		size += 1 + uint64(keyring.sealOverhead())
+	}
+	if size > math.MaxUint32 {
+		return ErrWALRecordTooLarge
+	}
+	return nil
+}
+
+// appendEncryptedRecord appends an encrypted record of given payload to buf,
+// which is written at given offset of the log.
+func appendEncryptedRecord(buf []byte, keyring *Keyring, payload []byte, offset int64) ([]byte, error) {
+	start := len(buf)
+	for i := 0; i < walHeaderSize; i++ {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, recordEncrypted)
+	buf, err := keyring.seal(buf, payload, walRecordAdditionalData(offset))
+	if err != nil {
+		return nil, err
+	}
+	header := buf[start : start+walHeaderSize]
+	binary.LittleEndian.PutUint32(header, uint32(len(buf)-start-walHeaderSize))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(buf[start+walHeaderSize:], castagnoliTable))
+	return buf, nil
+}
+
+// walRecordAdditionalData returns the additional data of the encrypted
+// record at given offset of a log.
+func walRecordAdditionalData(offset int64) []byte {
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], uint64(offset))
+	return data[:]
+}
+
+// readWAL calls fn with the offset and payload of every record of the log in r,
+// and returns the size of the valid part of the log and whether its records
+// are encrypted. A torn record at the end is not an error. Encrypted records
+// are decrypted with given keyring, and fn is called with their plaintext.
+// If the keyring is not nil, plain records are refused with ErrWALEncryption.
+// If fn is nil, records are only checked to be complete. Payloads passed to fn
+// are not empty, and only valid until fn returns.
+func readWAL(r io.Reader, keyring *Keyring, fn func(offset int64, payload []byte) error) (int64, bool, error) {
+	reader := bufio.NewReader(r)
+	var header [walHeaderSize]byte
+	var payload []byte
+	offset := int64(0)
+	encrypted := false
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, encrypted, nil
+		} else if err != nil {
+			return offset, encrypted, err
+		}
+		size := binary.LittleEndian.Uint32(header[:])
+		// Size of a torn record might be garbage, so the buffer only grows
+		// as the payload is read.
+		buf := bytes.NewBuffer(payload[:0])
+		if _, err := io.CopyN(buf, reader, int64(size)); err == io.EOF {
+			return offset, encrypted, nil
+		} else if err != nil {
+			return offset, encrypted, err
+		}
+		payload = buf.Bytes()
+		if crc32.Checksum(payload, castagnoliTable) != binary.LittleEndian.Uint32(header[4:]) {
+			if _, err := reader.Peek(1); err == io.EOF {
+				return offset, encrypted, nil
+			}
+			return offset, encrypted, &WALCorruptionError{Offset: offset, Reason: "checksum mismatch"}
+		}
+		// The first record decides whether records are encrypted.
+		isEncrypted := len(payload) > 0 && payload[0] == recordEncrypted
+		if offset == 0 {
+			encrypted = isEncrypted
+			if keyring != nil && !encrypted {
+				return offset, encrypted, ErrWALEncryption
+			}
+		} else if isEncrypted != encrypted {
+			return offset, encrypted, &WALCorruptionError{Offset: offset, Reason: "encrypted and plain records are mixed"}
+		}
+		if fn != nil {
+			record := payload
+			if isEncrypted {
+				var err error
+				if record, err = keyring.open(record[1:], walRecordAdditionalData(offset)); err != nil {
+					return offset, encrypted, err
+				}
+			}
+			if len(record) == 0 {
+				return offset, encrypted, &WALCorruptionError{Offset: offset, Reason: "empty record"}
+			}
+			if err := fn(offset, record); err != nil {
+				return offset, encrypted, err
+			}
+		}
+		offset += walHeaderSize + int64(size)
+	}
+}
+
+// decodeSetRecord returns the key and value of a set record payload.
+func decodeSetRecord(payload []byte) ([]byte, []byte, error) {
+	keySize, n := binary.Uvarint(payload[1:])
+	if n <= 0 || keySize > uint64(len(payload)-1-n) {
+		return nil, nil, errors.New("invalid key size")
+	}
+	keyEnd := 1 + n + int(keySize)
+	return payload[1+n : keyEnd], payload[keyEnd:], nil
+}
+
+// decodeCancelRecord returns the offset of the record cancelled by given
+// cancel record payload, and the number of its updates which are applied.
+func decodeCancelRecord(payload []byte) (int64, int, error) {
+	offset, n := binary.Uvarint(payload[1:])
+	if n <= 0 || offset > math.MaxInt64 {
+		return 0, 0, errors.New("invalid cancelled record offset")
+	}
+	applied, m := binary.Uvarint(payload[1+n:])
+	if m <= 0 || 1+n+m != len(payload) || applied > math.MaxInt32 {
+		return 0, 0, errors.New("invalid number of applied updates")
+	}
+	return int64(offset), int(applied), nil
+}
+
+// RecoveryReport describes the records replayed by Recover.
+type RecoveryReport struct {
+	// Number of updates applied to the list.
+	Applied int
+
+	// Number of updates which are not replayed since they, or an update
+	// before them in the same batch, failed when they were logged, see Set
+	// and Apply.
+	Cancelled int
+
+	// Updates which failed when they were replayed, in log order.
+	Skipped []SkippedRecord
+}
+
+// SkippedRecord is an update of a log which Recover could not apply.
+// Updates which fail after they are logged are cancelled by Set and Apply,
+// so this is left for updates whose writer crashed before it could cancel
+// them, and for lists which are smaller or have other options than the
+// logging one.
+type SkippedRecord struct {
+	// Offset of the record in log file.
+	Offset int64
+
+	Key []byte
+
+	// Error of the update, such as ErrArenaFull.
+	Err error
+}
+
+// Recover creates a list with NewSkipList and replays the log at given path
+// into it. Updates of a key are replayed in the order they became visible.
+// Batches are replayed as a whole, or not at all if their record is torn.
+// Updates which can not be applied are skipped and reported, the others are
+// still replayed.
+// To keep logging updates of the recovered list, open the log with OpenWAL
+// first and pass it with WithWAL; replayed records are not appended again.
+// Encrypted records are decrypted with the keyring of WithRecoveryKeyring,
+// ErrUnknownKey is returned if their key is not in it, and ErrDecryption if
+// they are modified or moved. If the keyring is given, logs with plain
+// records are refused with ErrWALEncryption.
+func Recover(path string, allocatorSize uint32, opts ...Option) (*SkipList, *RecoveryReport, error) {
+	return recoverInto(path, NewSkipList(allocatorSize, opts...), newOptions(opts).recoveryKeyring)
+}
+
+// RecoverWide is the same as Recover for lists created with NewWideSkipList.
+func RecoverWide(path string, allocatorSize uint64, opts ...Option) (*SkipList, *RecoveryReport, error) {
+	return recoverInto(path, NewWideSkipList(allocatorSize, opts...), newOptions(opts).recoveryKeyring)
+}
+
+// recoverInto replays the log at given path into given list.
+func recoverInto(path string, s *SkipList, keyring *Keyring) (*SkipList, *RecoveryReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	// Cancel records follow the records they cancel, so they are read first.
+	// Offsets of cancelled records are mapped to their applied updates.
+	cancelled := make(map[int64]int)
+	_, _, err = readWAL(file, keyring, func(offset int64, payload []byte) error {
+		if payload[0] != recordCancel {
+			return nil
+		}
+		recordOffset, applied, err := decodeCancelRecord(payload)
+		if err != nil {
+			return &WALCorruptionError{Offset: offset, Reason: err.Error()}
+		}
+		cancelled[recordOffset] = applied
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	report := &RecoveryReport{}
+	_, _, err = readWAL(file, keyring, func(offset int64, payload []byte) error {
+		var keys, vals [][]byte
+		var err error
+		switch payload[0] {
+		case recordCancel:
+			return nil
+		case recordSet:
+			var key, val []byte
+			key, val, err = decodeSetRecord(payload)
+			keys, vals = [][]byte{key}, [][]byte{val}
+		case recordBatch:
+			keys, vals, err = decodeBatchRecord(payload)
+		default:
+			err = errors.New("unknown record type")
+		}
+		if err != nil {
+			return &WALCorruptionError{Offset: offset, Reason: err.Error()}
+		}
+		if applied, ok := cancelled[offset]; ok && applied < len(keys) {
+			report.Cancelled += len(keys) - applied
+			keys = keys[:applied]
+		}
+		for i, key := range keys {
+			if err := s.set(key, vals[i]); err != nil {
+				skipped := SkippedRecord{Offset: offset, Key: append([]byte{}, key...), Err: err}
+				report.Skipped = append(report.Skipped, skipped)
+				continue
+			}
+			report.Applied++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, report, nil
+}
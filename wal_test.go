@@ -0,0 +1,398 @@
+package goskip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tempWALPath returns the path of a log in a new temporary directory,
+// and a function removing the directory.
+func tempWALPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "goskip-wal")
+	assert.NoError(t, err)
+	return filepath.Join(dir, "wal"), func() { os.RemoveAll(dir) }
+}
+
+// newLoggedList returns a list logging updates to the log at given path.
+func newLoggedList(t *testing.T, path string, opts ...WALOption) (*SkipList, *WAL) {
+	wal, err := OpenWAL(path, opts...)
+	assert.NoError(t, err)
+	return NewSkipList(defaultAllocatorSize, WithWAL(wal)), wal
+}
+
+// appendSetRecord appends a set record of given key and value to buf.
+func appendSetRecord(buf []byte, key []byte, val []byte) []byte {
+	return appendRecord(buf, appendSetPayload(nil, key, val))
+}
+
+func TestAppendSetRecord(t *testing.T) {
+	for _, data := range uniqueNodesData {
+		record := appendSetRecord(nil, data.key, data.val)
+		var key, val []byte
+		size, encrypted, err := readWAL(bytes.NewReader(record), nil, func(offset int64, payload []byte) error {
+			assert.Equal(t, int64(0), offset)
+			k, v, err := decodeSetRecord(payload)
+			key, val = append([]byte{}, k...), append([]byte{}, v...)
+			return err
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(record)), size)
+		assert.False(t, encrypted)
+		assert.Equal(t, data.key, key)
+		assert.Equal(t, data.val, val)
+	}
+}
+
+func TestCheckWALRecordSize(t *testing.T) {
+	keyring := newTestKeyring(t, 1)
+	assert.NoError(t, checkWALRecordSize(nil, math.MaxUint32))
+	assert.Equal(t, ErrWALRecordTooLarge, checkWALRecordSize(nil, math.MaxUint32+1))
+	sealedSize := math.MaxUint32 - 1 - uint64(keyring.sealOverhead())
+	assert.NoError(t, checkWALRecordSize(keyring, sealedSize))
+	assert.Equal(t, ErrWALRecordTooLarge, checkWALRecordSize(keyring, sealedSize+1), "Sealed payloads must fit")
+}
+
+func TestRecover(t *testing.T) {
+	policies := map[string]SyncPolicy{
+		"Always":   SyncAlways,
+		"Periodic": SyncPeriodic,
+		"Never":    SyncNever,
+	}
+	for name, policy := range policies {
+		policy := policy
+		t.Run(name, func(t *testing.T) {
+			path, remove := tempWALPath(t)
+			defer remove()
+			s, wal := newLoggedList(t, path, WithSyncPolicy(policy), WithSyncInterval(time.Millisecond))
+			for _, data := range uniqueNodesData {
+				assert.NoError(t, s.Set(data.key, []byte("old")))
+				assert.NoError(t, s.Set(data.key, data.val))
+			}
+			assert.NoError(t, wal.Close())
+			assert.Equal(t, ErrWALClosed, s.Set([]byte("key"), []byte("value")))
+			assert.NoError(t, wal.Close(), "Closing twice must do nothing")
+
+			recovered, report, err := Recover(path, defaultAllocatorSize)
+			assert.NoError(t, err)
+			assert.Equal(t, &RecoveryReport{Applied: 2 * len(uniqueNodesData)}, report)
+			for _, data := range uniqueNodesData {
+				assert.Equal(t, data.val, recovered.Get(data.key))
+			}
+			assert.Nil(t, recovered.Get([]byte("key")), "Updates after Close must not be logged")
+			assert.NoError(t, recovered.Validate())
+		})
+	}
+}
+
+func TestRecover_Parallel(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	t.Run("Group", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			i := i
+			t.Run(fmt.Sprintf("Writer-%d", i), func(t *testing.T) {
+				t.Parallel()
+				for j := 0; j < 100; j++ {
+					// Every writer updates shared keys as well.
+					assert.NoError(t, s.Set([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte("value")))
+					assert.NoError(t, s.Set([]byte(fmt.Sprintf("shared-%d", j%10)), []byte(fmt.Sprintf("value-%d", i))))
+				}
+			})
+		}
+	})
+	assert.NoError(t, wal.Close())
+
+	recovered, _, err := Recover(path, defaultAllocatorSize)
+	assert.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 100; j++ {
+			assert.Equal(t, []byte("value"), recovered.Get([]byte(fmt.Sprintf("key-%d-%d", i, j))))
+		}
+	}
+	for j := 0; j < 10; j++ {
+		key := []byte(fmt.Sprintf("shared-%d", j))
+		assert.Equal(t, s.Get(key), recovered.Get(key), "Last visible value must be recovered")
+	}
+}
+
+func TestRecover_Reopen(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	assert.NoError(t, s.Set([]byte("key1"), []byte("value1")))
+	assert.NoError(t, wal.Close())
+
+	wal, err := OpenWAL(path)
+	assert.NoError(t, err)
+	s, _, err = Recover(path, defaultAllocatorSize, WithWAL(wal))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set([]byte("key2"), []byte("value2")))
+	assert.NoError(t, wal.Close())
+
+	s, _, err = Recover(path, defaultAllocatorSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value1"), s.Get([]byte("key1")))
+	assert.Equal(t, []byte("value2"), s.Get([]byte("key2")))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*len(appendSetRecord(nil, []byte("key1"), []byte("value1")))), info.Size(),
+		"Replayed records must not be logged again")
+}
+
+func TestRecover_TornWrite(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	assert.NoError(t, s.Set([]byte("key1"), []byte("value1")))
+	assert.NoError(t, wal.Close())
+	valid, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	record := appendSetRecord(nil, []byte("key2"), []byte("value2"))
+	torn := map[string][]byte{
+		"Header":   record[:walHeaderSize/2],
+		"Payload":  record[:len(record)-1],
+		"Checksum": append(record[:len(record)-1:len(record)-1], 0),
+	}
+	for name, tail := range torn {
+		tail := tail
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, ioutil.WriteFile(path, append(append([]byte{}, valid...), tail...), 0644))
+			recovered, _, err := Recover(path, defaultAllocatorSize)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value1"), recovered.Get([]byte("key1")))
+			assert.Nil(t, recovered.Get([]byte("key2")))
+
+			// Reopening drops the torn record, so that new records are readable.
+			s, wal := newLoggedList(t, path)
+			assert.NoError(t, s.Set([]byte("key3"), []byte("value3")))
+			assert.NoError(t, wal.Close())
+			recovered, _, err = Recover(path, defaultAllocatorSize)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value1"), recovered.Get([]byte("key1")))
+			assert.Equal(t, []byte("value3"), recovered.Get([]byte("key3")))
+		})
+	}
+}
+
+func TestRecover_Corrupted(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	assert.NoError(t, s.Set([]byte("key1"), []byte("value1")))
+	assert.NoError(t, s.Set([]byte("key2"), []byte("value2")))
+	assert.NoError(t, wal.Close())
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	data[walHeaderSize+2] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	_, _, err = Recover(path, defaultAllocatorSize)
+	assert.Equal(t, &WALCorruptionError{Offset: 0, Reason: "checksum mismatch"}, err)
+	_, err = OpenWAL(path)
+	assert.IsType(t, &WALCorruptionError{}, err, "Corrupted log must not be truncated")
+}
+
+func TestRecover_Failed(t *testing.T) {
+	keyring := newTestKeyring(t, 1)
+	logs := map[string]struct {
+		walOpts  []WALOption
+		listOpts []Option
+	}{
+		"Plain":     {nil, nil},
+		"Encrypted": {[]WALOption{WithWALEncryption(keyring)}, []Option{WithRecoveryKeyring(keyring)}},
+	}
+	for name, log := range logs {
+		log := log
+		t.Run(name, func(t *testing.T) {
+			path, remove := tempWALPath(t)
+			defer remove()
+			wal, err := OpenWAL(path, log.walOpts...)
+			assert.NoError(t, err)
+			s := NewSkipList(4096, WithWAL(wal))
+			assert.NoError(t, s.Set([]byte("a"), []byte("value-a")))
+			assert.Equal(t, ErrArenaFull, s.Set([]byte("b"), bytes.Repeat([]byte("b"), 5000)))
+			assert.NoError(t, s.Set([]byte("c"), []byte("value-c")))
+			assert.NoError(t, wal.Close())
+
+			// Failed updates are not replayed, even if they fit now.
+			for _, size := range []uint32{4096, 1 << 20} {
+				recovered, report, err := Recover(path, size, log.listOpts...)
+				assert.NoError(t, err, "Size %d", size)
+				assert.Equal(t, &RecoveryReport{Applied: 2, Cancelled: 1}, report, "Size %d", size)
+				assert.Equal(t, []byte("value-a"), recovered.Get([]byte("a")), "Size %d", size)
+				assert.Nil(t, recovered.Get([]byte("b")), "Size %d", size)
+				assert.Equal(t, []byte("value-c"), recovered.Get([]byte("c")), "Size %d", size)
+			}
+		})
+	}
+}
+
+func TestRecover_Skipped(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path)
+	assert.NoError(t, s.Set([]byte("a"), []byte("value-a")))
+	assert.NoError(t, s.Set([]byte("b"), bytes.Repeat([]byte("b"), 5000)))
+	assert.NoError(t, s.Set([]byte("c"), []byte("value-c")))
+	assert.NoError(t, wal.Close())
+
+	// Updates which do not fit into the recovered list are skipped.
+	recovered, report, err := Recover(path, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Applied)
+	assert.Equal(t, 0, report.Cancelled)
+	if assert.Len(t, report.Skipped, 1) {
+		skipped := report.Skipped[0]
+		assert.Equal(t, int64(len(appendSetRecord(nil, []byte("a"), []byte("value-a")))), skipped.Offset)
+		assert.Equal(t, []byte("b"), skipped.Key)
+		assert.Equal(t, ErrArenaFull, skipped.Err)
+	}
+	assert.Equal(t, []byte("value-a"), recovered.Get([]byte("a")))
+	assert.Nil(t, recovered.Get([]byte("b")))
+	assert.Equal(t, []byte("value-c"), recovered.Get([]byte("c")))
+	assert.NoError(t, recovered.Validate())
+}
+
+func BenchmarkSkipList_Set_WAL(b *testing.B) {
+	policies := []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{"Always", SyncAlways},
+		{"Never", SyncNever},
+	}
+	for _, policy := range policies {
+		policy := policy
+		b.Run(policy.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "goskip-wal")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			wal, err := OpenWAL(filepath.Join(dir, "wal"), WithSyncPolicy(policy.policy))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wal.Close()
+			s := NewSkipList(uint32(b.N)*192+1<<20, WithWAL(wal))
+			var writer uint64
+			b.ResetTimer()
+			// Concurrent writers share syncs.
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				id := atomic.AddUint64(&writer, 1)
+				for i := 0; pb.Next(); i++ {
+					s.Set([]byte(fmt.Sprintf("key-%d-%09d", id, i)), []byte("value"))
+				}
+			})
+		})
+	}
+}
+
+func TestRecover_Encrypted(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path, WithWALEncryption(newTestKeyring(t, 1)))
+	assert.NoError(t, s.Set([]byte("first"), []byte("first value")))
+	assert.NoError(t, wal.Close())
+	// Records appended after reopening are sealed with their offsets too.
+	s, wal = newLoggedList(t, path, WithWALEncryption(newTestKeyring(t, 1)))
+	for _, data := range uniqueNodesData {
+		assert.NoError(t, s.Set(data.key, data.val))
+	}
+	assert.NoError(t, wal.Close())
+
+	log, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(log, []byte("first value")), "Values must be encrypted")
+	assert.False(t, bytes.Contains(log, uniqueNodesData[0].val), "Values must be encrypted")
+
+	_, _, err = Recover(path, defaultAllocatorSize)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	// Logs are recovered after rotation.
+	recovered, _, err := Recover(path, defaultAllocatorSize, WithRecoveryKeyring(newTestKeyring(t, 2, 1)))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first value"), recovered.Get([]byte("first")))
+	for _, data := range uniqueNodesData {
+		assert.Equal(t, data.val, recovered.Get(data.key))
+	}
+	assert.NoError(t, recovered.Validate())
+}
+
+func TestRecover_Encrypted_Moved(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path, WithWALEncryption(newTestKeyring(t, 1)))
+	assert.NoError(t, s.Set([]byte("key-a"), []byte("value-a")))
+	assert.NoError(t, s.Set([]byte("key-b"), []byte("value-b")))
+	assert.NoError(t, wal.Close())
+
+	// Records have the same size, their checksums match after the swap.
+	log, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	half := len(log) / 2
+	swapped := append(append([]byte{}, log[half:]...), log[:half]...)
+	assert.NoError(t, ioutil.WriteFile(path, swapped, 0644))
+
+	_, _, err = Recover(path, defaultAllocatorSize, WithRecoveryKeyring(newTestKeyring(t, 1)))
+	assert.Equal(t, ErrDecryption, err, "Moved records must not be replayed")
+}
+
+func TestRecover_Encrypted_PlainRecord(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	s, wal := newLoggedList(t, path, WithWALEncryption(newTestKeyring(t, 1)))
+	assert.NoError(t, s.Set([]byte("key"), []byte("value")))
+	assert.NoError(t, wal.Close())
+
+	log, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	injected := appendSetRecord(append([]byte{}, log...), []byte("key"), []byte("injected"))
+	assert.NoError(t, ioutil.WriteFile(path, injected, 0644))
+
+	_, _, err = Recover(path, defaultAllocatorSize, WithRecoveryKeyring(newTestKeyring(t, 1)))
+	assert.Equal(t, &WALCorruptionError{Offset: int64(len(log)), Reason: "encrypted and plain records are mixed"}, err)
+	_, err = OpenWAL(path, WithWALEncryption(newTestKeyring(t, 1)))
+	assert.IsType(t, &WALCorruptionError{}, err)
+
+	// Logs of plain records only are refused if they must be encrypted.
+	assert.NoError(t, ioutil.WriteFile(path, injected[len(log):], 0644))
+	_, _, err = Recover(path, defaultAllocatorSize, WithRecoveryKeyring(newTestKeyring(t, 1)))
+	assert.Equal(t, ErrWALEncryption, err)
+}
+
+func TestOpenWAL_Encryption(t *testing.T) {
+	path, remove := tempWALPath(t)
+	defer remove()
+	// Empty logs are opened either way.
+	wal, err := OpenWAL(path)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+	wal, err = OpenWAL(path, WithWALEncryption(newTestKeyring(t, 1)))
+	assert.NoError(t, err)
+	s := NewSkipList(defaultAllocatorSize, WithWAL(wal))
+	assert.NoError(t, s.Set([]byte("key"), []byte("value")))
+	assert.NoError(t, wal.Close())
+
+	_, err = OpenWAL(path)
+	assert.Equal(t, ErrWALEncryption, err, "Plain records must not be appended to encrypted logs")
+
+	plainPath := path + "-plain"
+	s, wal = newLoggedList(t, plainPath)
+	assert.NoError(t, s.Set([]byte("key"), []byte("value")))
+	assert.NoError(t, wal.Close())
+	_, err = OpenWAL(plainPath, WithWALEncryption(newTestKeyring(t, 1)))
+	assert.Equal(t, ErrWALEncryption, err, "Encrypted records must not be appended to plain logs")
+}